@@ -3,25 +3,43 @@ package main
 import (
 	"flag"
 	"github.com/yydzero/mnt/libpq"
+	"golang.org/x/net/context"
 	"log"
-	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
-	"io"
+	"syscall"
+	"time"
 )
 
 var port string
 var count int
+var shutdownTimeout time.Duration
+var socketDir string
+var metricsAddr string
 
 func main() {
 	log.SetFlags(log.Ltime | log.Lshortfile)
 
 	flag.StringVar(&port, "p", "5432", "port to listen on")
 	flag.IntVar(&count, "c", 10, "Default port to connect")
+	flag.StringVar(&socketDir, "k", "", "directory to also listen on Unix domain sockets in, eg: /tmp")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus metrics of all ports on at /metrics, eg: :9187")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "time to let statements finish on SIGTERM or SIGINT")
 
 	flag.Parse()
 
+	var opts []libpq.Option
+	if metricsAddr != "" {
+		metrics := libpq.NewMetrics()
+		opts = append(opts, libpq.WithMetrics(metrics))
+		go serveMetrics(metrics)
+	}
+
 	var wg sync.WaitGroup
+	var servers []*libpq.Server
 
 	for i := 0; i < count; i++ {
 		p, err := strconv.Atoi(port)
@@ -30,41 +48,84 @@ func main() {
 			panic(err)
 		}
 
-		wg.Add(1)
+		s := libpq.NewServer(opts...)
+		servers = append(servers, s)
 
-		go startServer(&wg, strconv.Itoa(p + i))
+		wg.Add(1)
+		go startServer(&wg, s, strconv.Itoa(p + i))
+		if socketDir != "" {
+			wg.Add(1)
+			go startUnixServer(&wg, s, p+i)
+		}
 	}
 
+	shutdown := make(chan struct{})
+	go func() {
+		shutdownOnSignal(servers)
+		close(shutdown)
+	}()
+
+	// The servers stop listening as soon as the shutdown starts, then
+	// their sessions are given time to finish.
 	wg.Wait()
+	<-shutdown
 
 	log.Println("Terminated.")
 }
 
-func startServer(wg *sync.WaitGroup, port string) {
+func startServer(wg *sync.WaitGroup, s *libpq.Server, port string) {
 	defer wg.Done()
 
-	ln, err := net.Listen("tcp", ":"+port)
-	if err != nil {
+	if err := s.ListenAndServe(":" + port); err != nil && err != libpq.ErrServerClosed {
 		panic(err)
 	}
-	log.Println("Listening on :" + port)
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			panic(err)
-		}
-		go handleConnection(conn)
+func startUnixServer(wg *sync.WaitGroup, s *libpq.Server, port int) {
+	defer wg.Done()
+
+	if err := s.ListenAndServeUnix(socketDir, port); err != nil && err != libpq.ErrServerClosed {
+		panic(err)
 	}
 }
 
-func handleConnection(conn net.Conn) {
-	log.Printf("get a new connection: %v\n", conn)
-	s := libpq.NewServer()
-	err := s.Serve(conn)
-	if err != io.EOF {
-		log.Printf("failed to handle a connection: %s\n", err.Error())
-	} else {
-		log.Println("Client closed connection.")
+// serveMetrics serves the metrics of the servers over HTTP.
+func serveMetrics(metrics *libpq.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Printf("Serving metrics on %s", metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		panic(err)
 	}
 }
+
+// shutdownOnSignal shuts the servers down on SIGTERM or SIGINT. A second
+// signal closes them straight away.
+func shutdownOnSignal(servers []*libpq.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("Received %v, shutting down.", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *libpq.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,296 @@
+// Package catalog emulates the pg_catalog and information_schema relations
+// that client tools query for introspection.
+//
+// Executor wraps another executor.Executor. Statements which read from one
+// of the emulated relations are answered from tables synthesized out of the
+// wrapped executor's schema (when it implements executor.SchemaProvider),
+// the server's built-in types and the session; every other statement is
+// passed through untouched.
+//
+// The SELECTs understood are those psql's describe commands, drivers and
+// ORMs issue to introspect a database:
+//
+//	SELECT [DISTINCT] targets FROM relation [alias]
+//		[{, | [INNER] JOIN | LEFT [OUTER] JOIN | CROSS JOIN} relation [alias] [ON expr] ...]
+//		[WHERE expr] [ORDER BY expr [ASC|DESC] [NULLS FIRST|LAST], ...]
+//		[LIMIT n] [OFFSET n]
+//
+// Expressions may use AND, OR and NOT; comparisons, including
+// OPERATOR(pg_catalog.~) and the other regular expression operators, LIKE,
+// IN, IS [NOT] NULL and ANY/ALL; ||, casts, CASE, scalar, ARRAY and EXISTS
+// subqueries, which may refer to the enclosing query, and the functions
+// listed in functions.go, pg_table_is_visible and format_type among them.
+// Anything else, such as aggregates, GROUP BY and UNION, fails with an
+// error rather than returning wrong rows.
+package catalog
+
+import (
+	"github.com/lib/pq/oid"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"golang.org/x/net/context"
+)
+
+// Type describes a built-in data type reported through pg_type.
+type Type struct {
+	Oid  oid.Oid
+	Name string
+
+	// Len is the pg_type.typlen of the type; variable-size types have -1.
+	Len int
+
+	// Category is the pg_type.typcategory of the type, eg: 'N' for numeric.
+	Category byte
+}
+
+// Executor answers catalog queries itself and delegates everything else.
+type Executor struct {
+	executor executor.Executor
+	types    []Type
+	typeOf   func(parser.Datum) oid.Oid
+}
+
+// New returns an Executor wrapping e. types lists the built-in types and
+// typeOf maps a column datum to the OID of its type.
+func New(e executor.Executor, types []Type, typeOf func(parser.Datum) oid.Oid) *Executor {
+	return &Executor{
+		executor: e,
+		types:    types,
+		typeOf:   typeOf,
+	}
+}
+
+// statement is a prepared catalog query.
+type statement struct {
+	q    *query
+	args parser.MapArgs
+}
+
+func (s *statement) Columns() []executor.ResultColumn {
+	return s.q.cols
+}
+
+func (s *statement) Args() parser.MapArgs {
+	return s.args
+}
+
+func (s *statement) Close() {
+}
+
+func (e *Executor) Prepare(ctx context.Context, query string, args parser.MapArgs) (
+	executor.PreparedStatement, error) {
+	if !e.isCatalogQuery(ctx, query) {
+		return e.executor.Prepare(ctx, query, args)
+	}
+
+	q, err := parseQuery(query, e.visibleTables(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &statement{q: q, args: q.args(args)}, nil
+}
+
+func (e *Executor) Execute(ctx context.Context, stmt executor.PreparedStatement, params []parser.Datum) executor.StatementResults {
+	s, ok := stmt.(*statement)
+	if !ok {
+		return e.executor.Execute(ctx, stmt, params)
+	}
+	return executor.StatementResults{
+		ResultList: executor.ResultList{e.run(ctx, s.q, params)},
+	}
+}
+
+func (e *Executor) ExecuteStatements(ctx context.Context, stmts string, params []parser.Datum) executor.StatementResults {
+	if !e.isCatalogQuery(ctx, stmts) {
+		return e.executor.ExecuteStatements(ctx, stmts, params)
+	}
+
+	var results executor.StatementResults
+	for _, stmt := range parser.Split(stmts) {
+		if !e.isCatalogStatement(ctx, stmt) {
+			r := e.executor.ExecuteStatements(ctx, stmt, params)
+			results.ResultList = append(results.ResultList, r.ResultList...)
+			continue
+		}
+		results.ResultList = append(results.ResultList, e.execute(ctx, stmt, params))
+	}
+	results.Empty = len(results.ResultList) == 0
+	return results
+}
+
+// ExecuteBatch passes a batch on to the wrapped executor if it implements
+// executor.BatchExecutor. Otherwise the statement is run once for each set
+// of parameters, until one fails.
+func (e *Executor) ExecuteBatch(ctx context.Context, stmt executor.PreparedStatement, params [][]parser.Datum) executor.ResultList {
+	if b, ok := e.executor.(executor.BatchExecutor); ok {
+		if _, ok := stmt.(*statement); !ok {
+			return b.ExecuteBatch(ctx, stmt, params)
+		}
+	}
+
+	var results executor.ResultList
+	for _, p := range params {
+		r := e.Execute(ctx, stmt, p)
+		results = append(results, r.ResultList...)
+		if failed(r.ResultList) {
+			break
+		}
+	}
+	return results
+}
+
+// Batches reports whether the wrapped executor runs batches itself, as an
+// executor.BatchExecutor. Otherwise ExecuteBatch runs them one Execute at a
+// time, which gains nothing over not batching them.
+func (e *Executor) Batches() bool {
+	_, ok := e.executor.(executor.BatchExecutor)
+	return ok
+}
+
+// failed reports whether any of the results is an error.
+func failed(results executor.ResultList) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// BeginImplicit passes the start of an implicit transaction on to the
+// wrapped executor, if it implements executor.ImplicitTransactor.
+func (e *Executor) BeginImplicit(ctx context.Context) error {
+	if t, ok := e.executor.(executor.ImplicitTransactor); ok {
+		return t.BeginImplicit(ctx)
+	}
+	return nil
+}
+
+// EndImplicit passes the end of an implicit transaction on to the wrapped
+// executor, if it implements executor.ImplicitTransactor.
+func (e *Executor) EndImplicit(ctx context.Context, commit bool) error {
+	if t, ok := e.executor.(executor.ImplicitTransactor); ok {
+		return t.EndImplicit(ctx, commit)
+	}
+	return nil
+}
+
+// execute runs a single catalog query.
+func (e *Executor) execute(ctx context.Context, stmt string, params []parser.Datum) executor.Result {
+	q, err := parseQuery(stmt, e.visibleTables(ctx))
+	if err != nil {
+		return executor.Result{Err: err}
+	}
+	return e.run(ctx, q, params)
+}
+
+// run runs a parsed catalog query.
+func (e *Executor) run(ctx context.Context, q *query, params []parser.Datum) executor.Result {
+	x := &execution{
+		e:      e,
+		ctx:    ctx,
+		params: params,
+		rows:   make(map[*relation][]executor.ResultRow),
+	}
+	rows, err := q.run(x, nil)
+	if err != nil {
+		return executor.Result{Err: err}
+	}
+	return executor.Result{
+		Type:    executor.Rows,
+		PGTag:   "SELECT",
+		Columns: q.cols,
+		Rows:    rows,
+	}
+}
+
+// userTables returns the tables exposed by the wrapped executor.
+func (e *Executor) userTables(ctx context.Context) []executor.Table {
+	p, ok := e.executor.(executor.SchemaProvider)
+	if !ok {
+		return nil
+	}
+	tables := p.Tables(ctx)
+	for i := range tables {
+		if tables[i].Schema == "" {
+			tables[i].Schema = "public"
+		}
+	}
+	return tables
+}
+
+// lookupType returns the built-in type with the given OID.
+func (e *Executor) lookupType(id oid.Oid) (Type, bool) {
+	for _, t := range e.types {
+		if t.Oid == id {
+			return t, true
+		}
+	}
+	return Type{}, false
+}
+
+// visibleTables returns the names of the wrapped executor's tables which
+// unqualified names refer to: those in the public schema.
+func (e *Executor) visibleTables(ctx context.Context) map[string]bool {
+	tables := make(map[string]bool)
+	for _, t := range e.userTables(ctx) {
+		if t.Schema == "public" {
+			tables[t.Name] = true
+		}
+	}
+	return tables
+}
+
+// isCatalogQuery reports whether any statement in query is a catalog
+// query.
+func (e *Executor) isCatalogQuery(ctx context.Context, query string) bool {
+	for _, stmt := range parser.Split(query) {
+		if e.isCatalogStatement(ctx, stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCatalogStatement reports whether stmt is a SELECT, or WITH, reading from
+// an emulated relation. Other statements, writes to such a relation among
+// them, are left to the wrapped executor.
+func (e *Executor) isCatalogStatement(ctx context.Context, stmt string) bool {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 || !(toks[0].Is("select") || toks[0].Is("with")) {
+		return false
+	}
+	var tables map[string]bool
+	for i := 0; i+1 < len(toks); i++ {
+		if !toks[i].Is("from") && !toks[i].Is("join") {
+			continue
+		}
+		if tables == nil {
+			tables = e.visibleTables(ctx)
+		}
+		if _, _, ok := relationAt(toks, i+1, tables); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// relationAt resolves a, possibly schema qualified, emulated relation name
+// starting at toks[i]. It returns the relation and the number of tokens used.
+// An unqualified name in tables is one of the wrapped executor's tables.
+func relationAt(toks []parser.Token, i int, tables map[string]bool) (*relation, int, bool) {
+	if toks[i].Kind != parser.Ident && toks[i].Kind != parser.QuotedIdent {
+		return nil, 0, false
+	}
+	if i+2 < len(toks) && toks[i+1].Is(".") {
+		r, ok := relations[toks[i].Val+"."+toks[i+2].Val]
+		return r, 3, ok
+	}
+	if tables[toks[i].Val] {
+		return nil, 0, false
+	}
+	// Other unqualified names resolve to pg_catalog first, as with the
+	// default search_path.
+	r, ok := relations["pg_catalog."+toks[i].Val]
+	return r, 1, ok
+}
@@ -0,0 +1,311 @@
+package catalog_test
+
+import (
+	. "github.com/yydzero/mnt/executor/catalog"
+
+	"github.com/lib/pq/oid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/fake"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+)
+
+var types = []Type{
+	{Oid: oid.T_bool, Name: "bool", Len: 1, Category: 'B'},
+	{Oid: oid.T_int8, Name: "int8", Len: 8, Category: 'N'},
+	{Oid: oid.T_text, Name: "text", Len: -1, Category: 'S'},
+}
+
+func typeOf(d parser.Datum) oid.Oid {
+	switch d.(type) {
+	case parser.DBool:
+		return oid.T_bool
+	case parser.DInt:
+		return oid.T_int8
+	}
+	return oid.T_text
+}
+
+// batchExecutor records the size of each batch it runs.
+type batchExecutor struct {
+	fake.FakeExecutor
+	batches []int
+}
+
+func (b *batchExecutor) ExecuteBatch(ctx context.Context, stmt executor.PreparedStatement, params [][]parser.Datum) executor.ResultList {
+	b.batches = append(b.batches, len(params))
+	return make(executor.ResultList, len(params))
+}
+
+// shadowExecutor has a table named like a catalog relation.
+type shadowExecutor struct {
+	fake.FakeExecutor
+}
+
+func (e *shadowExecutor) Tables(ctx context.Context) []executor.Table {
+	return []executor.Table{{Name: "pg_type"}}
+}
+
+var _ = Describe("Catalog executor", func() {
+	var (
+		e   *Executor
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		e = New(&fake.FakeExecutor{}, types, typeOf)
+		s := sql.NewSession(sql.ConnectionArgs{Database: "gpdb", User: "gpadmin"}, nil)
+		ctx = sql.NewContext(context.Background(), s)
+	})
+
+	execute := func(query string, params ...parser.Datum) executor.Result {
+		results := e.ExecuteStatements(ctx, query, params)
+		Expect(results.ResultList).Should(HaveLen(1))
+		return results.ResultList[0]
+	}
+
+	It("passes other statements through to the wrapped executor", func() {
+		r := execute("SELECT name FROM users")
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(HaveLen(3))
+		Expect(r.Rows[0].Values[0]).Should(Equal(parser.DString("xiaowang")))
+	})
+
+	passedThrough := func(r executor.Result) bool {
+		return len(r.Rows) == 3 && r.Rows[0].Values[0] == parser.DString("xiaowang")
+	}
+
+	It("passes statements other than queries of the catalog through", func() {
+		Expect(passedThrough(execute("DELETE FROM pg_class"))).Should(BeTrue())
+		Expect(passedThrough(execute("INSERT INTO t SELECT * FROM pg_type"))).Should(BeTrue())
+		Expect(passedThrough(execute("SELECT * FROM pg_type"))).Should(BeFalse())
+
+		e = New(&shadowExecutor{}, types, typeOf)
+		Expect(passedThrough(execute("SELECT * FROM pg_type"))).Should(BeTrue())
+		Expect(passedThrough(execute("SELECT * FROM pg_catalog.pg_type"))).Should(BeFalse())
+	})
+
+	prepare := func(query string) executor.PreparedStatement {
+		stmt, err := e.Prepare(ctx, query, parser.MapArgs{})
+		Expect(err).ShouldNot(HaveOccurred())
+		return stmt
+	}
+
+	It("runs batches one set of parameters at a time", func() {
+		results := e.ExecuteBatch(ctx, prepare("INSERT INTO users VALUES ($1)"), [][]parser.Datum{
+			{parser.DInt(1)}, {parser.DInt(2)},
+		})
+		Expect(results).Should(HaveLen(2))
+
+		results = e.ExecuteBatch(ctx, prepare("RAISE 'boom'"), [][]parser.Datum{{parser.DInt(1)}, {parser.DInt(2)}})
+		Expect(results).Should(HaveLen(1))
+		Expect(results[0].Err).Should(MatchError("boom"))
+	})
+
+	It("passes batches to a wrapped batch executor", func() {
+		Expect(e.Batches()).Should(BeFalse())
+
+		b := &batchExecutor{}
+		e = New(b, types, typeOf)
+		Expect(e.Batches()).Should(BeTrue())
+		e.ExecuteBatch(ctx, prepare("INSERT INTO users VALUES ($1)"), [][]parser.Datum{{parser.DInt(1)}, {parser.DInt(2)}})
+		Expect(b.batches).Should(Equal([]int{2}))
+	})
+
+	It("reports built-in types through pg_type", func() {
+		r := execute("SELECT oid, typname FROM pg_catalog.pg_type t WHERE t.typname = 'int8'")
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Columns).Should(HaveLen(2))
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			{Values: []parser.Datum{parser.DInt(oid.T_int8), parser.DString("int8")}},
+		}))
+	})
+
+	It("binds parameters and infers their types", func() {
+		stmt := prepare("SELECT typname FROM pg_type WHERE oid = $1")
+		Expect(stmt.Columns()).Should(HaveLen(1))
+		Expect(stmt.Args()["1"]).Should(Equal(parser.DummyInt))
+
+		r := execute("SELECT typname FROM pg_type WHERE oid = $1", parser.DInt(oid.T_bool))
+		Expect(r.Rows).Should(HaveLen(1))
+		Expect(r.Rows[0].Values[0]).Should(Equal(parser.DString("bool")))
+
+		// The prepared statement runs without parsing it again.
+		results := e.Execute(ctx, stmt, []parser.Datum{parser.DInt(oid.T_int8)})
+		Expect(results.ResultList).Should(HaveLen(1))
+		Expect(results.ResultList[0].Rows[0].Values[0]).Should(Equal(parser.DString("int8")))
+	})
+
+	It("describes the tables of the wrapped executor", func() {
+		r := execute("SELECT relname FROM pg_class WHERE relnamespace = 2200")
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			{Values: []parser.Datum{parser.DString("users")}},
+		}))
+
+		r = execute(`SELECT column_name, data_type FROM information_schema.columns
+			WHERE table_name = 'users' ORDER BY ordinal_position DESC LIMIT 2`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			{Values: []parser.Datum{parser.DString("description"), parser.DString("text")}},
+			{Values: []parser.Datum{parser.DString("age"), parser.DString("bigint")}},
+		}))
+	})
+
+	It("reports the session database", func() {
+		r := execute("SELECT datname FROM pg_database")
+		Expect(r.Rows[0].Values[0]).Should(Equal(parser.DString("gpdb")))
+	})
+
+	values := func(vs ...interface{}) executor.ResultRow {
+		var row executor.ResultRow
+		for _, v := range vs {
+			switch v := v.(type) {
+			case nil:
+				row.Values = append(row.Values, parser.DNull)
+			case string:
+				row.Values = append(row.Values, parser.DString(v))
+			case int:
+				row.Values = append(row.Values, parser.DInt(v))
+			case bool:
+				row.Values = append(row.Values, parser.DBool(v))
+			}
+		}
+		return row
+	}
+
+	It("answers psql's \\dt", func() {
+		r := execute(`SELECT n.nspname as "Schema",
+  c.relname as "Name",
+  CASE c.relkind WHEN 'r' THEN 'table' WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' WHEN 'i' THEN 'index' WHEN 'S' THEN 'sequence' WHEN 's' THEN 'special' WHEN 'f' THEN 'foreign table' END as "Type",
+  pg_catalog.pg_get_userbyid(c.relowner) as "Owner"
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r','')
+      AND n.nspname <> 'pg_catalog'
+      AND n.nspname <> 'information_schema'
+      AND n.nspname !~ '^pg_toast'
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 1,2;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Columns).Should(Equal([]executor.ResultColumn{
+			{Name: "Schema", Typ: parser.DummyString}, {Name: "Name", Typ: parser.DummyString},
+			{Name: "Type", Typ: parser.DummyString}, {Name: "Owner", Typ: parser.DummyString},
+		}))
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{values("public", "users", "table", "postgres")}))
+	})
+
+	It("answers psql's \\d table", func() {
+		r := execute(`SELECT c.oid,
+  n.nspname,
+  c.relname
+FROM pg_catalog.pg_class c
+     LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relname OPERATOR(pg_catalog.~) '^(users)$'
+  AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY 2, 3;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{values(16384, "public", "users")}))
+
+		r = execute(`SELECT c.relchecks, c.relkind, c.relhasindex, c.relhasrules, c.relhastriggers, c.relrowsecurity, c.relforcerowsecurity, c.relhasoids, '', c.reltablespace, CASE WHEN c.reloftype = 0 THEN '' ELSE c.reloftype::pg_catalog.regtype::pg_catalog.text END, c.relpersistence, c.relreplident
+FROM pg_catalog.pg_class c
+ LEFT JOIN pg_catalog.pg_class tc ON (c.reltoastrelid = tc.oid)
+WHERE c.oid = '16384';`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			values(0, "r", false, false, false, false, false, false, "", 0, "", "p", "d"),
+		}))
+
+		r = execute(`SELECT a.attname,
+  pg_catalog.format_type(a.atttypid, a.atttypmod),
+  (SELECT substring(pg_catalog.pg_get_expr(d.adbin, d.adrelid) for 128)
+   FROM pg_catalog.pg_attrdef d
+   WHERE d.adrelid = a.attrelid AND d.adnum = a.attnum AND a.atthasdef),
+  a.attnotnull, a.attnum,
+  (SELECT c.collname FROM pg_catalog.pg_collation c, pg_catalog.pg_type t
+   WHERE c.oid = a.attcollation AND t.oid = a.atttypid AND a.attcollation <> t.typcollation) AS attcollation,
+  NULL AS indexdef,
+  NULL AS attfdwoptions
+FROM pg_catalog.pg_attribute a
+WHERE a.attrelid = '16384' AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Columns[1].Name).Should(Equal("format_type"))
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			values("name", "text", nil, false, 1, nil, nil, nil),
+			values("age", "bigint", nil, false, 2, nil, nil, nil),
+			values("description", "text", nil, false, 3, nil, nil, nil),
+		}))
+
+		r = execute(`SELECT pol.polname,
+CASE WHEN pol.polroles = '{0}' THEN NULL ELSE array_to_string(array(select rolname from pg_roles where oid = any (pol.polroles) order by 1),',') END,
+pg_catalog.pg_get_expr(pol.polqual, pol.polrelid),
+pg_catalog.pg_get_expr(pol.polwithcheck, pol.polrelid),
+CASE pol.polcmd
+WHEN 'r' THEN 'SELECT'
+WHEN 'a' THEN 'INSERT'
+WHEN 'w' THEN 'UPDATE'
+WHEN 'd' THEN 'DELETE'
+WHEN '*' THEN 'ALL'
+END AS cmd
+FROM pg_catalog.pg_policy pol
+WHERE pol.polrelid = '16384' ORDER BY 1;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(BeEmpty())
+
+		r = execute(`SELECT c.oid::pg_catalog.regclass FROM pg_catalog.pg_class c, pg_catalog.pg_inherits i WHERE c.oid=i.inhparent AND i.inhrelid = '16384' ORDER BY inhseqno;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(BeEmpty())
+
+		r = execute(`SELECT c.oid::pg_catalog.regclass FROM pg_catalog.pg_class c, pg_catalog.pg_inherits i WHERE c.oid=i.inhrelid AND i.inhparent = '16384' ORDER BY c.oid::pg_catalog.regclass::pg_catalog.text;`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(BeEmpty())
+	})
+
+	It("joins pg_attribute with pg_type", func() {
+		r := execute(`SELECT a.attname, t.typname FROM pg_attribute a JOIN pg_type t ON a.atttypid = t.oid
+			WHERE a.attrelid = 'users'::regclass AND a.attnum > 0 ORDER BY a.attnum DESC`)
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			values("description", "text"), values("age", "int8"), values("name", "text"),
+		}))
+
+		stmt := prepare("SELECT t.typname FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid WHERE a.attname = $1")
+		Expect(stmt.Args()["1"]).Should(Equal(parser.DummyString))
+	})
+
+	It("reports the type of settings", func() {
+		r := execute("SELECT name, vartype FROM pg_settings WHERE name IN ('statement_timeout', 'IntervalStyle', 'standard_conforming_strings', 'search_path') ORDER BY name")
+		Expect(r.Err).ShouldNot(HaveOccurred())
+		Expect(r.Rows).Should(Equal([]executor.ResultRow{
+			values("IntervalStyle", "enum"), values("search_path", "string"),
+			values("standard_conforming_strings", "bool"), values("statement_timeout", "integer"),
+		}))
+	})
+
+	It("rejects queries it cannot answer correctly", func() {
+		code := func(r executor.Result) string {
+			Expect(r.Err).Should(HaveOccurred())
+			return sql.ErrorCode(r.Err)
+		}
+
+		r := execute("SELECT relkind, count(*) FROM pg_class GROUP BY relkind")
+		Expect(code(r)).Should(Equal(sql.CodeFeatureNotSupportedError))
+
+		r = execute("SELECT nosuchcolumn FROM pg_class")
+		Expect(r.Err).Should(MatchError(`column "nosuchcolumn" does not exist`))
+		Expect(code(r)).Should(Equal(sql.CodeUndefinedColumnError))
+
+		r = execute("SELECT c.relname FROM pg_class c JOIN users u ON u.name = c.relname")
+		Expect(r.Err).Should(MatchError(`relation "users" does not exist`))
+		Expect(code(r)).Should(Equal(sql.CodeUndefinedTableError))
+
+		r = execute("SELECT nosuchfunction(relname) FROM pg_class")
+		Expect(code(r)).Should(Equal(sql.CodeUndefinedFunctionError))
+
+		r = execute("SELECT relname FROM pg_class WHERE")
+		Expect(code(r)).Should(Equal(sql.CodeSyntaxError))
+	})
+})
@@ -0,0 +1,1322 @@
+package catalog
+
+import (
+	"bytes"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// expr is a node of a parsed expression. resolve binds its column
+// references to the FROM items in scope; typ and eval may be used after.
+type expr interface {
+	resolve(s *scope) error
+	typ() parser.Datum
+	eval(env *env) (parser.Datum, error)
+}
+
+// execution holds the state of one run of a catalog query.
+type execution struct {
+	e      *Executor
+	ctx    context.Context
+	params []parser.Datum
+
+	// rows caches the synthesized contents of each relation, so that
+	// joins and subqueries do not rebuild them for every row.
+	rows      map[*relation][]executor.ResultRow
+	relations []*relation
+}
+
+func (x *execution) relationRows(rel *relation) []executor.ResultRow {
+	rows, ok := x.rows[rel]
+	if !ok {
+		rows = x.e.rows(x.ctx, rel)
+		x.rows[rel] = rows
+	}
+	return rows
+}
+
+// allRelations returns the emulated relations and user tables, with the
+// OIDs they have in pg_class.
+func (x *execution) allRelations() []*relation {
+	if x.relations == nil {
+		x.relations = x.e.allRelations(x.ctx)
+	}
+	return x.relations
+}
+
+// env is the row an expression is evaluated against: one row of each FROM
+// item, a nil Values standing for the NULLs of an unmatched LEFT JOIN.
+type env struct {
+	x     *execution
+	tuple []executor.ResultRow
+	outer *env
+}
+
+func isTrue(e expr, env *env) (bool, error) {
+	v, err := e.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(parser.DBool)
+	return ok && bool(b), nil
+}
+
+// datumType returns the column type of a value.
+func datumType(d parser.Datum) parser.Datum {
+	switch d.(type) {
+	case parser.DBool:
+		return parser.DummyBool
+	case parser.DInt:
+		return parser.DummyInt
+	case parser.DFloat:
+		return parser.DummyFloat
+	}
+	return parser.DummyString
+}
+
+// exprName returns the column name PostgreSQL gives an unnamed target.
+func exprName(e expr) string {
+	switch e := e.(type) {
+	case *colRef:
+		return e.name
+	case *funcExpr:
+		return e.name
+	case *castExpr:
+		if name := exprName(e.e); name != "?column?" {
+			return name
+		}
+		return e.to
+	case *caseExpr:
+		return "case"
+	case *arrayExpr:
+		return "array"
+	case *existsExpr:
+		return "exists"
+	case *subqueryExpr:
+		if t := e.q.targets[0]; !t.star {
+			return t.name
+		}
+	}
+	return "?column?"
+}
+
+// hint gives a parameter compared with an expression of type t that type,
+// unless it already has one.
+func hint(e expr, t parser.Datum) {
+	if p, ok := e.(*paramExpr); ok && p.t == nil {
+		p.t = t
+	}
+}
+
+// parseExpr parses an expression. Precedence follows PostgreSQL: OR, AND,
+// NOT, then the comparison, pattern matching, IS and IN operators, all at
+// one level, then ||, casts and COLLATE.
+func parseExpr(r *tokenReader) (expr, error) {
+	l, err := parseAnd(r)
+	for err == nil && r.accept("or") {
+		var rhs expr
+		if rhs, err = parseAnd(r); err == nil {
+			l = &binaryExpr{op: "or", l: l, r: rhs}
+		}
+	}
+	return l, err
+}
+
+func parseAnd(r *tokenReader) (expr, error) {
+	l, err := parseNot(r)
+	for err == nil && r.accept("and") {
+		var rhs expr
+		if rhs, err = parseNot(r); err == nil {
+			l = &binaryExpr{op: "and", l: l, r: rhs}
+		}
+	}
+	return l, err
+}
+
+func parseNot(r *tokenReader) (expr, error) {
+	if r.accept("not") {
+		e, err := parseNot(r)
+		return &notExpr{e: e}, err
+	}
+	return parseComparison(r)
+}
+
+// comparisonOps maps the comparison and regular expression operators to
+// their canonical spelling.
+var comparisonOps = map[string]string{
+	"=": "=", "<>": "<>", "!=": "<>", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+	"~": "~", "!~": "!~", "~*": "~*", "!~*": "!~*",
+}
+
+func parseComparison(r *tokenReader) (expr, error) {
+	l, err := parseConcat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.accept("is") {
+		not := r.accept("not")
+		t := r.next()
+		if !t.Is("null") && !t.Is("true") && !t.Is("false") {
+			r.pos--
+			return nil, r.unsupported()
+		}
+		return &isExpr{e: l, what: t.Val, not: not}, nil
+	}
+
+	not := false
+	if r.peek().Is("not") && (r.peekAt(1).Is("in") || r.peekAt(1).Is("like") || r.peekAt(1).Is("ilike")) {
+		r.next()
+		not = true
+	}
+	switch {
+	case r.accept("in"):
+		if err := r.expect("("); err != nil {
+			return nil, err
+		}
+		in := &inExpr{e: l, not: not}
+		for {
+			e, err := parseExpr(r)
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, e)
+			if !r.accept(",") {
+				break
+			}
+		}
+		return in, r.expect(")")
+
+	case r.peek().Is("like"), r.peek().Is("ilike"):
+		op := r.next().Val
+		rhs, err := parseConcat(r)
+		if err != nil {
+			return nil, err
+		}
+		var e expr = &binaryExpr{op: op, l: l, r: rhs}
+		if not {
+			e = &notExpr{e: e}
+		}
+		return e, nil
+	}
+
+	op, ok, err := parseOperator(r)
+	if err != nil || !ok {
+		return l, err
+	}
+	if r.peek().Is("any") || r.peek().Is("some") || r.peek().Is("all") {
+		all := r.next().Is("all")
+		if err := r.expect("("); err != nil {
+			return nil, err
+		}
+		rhs, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		return &anyExpr{op: op, l: l, r: rhs, all: all}, r.expect(")")
+	}
+	rhs, err := parseConcat(r)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryExpr{op: op, l: l, r: rhs}, nil
+}
+
+// parseOperator parses a comparison operator, either bare or spelled as
+// OPERATOR(schema.op) as psql does.
+func parseOperator(r *tokenReader) (string, bool, error) {
+	t := r.peek()
+	if t.Kind == parser.Punct {
+		op, ok := comparisonOps[t.Val]
+		if ok {
+			r.next()
+		}
+		return op, ok, nil
+	}
+	if !t.Is("operator") {
+		return "", false, nil
+	}
+	r.next()
+	if err := r.expect("("); err != nil {
+		return "", false, err
+	}
+	if r.peek().Kind == parser.Ident && r.peekAt(1).Is(".") {
+		r.pos += 2
+	}
+	var op string
+	for !r.done() && !r.peek().Is(")") {
+		if r.peek().Kind != parser.Punct {
+			return "", false, r.unsupported()
+		}
+		op += r.next().Val
+	}
+	if err := r.expect(")"); err != nil {
+		return "", false, err
+	}
+	canonical, ok := comparisonOps[op]
+	if !ok {
+		return "", false, sql.NewPGError(sql.CodeUndefinedFunctionError, "operator does not exist: %s", op)
+	}
+	return canonical, true, nil
+}
+
+func parseConcat(r *tokenReader) (expr, error) {
+	l, err := parseUnary(r)
+	for err == nil && r.accept("||") {
+		var rhs expr
+		if rhs, err = parseUnary(r); err == nil {
+			l = &binaryExpr{op: "||", l: l, r: rhs}
+		}
+	}
+	return l, err
+}
+
+func parseUnary(r *tokenReader) (expr, error) {
+	if r.peek().Is("-") && r.peekAt(1).Kind == parser.Number {
+		r.next()
+		d, err := number("-" + r.next().Val)
+		if err != nil {
+			return nil, err
+		}
+		return parsePostfix(r, &constExpr{d: d})
+	}
+	e, err := parsePrimary(r)
+	if err != nil {
+		return nil, err
+	}
+	return parsePostfix(r, e)
+}
+
+func parsePostfix(r *tokenReader, e expr) (expr, error) {
+	for {
+		switch {
+		case r.accept("::"):
+			to, err := parseTypeName(r)
+			if err != nil {
+				return nil, err
+			}
+			e = &castExpr{e: e, to: to}
+		case r.accept("collate"):
+			// The emulated catalogs have a single collation.
+			if _, err := parseTypeName(r); err != nil {
+				return nil, err
+			}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parseTypeName parses the name of a type, or of a collation, dropping any
+// schema, type modifiers and array bounds other than the "[]" suffix.
+func parseTypeName(r *tokenReader) (string, error) {
+	if !isLabel(r.peek()) {
+		return "", r.unsupported()
+	}
+	name := r.next().Val
+	if r.accept(".") {
+		if !isLabel(r.peek()) {
+			return "", r.unsupported()
+		}
+		name = r.next().Val
+	}
+	switch {
+	case name == "double" && r.accept("precision"):
+		name = "double precision"
+	case name == "character" && r.accept("varying"):
+		name = "character varying"
+	}
+	if r.accept("(") {
+		for !r.done() && !r.accept(")") {
+			r.next()
+		}
+	}
+	for r.accept("[") {
+		if r.peek().Kind == parser.Number {
+			r.next()
+		}
+		if err := r.expect("]"); err != nil {
+			return "", err
+		}
+		name += "[]"
+	}
+	return name, nil
+}
+
+func number(s string) (parser.Datum, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return parser.DInt(i), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, sql.NewPGError(sql.CodeInvalidTextRepresentationError, "invalid number %q", s)
+	}
+	return parser.DFloat(f), nil
+}
+
+// sqlValueFunctions may be called without parentheses.
+var sqlValueFunctions = map[string]bool{
+	"current_user": true, "session_user": true, "current_role": true,
+	"current_catalog": true, "current_schema": true,
+}
+
+func parsePrimary(r *tokenReader) (expr, error) {
+	t := r.peek()
+	switch {
+	case r.done():
+		return nil, r.unsupported()
+	case t.Kind == parser.String:
+		r.next()
+		return &constExpr{d: parser.DString(t.Val)}, nil
+	case t.Kind == parser.Number:
+		r.next()
+		d, err := number(t.Val)
+		return &constExpr{d: d}, err
+	case t.Kind == parser.Param:
+		r.next()
+		n, err := strconv.Atoi(t.Val)
+		if err != nil {
+			return nil, sql.NewPGError(sql.CodeUndefinedParameterError, "there is no parameter $%s", t.Val)
+		}
+		p := &paramExpr{n: n}
+		r.params = append(r.params, p)
+		return p, nil
+	case t.Is("true"), t.Is("false"):
+		r.next()
+		return &constExpr{d: parser.DBool(t.Val == "true")}, nil
+	case t.Is("null"):
+		r.next()
+		return &constExpr{d: parser.DNull}, nil
+
+	case t.Is("("):
+		r.next()
+		if r.peek().Is("select") {
+			q, err := parseSelect(r)
+			if err != nil {
+				return nil, err
+			}
+			return &subqueryExpr{q: q}, r.expect(")")
+		}
+		e, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		return e, r.expect(")")
+
+	case t.Is("case"):
+		return parseCase(r)
+
+	case t.Is("array"):
+		r.next()
+		if r.accept("(") {
+			q, err := parseSelect(r)
+			if err != nil {
+				return nil, err
+			}
+			return &arrayExpr{q: q}, r.expect(")")
+		}
+		if err := r.expect("["); err != nil {
+			return nil, err
+		}
+		a := &arrayExpr{}
+		for !r.accept("]") {
+			e, err := parseExpr(r)
+			if err != nil {
+				return nil, err
+			}
+			a.elems = append(a.elems, e)
+			if !r.accept(",") {
+				if err := r.expect("]"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return a, nil
+
+	case t.Is("exists"):
+		r.next()
+		if err := r.expect("("); err != nil {
+			return nil, err
+		}
+		q, err := parseSelect(r)
+		if err != nil {
+			return nil, err
+		}
+		return &existsExpr{q: q}, r.expect(")")
+
+	case t.Kind == parser.Ident && sqlValueFunctions[t.Val] && !r.peekAt(1).Is("."):
+		r.next()
+		if r.accept("(") {
+			if err := r.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		return &funcExpr{name: t.Val, fn: functions[t.Val]}, nil
+
+	case isName(t):
+		r.next()
+		qual, name := "", t.Val
+		if r.accept(".") {
+			if !isLabel(r.peek()) {
+				return nil, r.unsupported()
+			}
+			qual, name = name, r.next().Val
+		}
+		if r.peek().Is("(") {
+			return parseCall(r, qual, name)
+		}
+		return &colRef{qual: qual, name: name}, nil
+	}
+	return nil, r.unsupported()
+}
+
+// aggregates are the built-in aggregate functions. Catalog queries do not
+// aggregate, but calls to them are valid SQL.
+var aggregates = map[string]bool{
+	"array_agg": true, "avg": true, "bool_and": true, "bool_or": true, "count": true,
+	"max": true, "min": true, "string_agg": true, "sum": true,
+}
+
+// parseCall parses the arguments of a call to a built-in function.
+func parseCall(r *tokenReader, qual, name string) (expr, error) {
+	fn, ok := functions[name]
+	if !ok && qual == "" && aggregates[name] {
+		return nil, sql.NewPGError(sql.CodeFeatureNotSupportedError,
+			"aggregate function %s is not supported in catalog queries", name)
+	}
+	if !ok || (qual != "" && qual != "pg_catalog") {
+		if qual != "" {
+			name = qual + "." + name
+		}
+		return nil, sql.NewPGError(sql.CodeUndefinedFunctionError, "function %s does not exist", name)
+	}
+	r.next()
+
+	f := &funcExpr{name: name, fn: fn}
+	for !r.accept(")") {
+		e, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		f.args = append(f.args, e)
+		// substring(s FROM start FOR count) is the only call with keyword
+		// separated arguments.
+		if name == "substring" && (r.peek().Is("from") || r.peek().Is("for")) {
+			if r.accept("from") {
+				from, err := parseExpr(r)
+				if err != nil {
+					return nil, err
+				}
+				f.args = append(f.args, from)
+			} else {
+				f.args = append(f.args, &constExpr{d: parser.DInt(1)})
+			}
+			if r.accept("for") {
+				count, err := parseExpr(r)
+				if err != nil {
+					return nil, err
+				}
+				f.args = append(f.args, count)
+			}
+			if err := r.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if !r.accept(",") {
+			if err := r.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if len(f.args) < fn.minArgs || (fn.maxArgs >= 0 && len(f.args) > fn.maxArgs) {
+		return nil, sql.NewPGError(sql.CodeUndefinedFunctionError, "function %s does not take %d arguments", name, len(f.args))
+	}
+	return f, nil
+}
+
+func parseCase(r *tokenReader) (expr, error) {
+	r.next()
+	c := &caseExpr{}
+	if !r.peek().Is("when") {
+		operand, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		c.operand = operand
+	}
+	for r.accept("when") {
+		cond, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.expect("then"); err != nil {
+			return nil, err
+		}
+		result, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		c.whens = append(c.whens, when{cond: cond, result: result})
+	}
+	if len(c.whens) == 0 {
+		return nil, r.unsupported()
+	}
+	if r.accept("else") {
+		els, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		c.els = els
+	}
+	return c, r.expect("end")
+}
+
+type constExpr struct {
+	d parser.Datum
+}
+
+func (c *constExpr) resolve(*scope) error            { return nil }
+func (c *constExpr) typ() parser.Datum               { return datumType(c.d) }
+func (c *constExpr) eval(*env) (parser.Datum, error) { return c.d, nil }
+
+// paramExpr is a positional parameter; t is its type, once inferred.
+type paramExpr struct {
+	n int
+	t parser.Datum
+}
+
+func (p *paramExpr) resolve(*scope) error { return nil }
+
+func (p *paramExpr) typ() parser.Datum {
+	if p.t == nil {
+		return parser.DummyString
+	}
+	return p.t
+}
+
+func (p *paramExpr) eval(env *env) (parser.Datum, error) {
+	if p.n < 1 || p.n > len(env.x.params) {
+		return nil, sql.NewPGError(sql.CodeUndefinedParameterError, "there is no parameter $%d", p.n)
+	}
+	if env.x.params[p.n-1] == nil {
+		return parser.DNull, nil
+	}
+	return env.x.params[p.n-1], nil
+}
+
+// colRef is a column reference, bound by resolve to column idx of FROM item
+// item of the query depth levels out.
+type colRef struct {
+	qual, name string
+
+	depth, item, idx int
+	t                parser.Datum
+}
+
+func (c *colRef) resolve(s *scope) error {
+	qualFound := false
+	for depth := 0; s != nil; depth, s = depth+1, s.outer {
+		found := false
+		for i, item := range s.q.from {
+			if c.qual != "" {
+				if c.qual != item.alias {
+					continue
+				}
+				qualFound = true
+			}
+			idx, err := item.rel.columnIndex(c.name)
+			if err != nil {
+				continue
+			}
+			if found {
+				return sql.NewPGError(sql.CodeAmbiguousColumnError, "column reference %q is ambiguous", c.name)
+			}
+			found = true
+			c.depth, c.item, c.idx, c.t = depth, i, idx, item.rel.columns[idx].Typ
+		}
+		if found {
+			return nil
+		}
+	}
+	if c.qual != "" && !qualFound {
+		return sql.NewPGError(sql.CodeUndefinedTableError, "missing FROM-clause entry for table %q", c.qual)
+	}
+	return sql.NewPGError(sql.CodeUndefinedColumnError, "column %q does not exist", c.name)
+}
+
+func (c *colRef) typ() parser.Datum { return c.t }
+
+func (c *colRef) eval(env *env) (parser.Datum, error) {
+	for i := 0; i < c.depth; i++ {
+		env = env.outer
+	}
+	if c.item >= len(env.tuple) {
+		return nil, sql.NewPGError(sql.CodeUndefinedTableError, "invalid reference to FROM-clause entry for column %q", c.name)
+	}
+	row := env.tuple[c.item]
+	if row.Values == nil {
+		return parser.DNull, nil
+	}
+	return row.Values[c.idx], nil
+}
+
+// binaryExpr is AND, OR, ||, a comparison or a pattern match.
+type binaryExpr struct {
+	op   string
+	l, r expr
+}
+
+func (b *binaryExpr) resolve(s *scope) error {
+	if err := b.l.resolve(s); err != nil {
+		return err
+	}
+	if err := b.r.resolve(s); err != nil {
+		return err
+	}
+	hint(b.l, b.r.typ())
+	hint(b.r, b.l.typ())
+	return nil
+}
+
+func (b *binaryExpr) typ() parser.Datum {
+	if b.op == "||" {
+		return parser.DummyString
+	}
+	return parser.DummyBool
+}
+
+func (b *binaryExpr) eval(env *env) (parser.Datum, error) {
+	if b.op == "and" || b.op == "or" {
+		return b.evalLogical(env)
+	}
+	l, err := b.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := b.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return applyOp(b.op, l, r)
+}
+
+// evalLogical evaluates AND and OR with SQL's three-valued logic.
+func (b *binaryExpr) evalLogical(env *env) (parser.Datum, error) {
+	// The value which decides the result on its own: false for AND.
+	decisive := parser.DBool(b.op == "or")
+	sawNull := false
+	for _, e := range []expr{b.l, b.r} {
+		v, err := e.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		switch v {
+		case decisive:
+			return decisive, nil
+		case parser.DNull:
+			sawNull = true
+		case !decisive:
+		default:
+			return nil, sql.NewPGError(sql.CodeDatatypeMismatchError, "argument of %s must be type boolean", strings.ToUpper(b.op))
+		}
+	}
+	if sawNull {
+		return parser.DNull, nil
+	}
+	return !decisive, nil
+}
+
+// applyOp applies a comparison, pattern match or || to two values.
+func applyOp(op string, l, r parser.Datum) (parser.Datum, error) {
+	if l == parser.DNull || r == parser.DNull {
+		return parser.DNull, nil
+	}
+	switch op {
+	case "=":
+		return parser.DBool(compare(l, r) == 0), nil
+	case "<>":
+		return parser.DBool(compare(l, r) != 0), nil
+	case "<":
+		return parser.DBool(compare(l, r) < 0), nil
+	case "<=":
+		return parser.DBool(compare(l, r) <= 0), nil
+	case ">":
+		return parser.DBool(compare(l, r) > 0), nil
+	case ">=":
+		return parser.DBool(compare(l, r) >= 0), nil
+	case "~", "!~", "~*", "!~*":
+		pattern := toText(r)
+		if strings.HasSuffix(op, "*") {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, sql.NewPGError(sql.CodeInvalidRegularExpressionError, "invalid regular expression: %v", err)
+		}
+		return parser.DBool(re.MatchString(toText(l)) != strings.HasPrefix(op, "!")), nil
+	case "like", "ilike":
+		re, err := regexp.Compile(likePattern(toText(r), op == "ilike"))
+		if err != nil {
+			return nil, err
+		}
+		return parser.DBool(re.MatchString(toText(l))), nil
+	case "||":
+		return parser.DString(toText(l) + toText(r)), nil
+	}
+	return nil, sql.NewPGError(sql.CodeUndefinedFunctionError, "operator does not exist: %s", op)
+}
+
+// likePattern translates a LIKE pattern into a regular expression.
+func likePattern(pattern string, ignoreCase bool) string {
+	var b bytes.Buffer
+	if ignoreCase {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("(?s)^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (n *notExpr) resolve(s *scope) error { return n.e.resolve(s) }
+func (n *notExpr) typ() parser.Datum      { return parser.DummyBool }
+
+func (n *notExpr) eval(env *env) (parser.Datum, error) {
+	v, err := n.e.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case parser.DBool:
+		return !v, nil
+	}
+	if v == parser.DNull {
+		return parser.DNull, nil
+	}
+	return nil, sql.NewPGError(sql.CodeDatatypeMismatchError, "argument of NOT must be type boolean")
+}
+
+// isExpr is e IS [NOT] NULL, TRUE or FALSE.
+type isExpr struct {
+	e    expr
+	what string
+	not  bool
+}
+
+func (i *isExpr) resolve(s *scope) error { return i.e.resolve(s) }
+func (i *isExpr) typ() parser.Datum      { return parser.DummyBool }
+
+func (i *isExpr) eval(env *env) (parser.Datum, error) {
+	v, err := i.e.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	var is bool
+	switch i.what {
+	case "null":
+		is = v == parser.DNull
+	case "true":
+		is = v == parser.DBool(true)
+	case "false":
+		is = v == parser.DBool(false)
+	}
+	return parser.DBool(is != i.not), nil
+}
+
+// inExpr is e [NOT] IN (list).
+type inExpr struct {
+	e    expr
+	list []expr
+	not  bool
+}
+
+func (in *inExpr) resolve(s *scope) error {
+	if err := in.e.resolve(s); err != nil {
+		return err
+	}
+	for _, e := range in.list {
+		if err := e.resolve(s); err != nil {
+			return err
+		}
+		hint(e, in.e.typ())
+	}
+	return nil
+}
+
+func (in *inExpr) typ() parser.Datum { return parser.DummyBool }
+
+func (in *inExpr) eval(env *env) (parser.Datum, error) {
+	v, err := in.e.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]parser.Datum, len(in.list))
+	for i, e := range in.list {
+		if values[i], err = e.eval(env); err != nil {
+			return nil, err
+		}
+	}
+	return matchAny("=", v, values, in.not)
+}
+
+// matchAny compares v with each of values using op, true if any comparison
+// is, or with all set if every one is. NULLs make an undecided result NULL.
+func matchAny(op string, v parser.Datum, values []parser.Datum, all bool) (parser.Datum, error) {
+	if all {
+		op = map[string]string{"=": "<>", "<>": "=", "<": ">=", "<=": ">", ">": "<=", ">=": "<",
+			"~": "!~", "!~": "~", "~*": "!~*", "!~*": "~*"}[op]
+	}
+	sawNull := false
+	for _, value := range values {
+		match, err := applyOp(op, v, value)
+		if err != nil {
+			return nil, err
+		}
+		switch match {
+		case parser.DBool(true):
+			return parser.DBool(!all), nil
+		case parser.DNull:
+			sawNull = true
+		}
+	}
+	if sawNull {
+		return parser.DNull, nil
+	}
+	return parser.DBool(all), nil
+}
+
+// anyExpr is l op ANY (r) or l op ALL (r), r being an array.
+type anyExpr struct {
+	op   string
+	l, r expr
+	all  bool
+}
+
+func (a *anyExpr) resolve(s *scope) error {
+	if err := a.l.resolve(s); err != nil {
+		return err
+	}
+	return a.r.resolve(s)
+}
+
+func (a *anyExpr) typ() parser.Datum { return parser.DummyBool }
+
+func (a *anyExpr) eval(env *env) (parser.Datum, error) {
+	v, err := a.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := a.r.eval(env)
+	if err != nil || arr == parser.DNull {
+		return parser.DNull, err
+	}
+	return matchAny(a.op, v, arrayElements(arr), a.all)
+}
+
+// arrayElements returns the elements of an array, given either as a value
+// or as an array literal such as '{1,2}'.
+func arrayElements(d parser.Datum) []parser.Datum {
+	if t, ok := d.(parser.DTuple); ok {
+		return t
+	}
+	s := strings.TrimSuffix(strings.TrimPrefix(toText(d), "{"), "}")
+	if s == "" {
+		return nil
+	}
+	var elems []parser.Datum
+	for _, e := range strings.Split(s, ",") {
+		if e == "NULL" {
+			elems = append(elems, parser.DNull)
+		} else {
+			elems = append(elems, parser.DString(strings.Trim(e, `"`)))
+		}
+	}
+	return elems
+}
+
+type when struct {
+	cond, result expr
+}
+
+// caseExpr is CASE [operand] WHEN ... THEN ... [ELSE ...] END.
+type caseExpr struct {
+	operand expr
+	whens   []when
+	els     expr
+}
+
+func (c *caseExpr) resolve(s *scope) error {
+	exprs := []expr{c.operand, c.els}
+	for _, w := range c.whens {
+		exprs = append(exprs, w.cond, w.result)
+	}
+	for _, e := range exprs {
+		if e == nil {
+			continue
+		}
+		if err := e.resolve(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *caseExpr) typ() parser.Datum {
+	for _, w := range c.whens {
+		if k, ok := w.result.(*constExpr); !ok || k.d != parser.DNull {
+			return w.result.typ()
+		}
+	}
+	if c.els != nil {
+		return c.els.typ()
+	}
+	return parser.DummyString
+}
+
+func (c *caseExpr) eval(env *env) (parser.Datum, error) {
+	var operand parser.Datum
+	if c.operand != nil {
+		var err error
+		if operand, err = c.operand.eval(env); err != nil {
+			return nil, err
+		}
+	}
+	for _, w := range c.whens {
+		v, err := w.cond.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if operand != nil {
+			v, _ = applyOp("=", operand, v)
+		}
+		if v == parser.DBool(true) {
+			return w.result.eval(env)
+		}
+	}
+	if c.els != nil {
+		return c.els.eval(env)
+	}
+	return parser.DNull, nil
+}
+
+// castExpr is e::to.
+type castExpr struct {
+	e  expr
+	to string
+}
+
+func (c *castExpr) resolve(s *scope) error {
+	if err := c.e.resolve(s); err != nil {
+		return err
+	}
+	hint(c.e, c.typ())
+	return nil
+}
+
+func (c *castExpr) typ() parser.Datum {
+	switch castKind(c.to) {
+	case "int":
+		return parser.DummyInt
+	case "float":
+		return parser.DummyFloat
+	case "bool":
+		return parser.DummyBool
+	case "text", "regclass", "regtype":
+		return parser.DummyString
+	}
+	return c.e.typ()
+}
+
+// castKind groups the type names a cast may convert to.
+func castKind(to string) string {
+	switch to {
+	case "int2", "int4", "int8", "smallint", "int", "integer", "bigint", "oid", "xid":
+		return "int"
+	case "float4", "float8", "real", "double precision", "numeric", "decimal":
+		return "float"
+	case "bool", "boolean":
+		return "bool"
+	case "text", "varchar", "character varying", "name", "char", "character", "bpchar":
+		return "text"
+	case "regclass", "regtype":
+		return to
+	}
+	return ""
+}
+
+func (c *castExpr) eval(env *env) (parser.Datum, error) {
+	v, err := c.e.eval(env)
+	if err != nil || v == parser.DNull {
+		return v, err
+	}
+	switch castKind(c.to) {
+	case "int":
+		switch v := v.(type) {
+		case parser.DInt:
+			return v, nil
+		case parser.DBool:
+			return parser.DInt(boolToFloat(bool(v))), nil
+		}
+		if f, ok := toFloat(v); ok {
+			return parser.DInt(int64(f)), nil
+		}
+		return nil, sql.NewPGError(sql.CodeInvalidTextRepresentationError, "invalid input syntax for integer: %q", toText(v))
+	case "float":
+		if f, ok := toFloat(v); ok {
+			return parser.DFloat(f), nil
+		}
+		return nil, sql.NewPGError(sql.CodeInvalidTextRepresentationError, "invalid input syntax for type double precision: %q", toText(v))
+	case "bool":
+		if b, ok := toBool(v); ok {
+			return parser.DBool(b), nil
+		}
+		return nil, sql.NewPGError(sql.CodeInvalidTextRepresentationError, "invalid input syntax for type boolean: %q", toText(v))
+	case "text":
+		return parser.DString(toText(v)), nil
+	case "regclass":
+		return env.x.regclass(v)
+	case "regtype":
+		return env.x.regtype(v)
+	}
+	return v, nil
+}
+
+// regclass converts a relation name to its OID, for comparisons, and an
+// OID to the relation's name, for display.
+func (x *execution) regclass(v parser.Datum) (parser.Datum, error) {
+	if id, ok := v.(parser.DInt); ok {
+		for _, rel := range x.allRelations() {
+			if rel.oid == int64(id) {
+				if isVisible(rel.schema) {
+					return parser.DString(rel.name), nil
+				}
+				return parser.DString(rel.qualifiedName()), nil
+			}
+		}
+		return parser.DString(toText(id)), nil
+	}
+
+	name := toText(v)
+	schema, rel := splitName(name)
+	for _, r := range x.allRelations() {
+		if r.name == rel && (r.schema == schema || (schema == "" && isVisible(r.schema))) {
+			return parser.DInt(r.oid), nil
+		}
+	}
+	return nil, sql.NewPGError(sql.CodeUndefinedTableError, "relation %q does not exist", name)
+}
+
+// regtype is regclass for types.
+func (x *execution) regtype(v parser.Datum) (parser.Datum, error) {
+	if id, ok := v.(parser.DInt); ok {
+		return parser.DString(x.e.formatType(int64(id))), nil
+	}
+	name := toText(v)
+	_, typ := splitName(name)
+	for _, t := range x.e.types {
+		if t.Name == typ || sqlTypeNames[t.Name] == typ {
+			return parser.DInt(t.Oid), nil
+		}
+	}
+	return nil, sql.NewPGError(sql.CodeUndefinedObjectError, "type %q does not exist", name)
+}
+
+// splitName splits a possibly qualified and quoted name into its schema
+// and object name, folding unquoted parts to lower case.
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(name, ".", 2)
+	for i, p := range parts {
+		if strings.HasPrefix(p, `"`) && strings.HasSuffix(p, `"`) && len(p) > 1 {
+			parts[i] = strings.Replace(p[1:len(p)-1], `""`, `"`, -1)
+		} else {
+			parts[i] = strings.ToLower(p)
+		}
+	}
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// isVisible reports whether objects of schema are found by unqualified
+// names with the default search_path.
+func isVisible(schema string) bool {
+	return schema == "pg_catalog" || schema == "public"
+}
+
+// subqueryExpr is a scalar subquery.
+type subqueryExpr struct {
+	q *query
+}
+
+func (sq *subqueryExpr) resolve(s *scope) error {
+	if err := sq.q.resolve(s); err != nil {
+		return err
+	}
+	if len(sq.q.cols) != 1 {
+		return sql.NewPGError(sql.CodeSyntaxError, "subquery must return only one column")
+	}
+	return nil
+}
+
+func (sq *subqueryExpr) typ() parser.Datum { return sq.q.cols[0].Typ }
+
+func (sq *subqueryExpr) eval(env *env) (parser.Datum, error) {
+	rows, err := sq.q.run(env.x, env)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(rows) == 0:
+		return parser.DNull, nil
+	case len(rows) > 1:
+		return nil, sql.NewPGError(sql.CodeCardinalityViolationError, "more than one row returned by a subquery used as an expression")
+	}
+	return rows[0].Values[0], nil
+}
+
+// arrayExpr is ARRAY(subquery) or ARRAY[elems].
+type arrayExpr struct {
+	q     *query
+	elems []expr
+}
+
+func (a *arrayExpr) resolve(s *scope) error {
+	if a.q != nil {
+		if err := a.q.resolve(s); err != nil {
+			return err
+		}
+		if len(a.q.cols) != 1 {
+			return sql.NewPGError(sql.CodeSyntaxError, "subquery must return only one column")
+		}
+	}
+	for _, e := range a.elems {
+		if err := e.resolve(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *arrayExpr) typ() parser.Datum { return parser.DummyString }
+
+func (a *arrayExpr) eval(env *env) (parser.Datum, error) {
+	tuple := parser.DTuple{}
+	if a.q != nil {
+		rows, err := a.q.run(env.x, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			tuple = append(tuple, row.Values[0])
+		}
+		return tuple, nil
+	}
+	for _, e := range a.elems {
+		v, err := e.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		tuple = append(tuple, v)
+	}
+	return tuple, nil
+}
+
+// existsExpr is EXISTS (subquery).
+type existsExpr struct {
+	q *query
+}
+
+func (ex *existsExpr) resolve(s *scope) error { return ex.q.resolve(s) }
+func (ex *existsExpr) typ() parser.Datum      { return parser.DummyBool }
+
+func (ex *existsExpr) eval(env *env) (parser.Datum, error) {
+	rows, err := ex.q.run(env.x, env)
+	if err != nil {
+		return nil, err
+	}
+	return parser.DBool(len(rows) > 0), nil
+}
+
+// funcExpr is a call of one of the built-in functions.
+type funcExpr struct {
+	name string
+	fn   *function
+	args []expr
+}
+
+func (f *funcExpr) resolve(s *scope) error {
+	for _, a := range f.args {
+		if err := a.resolve(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *funcExpr) typ() parser.Datum {
+	if f.fn.typ == nil {
+		if len(f.args) == 0 {
+			return parser.DummyString
+		}
+		return f.args[0].typ()
+	}
+	return f.fn.typ
+}
+
+func (f *funcExpr) eval(env *env) (parser.Datum, error) {
+	args := make([]parser.Datum, len(f.args))
+	for i, a := range f.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if v == parser.DNull && f.fn.strict {
+			return parser.DNull, nil
+		}
+		args[i] = v
+	}
+	return f.fn.call(env.x, args)
+}
+
+// substring returns count characters of s starting at the 1-based start.
+func substring(s string, start, count int64) string {
+	runes := []rune(s)
+	end := int64(len(runes)) + 1
+	if count >= 0 && start+count < end {
+		end = start + count
+	}
+	if start < 1 {
+		start = 1
+	}
+	if start >= end {
+		return ""
+	}
+	return string(runes[start-1 : end-1])
+}
@@ -0,0 +1,144 @@
+package catalog
+
+import (
+	"fmt"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"strings"
+)
+
+// function is a built-in function that catalog queries may call.
+type function struct {
+	minArgs, maxArgs int          // maxArgs is -1 for any number.
+	typ              parser.Datum // nil for the type of the first argument.
+
+	// strict functions return NULL, without being called, when any
+	// argument is NULL.
+	strict bool
+	call   func(x *execution, args []parser.Datum) (parser.Datum, error)
+}
+
+// functions are those used by psql and the introspection queries of
+// drivers and ORMs. Functions describing objects which cannot exist here,
+// such as defaults, constraints and comments, return NULL.
+var functions = map[string]*function{
+	"pg_table_is_visible": {1, 1, parser.DummyBool, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		for _, rel := range x.allRelations() {
+			if compare(parser.DInt(rel.oid), args[0]) == 0 {
+				return parser.DBool(isVisible(rel.schema)), nil
+			}
+		}
+		return parser.DNull, nil
+	}},
+	"pg_type_is_visible":     {1, 1, parser.DummyBool, true, constant(parser.DBool(true))},
+	"pg_function_is_visible": {1, 1, parser.DummyBool, true, constant(parser.DBool(true))},
+	"pg_get_userbyid": {1, 1, parser.DummyString, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		if compare(args[0], parser.DInt(bootstrapSuperuser)) == 0 {
+			return parser.DString("postgres"), nil
+		}
+		return parser.DString(fmt.Sprintf("unknown (OID=%s)", toText(args[0]))), nil
+	}},
+	"format_type": {2, 2, parser.DummyString, false, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		if args[0] == parser.DNull {
+			return parser.DNull, nil
+		}
+		id, ok := toFloat(args[0])
+		if !ok {
+			return nil, sql.NewPGError(sql.CodeInvalidTextRepresentationError, "invalid type OID %q", toText(args[0]))
+		}
+		return parser.DString(x.e.formatType(int64(id))), nil
+	}},
+	"pg_get_expr":          {2, 3, parser.DummyString, true, constant(parser.DNull)},
+	"pg_get_indexdef":      {1, 3, parser.DummyString, true, constant(parser.DNull)},
+	"pg_get_constraintdef": {1, 2, parser.DummyString, true, constant(parser.DNull)},
+	"pg_get_viewdef":       {1, 2, parser.DummyString, true, constant(parser.DNull)},
+	"obj_description":      {1, 2, parser.DummyString, true, constant(parser.DNull)},
+	"col_description":      {2, 2, parser.DummyString, true, constant(parser.DNull)},
+	"shobj_description":    {2, 2, parser.DummyString, true, constant(parser.DNull)},
+	"pg_encoding_to_char":  {1, 1, parser.DummyString, true, constant(parser.DString("UTF8"))},
+	"current_database": {0, 0, parser.DummyString, false, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		return parser.DString(x.e.databaseName(x.ctx)), nil
+	}},
+	"current_catalog": {0, 0, parser.DummyString, false, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		return parser.DString(x.e.databaseName(x.ctx)), nil
+	}},
+	"current_schema": {0, 0, parser.DummyString, false, constant(parser.DString("public"))},
+	"current_user":   {0, 0, parser.DummyString, false, sessionUser},
+	"current_role":   {0, 0, parser.DummyString, false, sessionUser},
+	"session_user":   {0, 0, parser.DummyString, false, sessionUser},
+	"version": {0, 0, parser.DummyString, false, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		version := "9.5.0"
+		if s, ok := sql.FromContext(x.ctx); ok {
+			if v, err := s.GetVar("server_version"); err == nil {
+				version = v
+			}
+		}
+		return parser.DString("PostgreSQL " + version), nil
+	}},
+	"coalesce": {1, -1, nil, false, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		for _, a := range args {
+			if a != parser.DNull {
+				return a, nil
+			}
+		}
+		return parser.DNull, nil
+	}},
+	"lower": {1, 1, parser.DummyString, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		return parser.DString(strings.ToLower(toText(args[0]))), nil
+	}},
+	"upper": {1, 1, parser.DummyString, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		return parser.DString(strings.ToUpper(toText(args[0]))), nil
+	}},
+	"substring": {2, 3, parser.DummyString, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		start, ok := toFloat(args[1])
+		count := -1.0
+		if len(args) == 3 {
+			var countOk bool
+			count, countOk = toFloat(args[2])
+			ok = ok && countOk
+			if count < 0 {
+				return nil, sql.NewPGError(sql.CodeSubstringError, "negative substring length not allowed")
+			}
+		}
+		if !ok {
+			return nil, sql.NewPGError(sql.CodeSubstringError, "invalid substring bounds")
+		}
+		return parser.DString(substring(toText(args[0]), int64(start), int64(count))), nil
+	}},
+	"array_to_string": {2, 3, parser.DummyString, true, func(x *execution, args []parser.Datum) (parser.Datum, error) {
+		var elems []string
+		for _, e := range arrayElements(args[0]) {
+			if e != parser.DNull {
+				elems = append(elems, toText(e))
+			}
+		}
+		return parser.DString(strings.Join(elems, toText(args[1]))), nil
+	}},
+}
+
+func constant(d parser.Datum) func(*execution, []parser.Datum) (parser.Datum, error) {
+	return func(*execution, []parser.Datum) (parser.Datum, error) {
+		return d, nil
+	}
+}
+
+func sessionUser(x *execution, args []parser.Datum) (parser.Datum, error) {
+	if s, ok := sql.FromContext(x.ctx); ok && s.User != "" {
+		return parser.DString(s.User), nil
+	}
+	return parser.DString("postgres"), nil
+}
+
+// formatType returns the SQL name of the type with the given OID, as
+// format_type does.
+func (e *Executor) formatType(id int64) string {
+	for _, t := range e.types {
+		if int64(t.Oid) == id {
+			if name, ok := sqlTypeNames[t.Name]; ok {
+				return name
+			}
+			return t.Name
+		}
+	}
+	return "???"
+}
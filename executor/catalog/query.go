@@ -0,0 +1,734 @@
+package catalog
+
+import (
+	"fmt"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// query is a parsed SELECT against emulated relations.
+type query struct {
+	distinct bool
+	targets  []target
+	from     []*fromItem
+	where    expr
+	orderBy  []orderItem
+	limit    int64 // -1 when there is no LIMIT.
+	offset   int64
+
+	// cols are the result columns, set by resolve.
+	cols []executor.ResultColumn
+	// params are the parameters used anywhere in the statement, subqueries
+	// included. Only set on the outermost query.
+	params []*paramExpr
+}
+
+// fromItem is a relation of the FROM clause. Each one after the first is
+// joined to the rows produced by those before it.
+type fromItem struct {
+	rel   *relation
+	alias string
+	left  bool // LEFT JOIN: rows without a match are kept, with NULLs.
+	on    expr // nil for the first relation, comma lists and cross joins.
+}
+
+// target is an entry of the select list.
+type target struct {
+	star  bool
+	qual  string // The table of a "qual.*" target.
+	e     expr
+	name  string
+	items []int // The FROM items a star expands to, set by resolve.
+}
+
+type orderItem struct {
+	e          expr
+	pos        int // 1-based select list position, when ordering by number or output name.
+	desc       bool
+	nullsFirst bool
+}
+
+// keywords cannot be used as bare aliases or column names.
+var keywords = map[string]bool{
+	"from": true, "where": true, "order": true, "limit": true, "offset": true,
+	"join": true, "inner": true, "left": true, "right": true, "full": true,
+	"cross": true, "on": true, "group": true, "having": true, "union": true,
+	"and": true, "or": true, "not": true, "is": true, "in": true, "like": true,
+	"ilike": true, "as": true, "asc": true, "desc": true, "case": true,
+	"when": true, "then": true, "else": true, "end": true, "collate": true,
+	"operator": true, "outer": true, "nulls": true, "for": true, "except": true,
+	"intersect": true, "using": true, "escape": true, "select": true,
+}
+
+type tokenReader struct {
+	toks   []parser.Token
+	pos    int
+	params []*paramExpr
+	tables map[string]bool // See parseQuery.
+}
+
+func (r *tokenReader) done() bool {
+	return r.pos >= len(r.toks)
+}
+
+func (r *tokenReader) peek() parser.Token {
+	if r.done() {
+		return parser.Token{Kind: parser.Punct}
+	}
+	return r.toks[r.pos]
+}
+
+// peekAt returns the token n past the current one.
+func (r *tokenReader) peekAt(n int) parser.Token {
+	if r.pos+n >= len(r.toks) {
+		return parser.Token{Kind: parser.Punct}
+	}
+	return r.toks[r.pos+n]
+}
+
+func (r *tokenReader) next() parser.Token {
+	t := r.peek()
+	r.pos++
+	return t
+}
+
+func (r *tokenReader) accept(kw string) bool {
+	if !r.done() && r.peek().Is(kw) {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+func (r *tokenReader) expect(kw string) error {
+	if !r.accept(kw) {
+		return r.unsupported()
+	}
+	return nil
+}
+
+// unsupported returns the error for a statement which cannot continue with
+// the current token. Catalog queries only support part of SELECT, so that
+// is taken to be a construct they do not support rather than a syntax
+// error, unless the statement ended early.
+func (r *tokenReader) unsupported() error {
+	if r.done() {
+		return sql.NewPGError(sql.CodeSyntaxError, "syntax error at end of input")
+	}
+	return sql.NewPGError(sql.CodeFeatureNotSupportedError, "unsupported catalog query at or near %q", r.peek().String())
+}
+
+func isName(t parser.Token) bool {
+	return t.Kind == parser.QuotedIdent || (t.Kind == parser.Ident && !keywords[t.Val])
+}
+
+// isLabel reports whether t may follow AS: any identifier, keywords included.
+func isLabel(t parser.Token) bool {
+	return t.Kind == parser.QuotedIdent || t.Kind == parser.Ident
+}
+
+// parseQuery parses a catalog query. tables holds the names of the wrapped
+// executor's tables, which unqualified names refer to before the emulated
+// relations.
+func parseQuery(stmt string, tables map[string]bool) (*query, error) {
+	toks, err := parser.Scan(stmt)
+	if err != nil {
+		return nil, sql.NewPGError(sql.CodeSyntaxError, "%s", err)
+	}
+	r := &tokenReader{toks: toks, tables: tables}
+	q, err := parseSelect(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.done() {
+		return nil, r.unsupported()
+	}
+	q.params = r.params
+	return q, q.resolve(nil)
+}
+
+// parseSelect parses a SELECT, stopping at the first token which cannot
+// continue it so that it may be used for subqueries.
+func parseSelect(r *tokenReader) (*query, error) {
+	q := &query{limit: -1}
+	if err := r.expect("select"); err != nil {
+		return nil, err
+	}
+	if q.distinct = r.accept("distinct"); !q.distinct {
+		r.accept("all")
+	}
+	for {
+		t, err := parseTarget(r)
+		if err != nil {
+			return nil, err
+		}
+		q.targets = append(q.targets, t)
+		if !r.accept(",") {
+			break
+		}
+	}
+
+	if err := r.expect("from"); err != nil {
+		return nil, err
+	}
+	if err := q.parseFrom(r); err != nil {
+		return nil, err
+	}
+
+	if r.accept("where") {
+		where, err := parseExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		q.where = where
+	}
+
+	if r.accept("order") {
+		if err := r.expect("by"); err != nil {
+			return nil, err
+		}
+		for {
+			o, err := parseOrderItem(r)
+			if err != nil {
+				return nil, err
+			}
+			q.orderBy = append(q.orderBy, o)
+			if !r.accept(",") {
+				break
+			}
+		}
+	}
+
+	if r.accept("limit") {
+		if !r.accept("all") {
+			n, err := parseCount(r)
+			if err != nil {
+				return nil, err
+			}
+			q.limit = n
+		}
+	}
+	if r.accept("offset") {
+		n, err := parseCount(r)
+		if err != nil {
+			return nil, err
+		}
+		q.offset = n
+	}
+	return q, nil
+}
+
+func parseCount(r *tokenReader) (int64, error) {
+	if r.peek().Kind != parser.Number {
+		return 0, r.unsupported()
+	}
+	n, err := strconv.ParseInt(r.peek().Val, 10, 64)
+	if err != nil {
+		return 0, r.unsupported()
+	}
+	r.next()
+	return n, nil
+}
+
+func parseTarget(r *tokenReader) (target, error) {
+	if r.accept("*") {
+		return target{star: true}, nil
+	}
+	if isName(r.peek()) && r.peekAt(1).Is(".") && r.peekAt(2).Is("*") {
+		t := target{star: true, qual: r.next().Val}
+		r.pos += 2
+		return t, nil
+	}
+
+	e, err := parseExpr(r)
+	if err != nil {
+		return target{}, err
+	}
+	t := target{e: e, name: exprName(e)}
+	if r.accept("as") {
+		if !isLabel(r.peek()) {
+			return target{}, r.unsupported()
+		}
+		t.name = r.next().Val
+	} else if isName(r.peek()) {
+		t.name = r.next().Val
+	}
+	return t, nil
+}
+
+func parseOrderItem(r *tokenReader) (orderItem, error) {
+	var o orderItem
+	if r.peek().Kind == parser.Number && (r.peekAt(1).Is(",") || !isOperand(r.peekAt(1))) {
+		pos, err := strconv.Atoi(r.peek().Val)
+		if err != nil {
+			return o, r.unsupported()
+		}
+		r.next()
+		o.pos = pos
+	} else {
+		e, err := parseExpr(r)
+		if err != nil {
+			return o, err
+		}
+		o.e = e
+	}
+	if r.accept("desc") {
+		o.desc = true
+	} else {
+		r.accept("asc")
+	}
+	o.nullsFirst = o.desc
+	if r.accept("nulls") {
+		switch {
+		case r.accept("first"):
+			o.nullsFirst = true
+		case r.accept("last"):
+			o.nullsFirst = false
+		default:
+			return o, r.unsupported()
+		}
+	}
+	return o, nil
+}
+
+// isOperand reports whether t continues an expression begun by a number,
+// which is then not an ORDER BY position.
+func isOperand(t parser.Token) bool {
+	return t.Kind == parser.Punct && t.Val != "" && t.Val != ")" && t.Val != ";"
+}
+
+// parseFrom parses the FROM clause: relations separated by commas or joined
+// with [INNER] JOIN, LEFT [OUTER] JOIN or CROSS JOIN.
+func (q *query) parseFrom(r *tokenReader) error {
+	item, err := parseFromItem(r)
+	if err != nil {
+		return err
+	}
+	q.from = append(q.from, item)
+	for {
+		var left, on bool
+		switch {
+		case r.accept(","):
+		case r.accept("cross"):
+			if err := r.expect("join"); err != nil {
+				return err
+			}
+		case r.accept("join"):
+			on = true
+		case r.accept("inner"):
+			if err := r.expect("join"); err != nil {
+				return err
+			}
+			on = true
+		case r.accept("left"):
+			r.accept("outer")
+			if err := r.expect("join"); err != nil {
+				return err
+			}
+			left, on = true, true
+		default:
+			return nil
+		}
+
+		item, err := parseFromItem(r)
+		if err != nil {
+			return err
+		}
+		item.left = left
+		if on {
+			if err := r.expect("on"); err != nil {
+				return err
+			}
+			if item.on, err = parseExpr(r); err != nil {
+				return err
+			}
+		}
+		q.from = append(q.from, item)
+	}
+}
+
+func parseFromItem(r *tokenReader) (*fromItem, error) {
+	if r.done() || !isName(r.peek()) {
+		return nil, r.unsupported()
+	}
+	rel, n, ok := relationAt(r.toks, r.pos, r.tables)
+	if !ok {
+		name := r.peek().Val
+		if r.peekAt(1).Is(".") && isLabel(r.peekAt(2)) {
+			name += "." + r.peekAt(2).Val
+		}
+		return nil, sql.NewPGError(sql.CodeUndefinedTableError, "relation %q does not exist", name)
+	}
+	r.pos += n
+
+	item := &fromItem{rel: rel, alias: rel.name}
+	if r.accept("as") {
+		if !isLabel(r.peek()) {
+			return nil, r.unsupported()
+		}
+		item.alias = r.next().Val
+	} else if isName(r.peek()) {
+		item.alias = r.next().Val
+	}
+	return item, nil
+}
+
+func (r *relation) columnIndex(name string) (int, error) {
+	for i, c := range r.columns {
+		if c.Name == name {
+			return i, nil
+		}
+	}
+	return 0, sql.NewPGError(sql.CodeUndefinedColumnError, "column %q does not exist", name)
+}
+
+// scope holds the FROM items visible to the expressions of a query, and
+// through outer those of the queries enclosing it.
+type scope struct {
+	q     *query
+	outer *scope
+}
+
+// resolve binds the column references of q, outer being the scope of the
+// enclosing query for subqueries, and works out its result columns.
+func (q *query) resolve(outer *scope) error {
+	s := &scope{q: q, outer: outer}
+	for _, item := range q.from {
+		if item.on == nil {
+			continue
+		}
+		if err := item.on.resolve(s); err != nil {
+			return err
+		}
+	}
+
+	q.cols = nil
+	for i := range q.targets {
+		t := &q.targets[i]
+		if !t.star {
+			if err := t.e.resolve(s); err != nil {
+				return err
+			}
+			q.cols = append(q.cols, executor.ResultColumn{Name: t.name, Typ: t.e.typ()})
+			continue
+		}
+		t.items = nil
+		for j, item := range q.from {
+			if t.qual == "" || t.qual == item.alias {
+				t.items = append(t.items, j)
+				q.cols = append(q.cols, item.rel.columns...)
+			}
+		}
+		if len(t.items) == 0 {
+			return sql.NewPGError(sql.CodeUndefinedTableError, "missing FROM-clause entry for table %q", t.qual)
+		}
+	}
+
+	if q.where != nil {
+		if err := q.where.resolve(s); err != nil {
+			return err
+		}
+	}
+
+	for i := range q.orderBy {
+		o := &q.orderBy[i]
+		// As in PostgreSQL, a bare name orders by the output column of
+		// that name before an input column.
+		if c, ok := o.e.(*colRef); ok && c.qual == "" {
+			for j, col := range q.cols {
+				if col.Name == c.name {
+					o.pos = j + 1
+					break
+				}
+			}
+		}
+		if o.pos == 0 {
+			if err := o.e.resolve(s); err != nil {
+				return err
+			}
+		} else if o.pos < 1 || o.pos > len(q.cols) {
+			return sql.NewPGError(sql.CodeInvalidColumnReferenceError, "ORDER BY position %d is not in select list", o.pos)
+		}
+	}
+	return nil
+}
+
+// args infers the types of the parameters in q from the expressions they
+// are compared with. Types already present in hints are kept.
+func (q *query) args(hints parser.MapArgs) parser.MapArgs {
+	args := make(parser.MapArgs)
+	for k, v := range hints {
+		args[k] = v
+	}
+	for _, p := range q.params {
+		if p.t == nil {
+			continue
+		}
+		k := strconv.Itoa(p.n)
+		if _, ok := args[k]; !ok {
+			args[k] = p.t
+		}
+	}
+	return args
+}
+
+// run evaluates q, outer being the row of the enclosing query for
+// correlated subqueries.
+func (q *query) run(x *execution, outer *env) ([]executor.ResultRow, error) {
+	// Join with nested loops; the emulated relations are small.
+	tuples := [][]executor.ResultRow{nil}
+	for _, item := range q.from {
+		rows := x.relationRows(item.rel)
+		var joined [][]executor.ResultRow
+		for _, t := range tuples {
+			matched := false
+			for _, row := range rows {
+				next := append(t[:len(t):len(t)], row)
+				if item.on != nil {
+					ok, err := isTrue(item.on, &env{x: x, tuple: next, outer: outer})
+					if err != nil {
+						return nil, err
+					}
+					if !ok {
+						continue
+					}
+				}
+				matched = true
+				joined = append(joined, next)
+			}
+			if item.left && !matched {
+				joined = append(joined, append(t[:len(t):len(t)], executor.ResultRow{}))
+			}
+		}
+		tuples = joined
+	}
+
+	type sortRow struct {
+		values, keys []parser.Datum
+	}
+	var out []sortRow
+	seen := make(map[string]bool)
+	for _, t := range tuples {
+		env := &env{x: x, tuple: t, outer: outer}
+		if q.where != nil {
+			ok, err := isTrue(q.where, env)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		var r sortRow
+		for _, tg := range q.targets {
+			if tg.star {
+				for _, j := range tg.items {
+					if t[j].Values == nil {
+						r.values = append(r.values, nulls(len(q.from[j].rel.columns))...)
+					} else {
+						r.values = append(r.values, t[j].Values...)
+					}
+				}
+				continue
+			}
+			v, err := tg.e.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			if tuple, ok := v.(parser.DTuple); ok {
+				v = parser.DString(arrayText(tuple))
+			}
+			r.values = append(r.values, v)
+		}
+		if q.distinct {
+			key := rowKey(r.values)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		for _, o := range q.orderBy {
+			if o.pos != 0 {
+				r.keys = append(r.keys, r.values[o.pos-1])
+				continue
+			}
+			v, err := o.e.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			r.keys = append(r.keys, v)
+		}
+		out = append(out, r)
+	}
+
+	if len(q.orderBy) > 0 {
+		sort.SliceStable(out, func(a, b int) bool {
+			for i, o := range q.orderBy {
+				x, y := out[a].keys[i], out[b].keys[i]
+				if xNull, yNull := x == parser.DNull, y == parser.DNull; xNull || yNull {
+					if xNull == yNull {
+						continue
+					}
+					return xNull == o.nullsFirst
+				}
+				c := compare(x, y)
+				if c == 0 {
+					continue
+				}
+				if o.desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+
+	if q.offset >= int64(len(out)) {
+		out = nil
+	} else {
+		out = out[q.offset:]
+	}
+	if q.limit >= 0 && q.limit < int64(len(out)) {
+		out = out[:q.limit]
+	}
+
+	result := make([]executor.ResultRow, len(out))
+	for i, r := range out {
+		result[i].Values = r.values
+	}
+	return result, nil
+}
+
+func nulls(n int) []parser.Datum {
+	values := make([]parser.Datum, n)
+	for i := range values {
+		values[i] = parser.DNull
+	}
+	return values
+}
+
+// rowKey identifies the values of a row for DISTINCT.
+func rowKey(values []parser.Datum) string {
+	var b []byte
+	for _, v := range values {
+		b = append(b, fmt.Sprintf("%T:%s\x00", v, toText(v))...)
+	}
+	return string(b)
+}
+
+// compare orders two datums, converting b to the type of a where needed.
+// NULLs sort after everything else.
+func compare(a, b parser.Datum) int {
+	if a == parser.DNull || b == parser.DNull {
+		switch {
+		case a == b:
+			return 0
+		case a == parser.DNull:
+			return 1
+		default:
+			return -1
+		}
+	}
+
+	switch x := a.(type) {
+	case parser.DInt:
+		if y, ok := toFloat(b); ok {
+			return compareFloat(float64(x), y)
+		}
+	case parser.DFloat:
+		if y, ok := toFloat(b); ok {
+			return compareFloat(float64(x), y)
+		}
+	case parser.DBool:
+		if y, ok := toBool(b); ok {
+			return compareFloat(boolToFloat(bool(x)), boolToFloat(y))
+		}
+	case parser.DString:
+		// Compare a string literal with a number as a number, as an
+		// untyped literal would be.
+		if _, ok := b.(parser.DString); !ok {
+			return -compare(b, a)
+		}
+	}
+	return strings.Compare(toText(a), toText(b))
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(d parser.Datum) (float64, bool) {
+	switch v := d.(type) {
+	case parser.DInt:
+		return float64(v), true
+	case parser.DFloat:
+		return float64(v), true
+	case parser.DString:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toBool(d parser.Datum) (bool, bool) {
+	switch v := d.(type) {
+	case parser.DBool:
+		return bool(v), true
+	case parser.DString:
+		switch strings.ToLower(strings.TrimSpace(string(v))) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, true
+		case "f", "false", "n", "no", "off", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func toText(d parser.Datum) string {
+	switch v := d.(type) {
+	case parser.DString:
+		return string(v)
+	case parser.DInt:
+		return strconv.FormatInt(int64(v), 10)
+	case parser.DFloat:
+		return strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case parser.DBool:
+		return strconv.FormatBool(bool(v))
+	case parser.DTuple:
+		return arrayText(v)
+	}
+	return fmt.Sprint(d)
+}
+
+// arrayText formats the elements of an array as an array literal.
+func arrayText(t parser.DTuple) string {
+	elems := make([]string, len(t))
+	for i, d := range t {
+		if d == parser.DNull {
+			elems[i] = "NULL"
+		} else {
+			elems[i] = toText(d)
+		}
+	}
+	return "{" + strings.Join(elems, ",") + "}"
+}
@@ -0,0 +1,352 @@
+package catalog
+
+import (
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+)
+
+// Well known OIDs, matching a stock PostgreSQL cluster where one exists.
+const (
+	pgCatalogNamespace         = 11
+	publicNamespace            = 2200
+	informationSchemaNamespace = 12000
+	bootstrapSuperuser         = 10
+	databaseOid                = 16383
+	utf8Encoding               = 6
+	defaultCollation           = 100
+
+	// firstUserOid is the first OID assigned to user tables.
+	firstUserOid = 16384
+)
+
+// relation is an emulated catalog table or view.
+type relation struct {
+	oid     int64
+	schema  string
+	name    string
+	kind    string // pg_class.relkind: "r" for tables, "v" for views.
+	columns []executor.ResultColumn
+}
+
+func (r *relation) qualifiedName() string {
+	return r.schema + "." + r.name
+}
+
+func col(name string, typ parser.Datum) executor.ResultColumn {
+	return executor.ResultColumn{Name: name, Typ: typ}
+}
+
+var (
+	oidCol  = parser.DummyInt
+	intCol  = parser.DummyInt
+	nameCol = parser.DummyString
+	textCol = parser.DummyString
+	charCol = parser.DummyString
+	boolCol = parser.DummyBool
+)
+
+var catalogRelations = []*relation{
+	{1247, "pg_catalog", "pg_type", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("typname", nameCol), col("typnamespace", oidCol),
+		col("typowner", oidCol), col("typlen", intCol), col("typbyval", boolCol),
+		col("typtype", charCol), col("typcategory", charCol), col("typisdefined", boolCol),
+		col("typdelim", charCol), col("typrelid", oidCol), col("typelem", oidCol),
+		col("typarray", oidCol), col("typbasetype", oidCol), col("typtypmod", intCol),
+		col("typnotnull", boolCol), col("typcollation", oidCol),
+	}},
+	{1249, "pg_catalog", "pg_attribute", "r", []executor.ResultColumn{
+		col("attrelid", oidCol), col("attname", nameCol), col("atttypid", oidCol),
+		col("attlen", intCol), col("attnum", intCol), col("atttypmod", intCol),
+		col("attnotnull", boolCol), col("atthasdef", boolCol), col("attisdropped", boolCol),
+		col("attcollation", oidCol),
+	}},
+	{1259, "pg_catalog", "pg_class", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("relname", nameCol), col("relnamespace", oidCol),
+		col("reltype", oidCol), col("relowner", oidCol), col("relkind", charCol),
+		col("relnatts", intCol), col("relhasindex", boolCol), col("relpersistence", charCol),
+		col("relchecks", intCol), col("relhasoids", boolCol), col("relhasrules", boolCol),
+		col("relhastriggers", boolCol), col("relhassubclass", boolCol), col("relrowsecurity", boolCol),
+		col("relforcerowsecurity", boolCol), col("reltablespace", oidCol), col("reloftype", oidCol),
+		col("reltoastrelid", oidCol), col("relreplident", charCol),
+	}},
+	{1262, "pg_catalog", "pg_database", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("datname", nameCol), col("datdba", oidCol),
+		col("encoding", intCol), col("datcollate", nameCol), col("datctype", nameCol),
+		col("datistemplate", boolCol), col("datallowconn", boolCol),
+	}},
+	{2604, "pg_catalog", "pg_attrdef", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("adrelid", oidCol), col("adnum", intCol), col("adbin", textCol),
+		col("adsrc", textCol),
+	}},
+	{2611, "pg_catalog", "pg_inherits", "r", []executor.ResultColumn{
+		col("inhrelid", oidCol), col("inhparent", oidCol), col("inhseqno", intCol),
+	}},
+	{2615, "pg_catalog", "pg_namespace", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("nspname", nameCol), col("nspowner", oidCol),
+	}},
+	{3256, "pg_catalog", "pg_policy", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("polname", nameCol), col("polrelid", oidCol), col("polcmd", charCol),
+		col("polroles", textCol), col("polqual", textCol), col("polwithcheck", textCol),
+	}},
+	{3456, "pg_catalog", "pg_collation", "r", []executor.ResultColumn{
+		col("oid", oidCol), col("collname", nameCol), col("collnamespace", oidCol),
+		col("collowner", oidCol), col("collencoding", intCol), col("collcollate", nameCol),
+		col("collctype", nameCol),
+	}},
+	{11000, "pg_catalog", "pg_settings", "v", []executor.ResultColumn{
+		col("name", textCol), col("setting", textCol), col("unit", textCol),
+		col("category", textCol), col("short_desc", textCol), col("context", textCol),
+		col("vartype", textCol), col("source", textCol),
+	}},
+	{11001, "pg_catalog", "pg_roles", "v", []executor.ResultColumn{
+		col("oid", oidCol), col("rolname", nameCol), col("rolsuper", boolCol),
+		col("rolinherit", boolCol), col("rolcreaterole", boolCol), col("rolcreatedb", boolCol),
+		col("rolcanlogin", boolCol), col("rolreplication", boolCol), col("rolconnlimit", intCol),
+		col("rolbypassrls", boolCol),
+	}},
+	{12001, "information_schema", "schemata", "v", []executor.ResultColumn{
+		col("catalog_name", nameCol), col("schema_name", nameCol), col("schema_owner", nameCol),
+	}},
+	{12002, "information_schema", "tables", "v", []executor.ResultColumn{
+		col("table_catalog", nameCol), col("table_schema", nameCol), col("table_name", nameCol),
+		col("table_type", textCol),
+	}},
+	{12003, "information_schema", "columns", "v", []executor.ResultColumn{
+		col("table_catalog", nameCol), col("table_schema", nameCol), col("table_name", nameCol),
+		col("column_name", nameCol), col("ordinal_position", intCol), col("column_default", textCol),
+		col("is_nullable", textCol), col("data_type", textCol), col("udt_name", nameCol),
+	}},
+}
+
+// relations indexes catalogRelations by qualified name.
+var relations = make(map[string]*relation)
+
+func init() {
+	for _, r := range catalogRelations {
+		relations[r.qualifiedName()] = r
+	}
+}
+
+// sqlTypeNames maps type names to the names information_schema reports.
+var sqlTypeNames = map[string]string{
+	"bool":        "boolean",
+	"int2":        "smallint",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"float4":      "real",
+	"float8":      "double precision",
+	"varchar":     "character varying",
+	"timestamp":   "timestamp without time zone",
+	"timestamptz": "timestamp with time zone",
+}
+
+// allRelations returns the emulated relations followed by the user tables,
+// each user table having been assigned an OID.
+func (e *Executor) allRelations(ctx context.Context) []*relation {
+	rels := append([]*relation(nil), catalogRelations...)
+	for i, t := range e.userTables(ctx) {
+		rels = append(rels, &relation{
+			oid:     int64(firstUserOid + i),
+			schema:  t.Schema,
+			name:    t.Name,
+			kind:    "r",
+			columns: t.Columns,
+		})
+	}
+	return rels
+}
+
+func (e *Executor) databaseName(ctx context.Context) string {
+	if s, ok := sql.FromContext(ctx); ok && s.Database != "" {
+		return s.Database
+	}
+	return "postgres"
+}
+
+func namespaceOid(schema string) int64 {
+	switch schema {
+	case "pg_catalog":
+		return pgCatalogNamespace
+	case "information_schema":
+		return informationSchemaNamespace
+	case "public":
+		return publicNamespace
+	}
+	// Assign other schemas an OID derived from their name, so it is stable
+	// across queries.
+	var h int64 = 1
+	for _, c := range schema {
+		h = (h*31 + int64(c)) % 1000000
+	}
+	return firstUserOid + 1000000 + h
+}
+
+func row(values ...parser.Datum) executor.ResultRow {
+	return executor.ResultRow{Values: values}
+}
+
+func nullable(s string) parser.Datum {
+	if s == "" {
+		return parser.DNull
+	}
+	return parser.DString(s)
+}
+
+// rows synthesizes the contents of an emulated relation.
+func (e *Executor) rows(ctx context.Context, r *relation) []executor.ResultRow {
+	var rows []executor.ResultRow
+
+	switch r.qualifiedName() {
+	case "pg_catalog.pg_type":
+		for _, t := range e.types {
+			byval := t.Len > 0 && t.Len <= 8
+			rows = append(rows, row(
+				parser.DInt(t.Oid), parser.DString(t.Name), parser.DInt(pgCatalogNamespace),
+				parser.DInt(bootstrapSuperuser), parser.DInt(t.Len), parser.DBool(byval),
+				parser.DString("b"), parser.DString(string(t.Category)), parser.DBool(true),
+				parser.DString(","), parser.DInt(0), parser.DInt(0),
+				parser.DInt(0), parser.DInt(0), parser.DInt(-1),
+				parser.DBool(false), parser.DInt(typeCollation(t)),
+			))
+		}
+
+	case "pg_catalog.pg_attribute":
+		for _, rel := range e.allRelations(ctx) {
+			for i, c := range rel.columns {
+				id := e.typeOf(c.Typ)
+				t, _ := e.lookupType(id)
+				rows = append(rows, row(
+					parser.DInt(rel.oid), parser.DString(c.Name), parser.DInt(id),
+					parser.DInt(t.Len), parser.DInt(i+1), parser.DInt(-1),
+					parser.DBool(false), parser.DBool(false), parser.DBool(false),
+					parser.DInt(typeCollation(t)),
+				))
+			}
+		}
+
+	case "pg_catalog.pg_class":
+		for _, rel := range e.allRelations(ctx) {
+			rows = append(rows, row(
+				parser.DInt(rel.oid), parser.DString(rel.name), parser.DInt(namespaceOid(rel.schema)),
+				parser.DInt(0), parser.DInt(bootstrapSuperuser), parser.DString(rel.kind),
+				parser.DInt(len(rel.columns)), parser.DBool(false), parser.DString("p"),
+				parser.DInt(0), parser.DBool(false), parser.DBool(false),
+				parser.DBool(false), parser.DBool(false), parser.DBool(false),
+				parser.DBool(false), parser.DInt(0), parser.DInt(0),
+				parser.DInt(0), parser.DString("d"),
+			))
+		}
+
+	case "pg_catalog.pg_database":
+		rows = append(rows, row(
+			parser.DInt(databaseOid), parser.DString(e.databaseName(ctx)), parser.DInt(bootstrapSuperuser),
+			parser.DInt(utf8Encoding), parser.DString("C"), parser.DString("C"),
+			parser.DBool(false), parser.DBool(true),
+		))
+
+	case "pg_catalog.pg_namespace":
+		for _, schema := range e.schemas(ctx) {
+			rows = append(rows, row(
+				parser.DInt(namespaceOid(schema)), parser.DString(schema), parser.DInt(bootstrapSuperuser),
+			))
+		}
+
+	case "pg_catalog.pg_collation":
+		for _, c := range []struct {
+			oid          int64
+			name, locale string
+		}{{defaultCollation, "default", ""}, {950, "C", "C"}, {951, "POSIX", "POSIX"}} {
+			rows = append(rows, row(
+				parser.DInt(c.oid), parser.DString(c.name), parser.DInt(pgCatalogNamespace),
+				parser.DInt(bootstrapSuperuser), parser.DInt(-1), parser.DString(c.locale),
+				parser.DString(c.locale),
+			))
+		}
+
+	case "pg_catalog.pg_roles":
+		rows = append(rows, row(
+			parser.DInt(bootstrapSuperuser), parser.DString("postgres"), parser.DBool(true),
+			parser.DBool(true), parser.DBool(true), parser.DBool(true),
+			parser.DBool(true), parser.DBool(true), parser.DInt(-1),
+			parser.DBool(true),
+		))
+
+	case "pg_catalog.pg_settings":
+		s, ok := sql.FromContext(ctx)
+		if !ok {
+			break
+		}
+		for _, setting := range s.Settings() {
+			settingContext := "user"
+			if setting.Flags&sql.ReadOnly != 0 {
+				settingContext = "internal"
+			}
+			rows = append(rows, row(
+				parser.DString(setting.Name), parser.DString(setting.Value), parser.DNull,
+				parser.DNull, parser.DString(setting.Desc), parser.DString(settingContext),
+				parser.DString(setting.Type), parser.DString("session"),
+			))
+		}
+
+	case "information_schema.schemata":
+		for _, schema := range e.schemas(ctx) {
+			rows = append(rows, row(
+				parser.DString(e.databaseName(ctx)), parser.DString(schema), parser.DString("postgres"),
+			))
+		}
+
+	case "information_schema.tables":
+		for _, rel := range e.allRelations(ctx) {
+			typ := "BASE TABLE"
+			if rel.kind == "v" {
+				typ = "VIEW"
+			}
+			rows = append(rows, row(
+				parser.DString(e.databaseName(ctx)), parser.DString(rel.schema), parser.DString(rel.name),
+				parser.DString(typ),
+			))
+		}
+
+	case "information_schema.columns":
+		for _, rel := range e.allRelations(ctx) {
+			for i, c := range rel.columns {
+				t, _ := e.lookupType(e.typeOf(c.Typ))
+				dataType, ok := sqlTypeNames[t.Name]
+				if !ok {
+					dataType = t.Name
+				}
+				rows = append(rows, row(
+					parser.DString(e.databaseName(ctx)), parser.DString(rel.schema), parser.DString(rel.name),
+					parser.DString(c.Name), parser.DInt(i+1), parser.DNull,
+					parser.DString("YES"), nullable(dataType), nullable(t.Name),
+				))
+			}
+		}
+	}
+
+	return rows
+}
+
+// typeCollation returns the pg_type.typcollation of t: the default
+// collation for string types, none for the others.
+func typeCollation(t Type) int64 {
+	if t.Category == 'S' {
+		return defaultCollation
+	}
+	return 0
+}
+
+// schemas returns the names of all schemas, built-in ones first.
+func (e *Executor) schemas(ctx context.Context) []string {
+	schemas := []string{"pg_catalog", "public", "information_schema"}
+	seen := map[string]bool{"pg_catalog": true, "public": true, "information_schema": true}
+	for _, t := range e.userTables(ctx) {
+		if !seen[t.Schema] {
+			seen[t.Schema] = true
+			schemas = append(schemas, t.Schema)
+		}
+	}
+	return schemas
+}
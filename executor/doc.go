@@ -3,5 +3,6 @@ package executor
 // package executor provide interface to execute SQL in stateful mode.
 //
 // exeuctor is stateful, so it must belong to specific session, include
-// database, username and transaction status.
+// database, username and transaction status. libpq.Server creates one for
+// each session with its ExecutorFactory.
 // How about planner?  Does it belong to session?
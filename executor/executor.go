@@ -8,6 +8,70 @@ import (
 // An Executor executes SQL statements.
 // Executor should be thread-safe
 type Executor interface {
-	Prepare(ctx context.Context, query string, args parser.MapArgs) ([]ResultColumn, parser.MapArgs, error)
+	// Prepare prepares query for Execute. args holds the parameter types
+	// the client specified, by number: "1" for $1.
+	Prepare(ctx context.Context, query string, args parser.MapArgs) (PreparedStatement, error)
+
+	// Execute runs a statement returned by Prepare with the given
+	// parameters.
+	Execute(ctx context.Context, stmt PreparedStatement, params []parser.Datum) StatementResults
+
+	// ExecuteStatements runs a single statement of a simple query, with the
+	// given parameters if any. The query is split with parser.Split and
+	// each statement is passed in its own call, in order, after the
+	// previous one's results were sent.
 	ExecuteStatements(ctx context.Context, stmts string, params []parser.Datum) StatementResults
 }
+
+// PreparedStatement is an executor's handle on a prepared statement, passed
+// back to it by each Execute so that the query is only parsed once.
+type PreparedStatement interface {
+	// Columns describes the rows the statement returns, if any.
+	Columns() []ResultColumn
+
+	// Args holds the types of the statement's parameters, by number.
+	Args() parser.MapArgs
+
+	// Close releases the statement once the client has deallocated it and
+	// the portals bound from it, or has disconnected.
+	Close()
+}
+
+// ImplicitTransactor is implemented by executors which need to know the
+// extent of implicit transactions. Outside of a transaction block, the
+// statements of a simple query, or of an extended query pipeline up to Sync,
+// run in one implicit transaction. It is committed at the end unless one of
+// them failed. A COMMIT or ROLLBACK run in it ends it early, and a BEGIN turns
+// it into a transaction block; EndImplicit is not called for these.
+type ImplicitTransactor interface {
+	BeginImplicit(ctx context.Context) error
+	EndImplicit(ctx context.Context, commit bool) error
+}
+
+// BatchExecutor is implemented by executors which can run one statement for
+// many sets of parameters at once. A client loading data pipelines Bind and
+// Execute of the same prepared INSERT, UPDATE or DELETE, and the Executes up to
+// the next other message are passed to ExecuteBatch together rather than to
+// ExecuteStatements one by one.
+//
+// ExecuteBatch returns a result for each set of parameters in turn, up to and
+// including the first one that fails. Its ctx allows statement_timeout for
+// each set of parameters, so a batch of n is canceled after n times
+// statement_timeout.
+type BatchExecutor interface {
+	ExecuteBatch(ctx context.Context, stmt PreparedStatement, params [][]parser.Datum) ResultList
+}
+
+// SchemaProvider is implemented by executors which can describe the tables
+// they expose. It is used to synthesize the system catalogs clients query
+// for introspection.
+type SchemaProvider interface {
+	Tables(ctx context.Context) []Table
+}
+
+// Table describes a user visible relation.
+type Table struct {
+	Schema  string // Defaults to "public" if empty.
+	Name    string
+	Columns []ResultColumn
+}
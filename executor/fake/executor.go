@@ -1,28 +1,171 @@
 package fake
 
 import (
+	"errors"
 	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
 	"golang.org/x/net/context"
 	"github.com/yydzero/mnt/executor"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type FakeExecutor struct {
 
 }
 
+// fakeStatement is a statement prepared by FakeExecutor, which keeps the
+// query to run it with ExecuteStatements.
+type fakeStatement struct {
+	query string
+}
+
+func (s *fakeStatement) Columns() []executor.ResultColumn {
+	if _, ok := sleepDuration(s.query); ok {
+		return makeSleepColumns()
+	}
+	return makeFakeColumns()
+}
+
+func (s *fakeStatement) Args() parser.MapArgs {
+	return makeFakeArgs()
+}
+
+func (s *fakeStatement) Close() {
+}
+
 func (e *FakeExecutor) Prepare(ctx context.Context, query string, args parser.MapArgs) (
-	[]executor.ResultColumn, parser.MapArgs, error) {
-	cols := makeFakeColumns()
-	args = makeFakeArgs()
-	return cols, args, nil
+	executor.PreparedStatement, error) {
+	return &fakeStatement{query: query}, nil
+}
+
+func (e *FakeExecutor) Execute(ctx context.Context, stmt executor.PreparedStatement, params []parser.Datum) (
+	executor.StatementResults) {
+	return e.ExecuteStatements(ctx, stmt.(*fakeStatement).query, params)
 }
 
 func (e *FakeExecutor) ExecuteStatements(ctx context.Context, stmts string, params []parser.Datum) (
 	executor.StatementResults) {
+	if err, ok := raisedError(stmts); ok {
+		return executor.StatementResults{
+			ResultList: executor.ResultList{{Err: err}},
+		}
+	}
+	if notice, ok := raisedNotice(stmts); ok {
+		return executor.StatementResults{
+			ResultList: executor.ResultList{{Type: executor.Ack, PGTag: "DO", Notices: []error{notice}}},
+		}
+	}
+	if d, ok := sleepDuration(stmts); ok {
+		return executor.StatementResults{
+			ResultList: executor.ResultList{sleep(ctx, d)},
+		}
+	}
+	if tag, ok := transactionTag(stmts); ok {
+		return executor.StatementResults{
+			ResultList: executor.ResultList{{Type: executor.Ack, PGTag: tag}},
+		}
+	}
 	r := makeFakeStatementResults()
 	return r
 }
 
+// transactionTag returns the command tag of a transaction control statement.
+func transactionTag(stmt string) (string, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return "", false
+	}
+	switch toks[0].Val {
+	case "begin", "start":
+		return "BEGIN", true
+	case "commit", "end":
+		return "COMMIT", true
+	case "rollback", "abort":
+		return "ROLLBACK", true
+	}
+	return "", false
+}
+
+// sleepDuration returns the duration of a "SELECT pg_sleep(seconds)"
+// statement, which waits so that tests can exercise timeouts.
+func sleepDuration(stmt string) (time.Duration, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) < 5 || !toks[0].Is("select") || !toks[1].Is("pg_sleep") ||
+		!toks[2].Is("(") || toks[3].Kind != parser.Number || !toks[4].Is(")") {
+		return 0, false
+	}
+	secs, err := strconv.ParseFloat(toks[3].Val, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// sleep waits for d, or fails with the error of ctx if it is done first.
+func sleep(ctx context.Context, d time.Duration) executor.Result {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return executor.Result{Err: ctx.Err()}
+	case <-t.C:
+	}
+	return executor.Result{
+		Type:    executor.Rows,
+		PGTag:   "SELECT",
+		Columns: makeSleepColumns(),
+		Rows:    []executor.ResultRow{{Values: []parser.Datum{parser.DNull}}},
+	}
+}
+
+// raisedError returns the error of a "RAISE 'message' ['sqlstate' ['detail'
+// ['hint']]]" statement, which fails with the given message so that tests can
+// exercise error handling.
+func raisedError(stmt string) (error, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) < 2 || !toks[0].Is("raise") || toks[1].Kind != parser.String {
+		return nil, false
+	}
+	var strs []string
+	for _, tok := range toks[2:] {
+		if tok.Kind == parser.String {
+			strs = append(strs, tok.Val)
+		}
+	}
+	if len(strs) == 0 {
+		return errors.New(toks[1].Val), true
+	}
+	e := sql.NewPGError(strs[0], "%s", toks[1].Val)
+	if len(strs) > 1 {
+		e.Detail = strs[1]
+	}
+	if len(strs) > 2 {
+		e.Hint = strs[2]
+	}
+	return e, true
+}
+
+// raisedNotice returns the notice of a "RAISE level 'message'" statement,
+// where level is one of DEBUG, LOG, INFO, NOTICE or WARNING.
+func raisedNotice(stmt string) (error, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) < 3 || !toks[0].Is("raise") || toks[1].Kind != parser.Ident || toks[2].Kind != parser.String {
+		return nil, false
+	}
+	severity := sql.Severity(strings.ToUpper(toks[1].Val))
+	switch severity {
+	case sql.SeverityDebug, sql.SeverityLog, sql.SeverityInfo, sql.SeverityNotice, sql.SeverityWarning:
+		return &sql.PGError{Severity: severity, Message: toks[2].Val}, true
+	}
+	return nil, false
+}
+
+func (e *FakeExecutor) Tables(ctx context.Context) []executor.Table {
+	return []executor.Table{{Name: "users", Columns: makeFakeColumns()}}
+}
+
 func makeResultColumn(name string, typ parser.Datum) executor.ResultColumn {
 	return executor.ResultColumn{
 		Name: name,
@@ -44,6 +187,10 @@ func makeFakeColumns() []executor.ResultColumn {
 	return cols
 }
 
+func makeSleepColumns() []executor.ResultColumn {
+	return []executor.ResultColumn{makeResultColumn("pg_sleep", parser.DummyString)}
+}
+
 func makeFakeRows() []executor.ResultRow {
 	rows := make([]executor.ResultRow, 3)
 	rows[0] = executor.ResultRow{
@@ -51,6 +51,11 @@ type Result struct {
 									  // the result set of the result.
 									  // TODO: streaming?
 	Rows []ResultRow
+
+									  // Notices are sent to the client ahead of the result, if the session's
+									  // client_min_messages allows. They are usually *sql.PGError values with
+									  // a Severity of NOTICE or WARNING; other errors are sent as NOTICEs.
+	Notices []error
 }
 
 // ResultColumn contains the name and type of a SQL column
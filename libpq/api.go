@@ -2,17 +2,24 @@ package libpq
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/lib/pq/oid"
 	"github.com/yydzero/mnt/executor"
 	"github.com/yydzero/mnt/parser"
 	"github.com/yydzero/mnt/sql"
+	"github.com/yydzero/mnt/util/datetime"
+	"github.com/yydzero/mnt/util/duration"
+	"github.com/yydzero/mnt/util/encoding"
 	_ "github.com/yydzero/mnt/util/reflect"
 	"golang.org/x/net/context"
-	"log"
+	"io"
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ClientMessageType byte
@@ -46,6 +53,7 @@ const (
 	ServerMsgErrorResponse        ServerMessageType = 'E'
 	ServerMsgFuncCallResponse     ServerMessageType = 'V'
 	ServerMsgKeyData              ServerMessageType = 'K'
+	ServerMsgNegotiateProtocol    ServerMessageType = 'v'
 	ServerMsgNoData               ServerMessageType = 'n'
 	ServerMsgNoticeResponse       ServerMessageType = 'N'
 	ServerMsgNotificationResponse ServerMessageType = 'A'
@@ -67,7 +75,8 @@ const (
 )
 
 const (
-	AuthOK int32 = 0
+	AuthOK                int32 = 0
+	AuthCleartextPassword int32 = 3
 )
 
 // preparedStatement is a SQL statement which has been parsed, analyzed and rewritten.
@@ -77,22 +86,65 @@ type preparedStatement struct {
 	query    string
 	argTypes []oid.Oid
 	columns  []executor.ResultColumn
+
+	// handle is the executor's statement, or nil for statements handled by
+	// the session.
+	handle *statementHandle
+}
+
+// statementHandle counts the references to an executor's prepared statement
+// from the statement and the portals bound from it. It is closed once they
+// are all gone.
+type statementHandle struct {
+	stmt executor.PreparedStatement
+	refs int
+}
+
+func (h *statementHandle) acquire() {
+	if h != nil {
+		h.refs++
+	}
+}
+
+func (h *statementHandle) release() {
+	if h == nil {
+		return
+	}
+	h.refs--
+	if h.refs == 0 {
+		h.stmt.Close()
+	}
 }
 
 // portal represents SQL execution. preparedStatement could bind to portal.
 // cursor will also create portal.
 //
 // Start with: portal is a preparedStatement that has been bound with parameters
+//
+// Portals last until the end of the transaction they were bound in, or until
+// they or their statement are closed. The unnamed portal is also replaced by
+// the next Bind to it or a simple query.
 type portal struct {
-	name   string
-	stmt   preparedStatement
-	params []parser.Datum
-	format []formatCode // output format
+	stmtName string // The prepared statement it was bound from.
+	stmt     preparedStatement
+	params   []parser.Datum
+	format   []formatCode // output format
+
+	// suspended holds the rows left over when an Execute hit its row limit,
+	// to be sent by the next Execute.
+	suspended *executor.Result
+
+	// done is set once the statement has run to completion. Later Executes
+	// are answered with completion, a result like the last one sent but with
+	// no rows, rather than running the statement again.
+	done       bool
+	completion executor.Result
 }
 
 // TODO: session and executor
 type pqConn struct {
-	conn net.Conn
+	conn   net.Conn
+	server *Server
 
 	r        *bufio.Reader
 	w        *bufio.Writer
@@ -103,84 +155,266 @@ type pqConn struct {
 	session  *sql.Session
 	executor executor.Executor
 
+	// metrics counts the traffic of the connection's port, if the server
+	// has metrics.
+	metrics *portMetrics
+
+	// teardown is called on close, after the executor's statements have been
+	// closed.
+	teardown func()
+
 	preparedStatements map[string]preparedStatement
-	portals            map[string]portal
+	portals            map[string]*portal
+
+	// suspended is set by sendResponse when the row limit of an Execute
+	// leaves rows unsent, for handleExecute to keep in the portal.
+	suspended *executor.Result
+
+	// completed is set by sendResponse to the type and tag of the last
+	// result it completed, for handleExecute to answer Executes of an
+	// exhausted portal with.
+	completed executor.Result
+
+	// batch holds the Executes of a pipeline waiting to be run together, if
+	// the executor implements executor.BatchExecutor.
+	batch *batch
+
+	// reported holds the values of GUC_REPORT parameters last sent to the
+	// client in ParameterStatus messages.
+	reported map[string]string
 
 	extendedQueryMessage, ignoreTillSync bool
+
+	// hub delivers notifications to and from other connections, which
+	// identify this one by pid.
+	hub *notificationHub
+	pid int32
+
+	// functions can be called with the FunctionCall message.
+	functions *functionRegistry
+
+	// notifyMu guards the writer while the connection is idle, when
+	// notifyIdle writes the notifications other connections queue to it.
+	// Notifications arriving while it is busy wait for the next
+	// ReadyForQuery.
+	notifyMu   sync.Mutex
+	idle       bool
+	terminated bool
+
+	// queueMu guards notifications, which other connections append to
+	// without waiting for the writer.
+	queueMu       sync.Mutex
+	notifications []sql.Notification
+
+	// notifyPending wakes notifyIdle when a notification is queued. done is
+	// closed when the connection is.
+	notifyPending chan struct{}
+	done          chan struct{}
+
+	// readDeadline is set while an idle timeout limits the wait for the
+	// client's next command.
+	readDeadline bool
+
+	// ctx is the session's context. Shutdown cancels it once it runs out of
+	// time, to stop the statement in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func newPQConn(conn net.Conn, executor executor.Executor, sessionArgs sql.ConnectionArgs) pqConn {
-	return pqConn{
-		conn: conn,
-		r:    bufio.NewReader(conn),
-		w:    bufio.NewWriter(conn),
+func newPQConn(conn net.Conn, s *Server, sessionArgs sql.ConnectionArgs) *pqConn {
+	c := &pqConn{
+		conn:    conn,
+		server:  s,
+		w:       bufio.NewWriter(conn),
+		readBuf: readBuffer{maxSize: s.maxMessageSize},
 
-		executor: executor,
+		hub:       s.hub,
+		pid:       s.hub.newPID(),
+		functions: s.functions,
 
 		preparedStatements: make(map[string]preparedStatement),
-		portals:            make(map[string]portal),
+		portals:            make(map[string]*portal),
+		reported:           make(map[string]string),
 
-		session: sql.NewSession(sessionArgs, executor, conn.RemoteAddr()),
+		session: sql.NewSession(sessionArgs, conn.RemoteAddr()),
+
+		notifyPending: make(chan struct{}, 1),
+		done:          make(chan struct{}),
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.r = bufio.NewReader(busyReader{c})
+	return c
 }
 
 func (c *pqConn) close() {
+	c.hub.unlisten(c, "")
+	close(c.done)
+	c.cancel()
+
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
 	if err := c.w.Flush(); err != nil {
-		log.Println(err.Error())
+		c.server.logf("%v", err)
 	}
 
 	_ = c.conn.Close()
+
+	for name := range c.portals {
+		c.deletePortal(name)
+	}
+	for name := range c.preparedStatements {
+		c.deleteStatement(name)
+	}
+	if c.teardown != nil {
+		c.teardown()
+	}
+}
+
+// setStatement stores stmt under name, replacing any statement there.
+func (c *pqConn) setStatement(name string, stmt preparedStatement) {
+	c.deleteStatement(name)
+	stmt.handle.acquire()
+	c.preparedStatements[name] = stmt
+}
+
+func (c *pqConn) deleteStatement(name string) {
+	if stmt, ok := c.preparedStatements[name]; ok {
+		stmt.handle.release()
+		delete(c.preparedStatements, name)
+	}
+}
+
+// setPortal stores p under name, replacing any portal there.
+func (c *pqConn) setPortal(name string, p *portal) {
+	c.deletePortal(name)
+	p.stmt.handle.acquire()
+	c.portals[name] = p
+}
+
+func (c *pqConn) deletePortal(name string) {
+	if p, ok := c.portals[name]; ok {
+		p.stmt.handle.release()
+		delete(c.portals, name)
+	}
 }
 
-// parseOptions parse options from client
-func parseOptions(data []byte) (sql.ConnectionArgs, error) {
-	args := sql.ConnectionArgs{}
+// parseOptions parse options from client. Other than database, user and
+// replication, each is a run-time parameter for the session, as is each
+// "-c name=value" or "--name=value" in the options parameter. Protocol
+// options (those starting with "_pq_.") are not supported, and their names
+// are returned so that the client can be told.
+func parseOptions(data []byte) (sql.ConnectionArgs, []string, error) {
+	args := sql.ConnectionArgs{Vars: make(map[string]string)}
+	var protocolOptions []string
+	var cmdline string
 	buf := readBuffer{msg: data}
 
 	for {
 		key, err := buf.getString()
 		if err != nil {
-			return args, fmt.Errorf("error when reading option key: %s", err)
+			return args, nil, sql.NewPGError(sql.CodeProtocolViolationError, "error when reading option key: %s", err)
 		}
 		if len(key) == 0 {
 			break
 		}
 		value, err := buf.getString()
 		if err != nil {
-			return args, fmt.Errorf("error when reading option value: %s", err)
+			return args, nil, sql.NewPGError(sql.CodeProtocolViolationError, "error when reading option value: %s", err)
 		}
 
-		switch key {
+		if strings.HasPrefix(key, "_pq_.") {
+			protocolOptions = append(protocolOptions, key)
+			continue
+		}
+
+		// Parameter names are case insensitive, eg: JDBC sends "DateStyle".
+		switch strings.ToLower(key) {
 		case "database":
 			args.Database = value
 		case "user":
 			args.User = value
-		case "client_encoding":
-			args.ClientEncoding = value
-		case "datestyle":
-			args.DateStyle = value
+		case "options":
+			cmdline = value
+		case "replication":
+			args.Replication = value
 		default:
-			log.Printf("unrecognized connection parameter %q", key)
+			args.Vars[strings.ToLower(key)] = value
 		}
 	}
 
-	//r.PrintVarInJson(args)
+	// Parameters in the startup packet take precedence over options.
+	opts, err := parseCommandLine(splitOptions(cmdline))
+	if err != nil {
+		return args, nil, err
+	}
+	for name, value := range opts {
+		if _, ok := args.Vars[name]; !ok {
+			args.Vars[name] = value
+		}
+	}
 
-	return args, nil
+	return args, protocolOptions, nil
 }
 
-// serve serves a session/connection.
-// main loop
-func (c *pqConn) serve(authenticationHook func(string, bool) error) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// splitOptions splits the options startup parameter on white space. A
+// backslash escapes the character after it, so that values can contain
+// spaces.
+func splitOptions(s string) []string {
+	var args []string
+	var arg []byte
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = arg[:0], false
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			arg, inArg = append(arg, s[i]), true
+		default:
+			arg, inArg = append(arg, c), true
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args
+}
 
-	if authenticationHook != nil {
-		// TODO: c.session.User
-		if err := authenticationHook("", true); err != nil {
-			return c.sendInternalError(err.Error())
+// parseCommandLine reads the "-c name=value" and "--name=value" arguments
+// of the options parameter. As on the postgres command line, dashes in names
+// stand for underscores.
+func parseCommandLine(args []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		var opt string
+		switch arg := args[i]; {
+		case arg == "-c" && i+1 < len(args):
+			i++
+			opt = args[i]
+		case strings.HasPrefix(arg, "-c") && len(arg) > 2:
+			opt = arg[2:]
+		case strings.HasPrefix(arg, "--") && len(arg) > 2:
+			opt = arg[2:]
+		default:
+			return nil, sql.NewPGError(sql.CodeSyntaxError, "invalid command-line argument for server process: %s", arg)
+		}
+		eq := strings.IndexByte(opt, '=')
+		if eq <= 0 {
+			return nil, sql.NewPGError(sql.CodeSyntaxError, "-c %s requires a value", opt)
 		}
+		name := strings.ToLower(strings.Replace(opt[:eq], "-", "_", -1))
+		vars[name] = opt[eq+1:]
 	}
+	return vars, nil
+}
+
+// serve serves a session/connection.
+// main loop
+func (c *pqConn) serve() error {
+	ctx := sql.NewContext(c.ctx, c.session)
 
 	// Server response with AuthMessage
 	c.writeBuf.initMsg(ServerMsgAuth)
@@ -189,64 +423,63 @@ func (c *pqConn) serve(authenticationHook func(string, bool) error) error {
 		return err
 	}
 
-	// Server response with client_encoding/DateStyle/server_version parameters
-	for key, value := range map[string]string{
-		"client_encoding": "UTF8",
-		"datestyle":       "ISO",
-		"server_version":  "9.5.0",
-	} {
-		c.writeBuf.initMsg(ServerMsgParameterStatus)
-		for _, str := range [...]string{key, value} {
-			if err := c.writeBuf.writeString(str); err != nil {
-				return err
-			}
-		}
-		if err := c.writeBuf.finishMsg(c.w); err != nil {
-			return err
-		}
+	// Server response with client_encoding/DateStyle/server_version etc parameters
+	c.applySettings()
+	if err := c.sendParameterChanges(); err != nil {
+		return err
 	}
 	if err := c.w.Flush(); err != nil {
 		return err
 	}
 
-	log.Printf("Now ready to goto main loop\n")
+	c.server.logf("Now ready to goto main loop")
+	go c.notifyIdle()
 
 	// Main loop to handle client requests
 	for {
+		// idleErr terminates the session if the client's next command does
+		// not arrive in time.
+		var idleErr *sql.PGError
 		if !c.extendedQueryMessage {
-			// Non extended query protocol
-			c.writeBuf.initMsg(ServerMsgReady)
-			var txnStatus byte
-			switch c.session.TxnState.State {
-			case sql.Aborted:
-				txnStatus = 'E'
-			case sql.Open:
-				txnStatus = 'T'
-			case sql.Idle:
-				txnStatus = 'I'
-			default:
-				return fmt.Errorf("Wrong txn status: %v", c.session.TxnState.State)
+			// A server shutting down terminates sessions once they are idle.
+			if c.server.shuttingDown() {
+				return c.sendAdminShutdown()
 			}
 
-			c.writeBuf.WriteByte(txnStatus)
-			if err := c.writeBuf.finishMsg(c.w); err != nil {
+			// Non extended query protocol
+			if err := c.sendReadyForQuery(); err != nil {
 				return err
 			}
-
-			// We only flush on every message if not doing an extended query.
-			// If we are, wait for an explicit Flush message. See:
-			// http://www.postgresql.org/docs/current/static/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY.
-			if err := c.w.Flush(); err != nil {
+			var err error
+			if idleErr, err = c.setIdleDeadline(); err != nil {
 				return err
 			}
+		} else if err := c.clearReadDeadline(); err != nil {
+			return err
 		}
 
 		typ, len, err := c.readBuf.readTypedMsg(c.r)
 		if err != nil {
+			if c.ctx.Err() != nil {
+				return c.sendAdminShutdown()
+			}
+			if idleErr != nil && isTimeout(err) {
+				return c.terminateIdleSession(idleErr)
+			}
 			return err
 		}
+		c.setIdle(false)
+		c.metrics.message(typ)
+
+		c.server.logf("Message: Type=%c, Len=%d, Content=%q", typ, len, string(c.readBuf.msg))
 
-		log.Printf("Message: Type=%c, Len=%d, Content=%q\n", typ, len, string(c.readBuf.msg))
+		// A batch runs once anything but its Binds and Executes arrives. It may
+		// fail, and then the message is ignored like any other up to Sync.
+		if c.batch != nil && typ != ClientMsgBind && typ != ClientMsgExecute {
+			if err := c.runBatch(); err != nil {
+				return err
+			}
+		}
 
 		// When an error occurs handling an extended query message, we have to ignore
 		// any messages until get a sync.
@@ -259,6 +492,10 @@ func (c *pqConn) serve(authenticationHook func(string, bool) error) error {
 		case ClientMsgSync:
 			c.extendedQueryMessage = false
 			c.ignoreTillSync = false
+			// Sync ends the implicit transaction of a pipeline, and with it
+			// its portals.
+			err = c.endImplicitTransaction(ctx)
+			c.closeTransactionPortals()
 
 		case ClientMsgSimpleQuery:
 			c.extendedQueryMessage = false
@@ -271,6 +508,10 @@ func (c *pqConn) serve(authenticationHook func(string, bool) error) error {
 		case ClientMsgTerminate:
 			return nil
 
+		case ClientMsgFuncCall:
+			c.extendedQueryMessage = false
+			err = c.handleFunctionCall(ctx, &c.readBuf)
+
 		case ClientMsgParse:
 			c.extendedQueryMessage = true
 			err = c.handleParse(ctx, &c.readBuf)
@@ -302,16 +543,211 @@ func (c *pqConn) serve(authenticationHook func(string, bool) error) error {
 		if err != nil {
 			return err
 		}
+		if c.ctx.Err() != nil {
+			return c.sendAdminShutdown()
+		}
+	}
+}
+
+// sendReadyForQuery sends any queued notifications and parameter changes,
+// then ReadyForQuery, and marks the connection idle.
+func (c *pqConn) sendReadyForQuery() error {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+
+	if err := c.sendNotifications(); err != nil {
+		return err
+	}
+	if err := c.sendParameterChanges(); err != nil {
+		return err
+	}
+
+	c.writeBuf.initMsg(ServerMsgReady)
+	var txnStatus byte
+	switch c.session.TxnState.State {
+	case sql.Aborted:
+		txnStatus = 'E'
+	case sql.Open:
+		txnStatus = 'T'
+	case sql.Idle:
+		txnStatus = 'I'
+	default:
+		return fmt.Errorf("Wrong txn status: %v", c.session.TxnState.State)
+	}
+
+	c.writeBuf.WriteByte(txnStatus)
+	if err := c.writeBuf.finishMsg(c.w); err != nil {
+		return err
+	}
+
+	// We only flush on every message if not doing an extended query.
+	// If we are, wait for an explicit Flush message. See:
+	// http://www.postgresql.org/docs/current/static/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY.
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	// A client which sent its next command with the last one is not idle,
+	// as reading it will not touch the connection.
+	c.idle = c.r.Buffered() == 0
+	return nil
+}
+
+func (c *pqConn) setIdle(idle bool) {
+	c.notifyMu.Lock()
+	c.idle = idle
+	c.notifyMu.Unlock()
+}
+
+// busyReader reads from the connection of a pqConn, marking it busy as
+// soon as input arrives, so that Shutdown does not terminate a session
+// whose next command has been read. Input which arrives once it has been
+// terminated is dropped.
+type busyReader struct {
+	c *pqConn
+}
+
+func (r busyReader) Read(b []byte) (int, error) {
+	n, err := r.c.conn.Read(b)
+	if n > 0 {
+		r.c.notifyMu.Lock()
+		defer r.c.notifyMu.Unlock()
+		if r.c.terminated {
+			return 0, io.EOF
+		}
+		r.c.idle = false
+	}
+	return n, err
+}
+
+// sendParameterChanges sends a ParameterStatus message for each GUC_REPORT
+// parameter whose value differs from the one the client last saw.
+func (c *pqConn) sendParameterChanges() error {
+	for _, setting := range c.session.ReportedSettings() {
+		if value, ok := c.reported[setting.Name]; ok && value == setting.Value {
+			continue
+		}
+		c.writeBuf.initMsg(ServerMsgParameterStatus)
+		for _, str := range [...]string{setting.Name, setting.Value} {
+			if err := c.writeBuf.writeClientString(str); err != nil {
+				return err
+			}
+		}
+		if err := c.writeBuf.finishMsg(c.w); err != nil {
+			return err
+		}
+		c.reported[setting.Name] = setting.Value
 	}
+	return nil
+}
+
+// applySettings switches text conversion to the current values of the
+// session's client_encoding, DateStyle, IntervalStyle and TimeZone.
+func (c *pqConn) applySettings() {
+	name, _ := c.session.GetVar("client_encoding")
+	if c.writeBuf.encoding == nil || c.writeBuf.encoding.Name != name {
+		e, err := encoding.Lookup(name)
+		if err != nil {
+			e = encoding.UTF8
+		}
+		c.writeBuf.encoding = e
+	}
+
+	// The values were validated when they were set, so errors only mean the
+	// defaults are kept.
+	f := &c.writeBuf.format
+	if v, err := c.session.GetVar("DateStyle"); err == nil {
+		f.dateStyle, _ = datetime.ParseDateStyle(v, datetime.DefaultDateStyle)
+	}
+	if v, err := c.session.GetVar("IntervalStyle"); err == nil {
+		f.intervalStyle, _ = duration.ParseStyle(v)
+	}
+	if v, err := c.session.GetVar("TimeZone"); err == nil {
+		if loc, err := datetime.LoadLocation(v); err == nil {
+			f.location = loc
+		}
+	}
+}
+
+// decodeClientText converts text received from the client to UTF8. An error
+// response is sent if it is not valid in the client encoding.
+func (c *pqConn) decodeClientText(b []byte) (string, bool, error) {
+	s, err := c.writeBuf.encoding.Decode(b)
+	if err == nil {
+		return s, true, nil
+	}
+	return "", false, c.sendPGError(err)
+}
+
+// getQuery reads a null-terminated query string in the client encoding.
+func (c *pqConn) getQuery(buf *readBuffer) (string, bool, error) {
+	pos := bytes.IndexByte(buf.msg, 0)
+	if pos == -1 {
+		return "", false, fmt.Errorf("NUL terminator not found")
+	}
+	b := buf.msg[:pos]
+	buf.msg = buf.msg[pos+1:]
+	return c.decodeClientText(b)
 }
 
 func (c *pqConn) handleSimpleQuery(ctx context.Context, buf *readBuffer) error {
-	query, err := buf.getString()
-	if err != nil {
+	query, ok, err := c.getQuery(buf)
+	if !ok {
+		return err
+	}
+
+	// A simple query replaces the unnamed statement and portal.
+	c.deleteStatement("")
+	c.deletePortal("")
+
+	if err := c.executeStatements(ctx, query, nil, nil, nil, true, 0); err != nil {
 		return err
 	}
+	err = c.endImplicitTransaction(ctx)
+	c.closeTransactionPortals()
+	return err
+}
+
+// beginImplicitTransaction starts an implicit transaction for a statement
+// run outside of a transaction block, unless one is in progress.
+func (c *pqConn) beginImplicitTransaction(ctx context.Context) error {
+	if !c.session.BeginImplicit() {
+		return nil
+	}
+	if t, ok := c.executor.(executor.ImplicitTransactor); ok {
+		return t.BeginImplicit(ctx)
+	}
+	return nil
+}
+
+// endImplicitTransaction commits the implicit transaction, or rolls it back
+// if a statement in it failed. The notifications of what committed are then
+// delivered.
+func (c *pqConn) endImplicitTransaction(ctx context.Context) error {
+	if c.session.TxnState.Implicit {
+		commit := !c.session.TxnState.ImplicitFailed
+		if t, ok := c.executor.(executor.ImplicitTransactor); ok {
+			if err := t.EndImplicit(ctx, commit); err != nil {
+				commit = false
+				if err := c.sendPGError(err); err != nil {
+					return err
+				}
+			}
+		}
+		c.session.EndImplicit(commit)
+	}
+	c.deliverNotifications()
+	return nil
+}
 
-	return c.executeStatements(ctx, query, nil, nil, true, 0)
+// closeTransactionPortals closes all portals once the transaction they were
+// bound in has ended.
+func (c *pqConn) closeTransactionPortals() {
+	if c.session.TxnState.State != sql.Idle {
+		return
+	}
+	for name := range c.portals {
+		c.deletePortal(name)
+	}
 }
 
 // handleMPPQuery act as GPDB QE and process request received from QD.
@@ -321,15 +757,18 @@ func (c *pqConn) handleSimpleQuery(ctx context.Context, buf *readBuffer) error {
 //	siceIndex
 //
 func (c *pqConn) handleMPPQuery(ctx context.Context, buf *readBuffer) error {
-	query, err := buf.getString()
-	if err != nil {
+	query, ok, err := c.getQuery(buf)
+	if !ok {
 		return err
 	}
 
 	//c.sendInternalError(fmt.Sprintf("fake error"))
 	//return nil
 
-	return c.executeStatements(ctx, query, nil, nil, true, 0)
+	if err := c.executeStatements(ctx, query, nil, nil, nil, true, 0); err != nil {
+		return err
+	}
+	return c.endImplicitTransaction(ctx)
 }
 
 // handleParse parses prepared statement, eg:
@@ -344,13 +783,13 @@ func (c *pqConn) handleParse(ctx context.Context, buf *readBuffer) error {
 	// Unnamed prepared statement can be overritten.
 	if name != "" {
 		if _, ok := c.preparedStatements[name]; ok {
-			return c.sendInternalError(fmt.Sprintf("prepared statement %q already exists", name))
+			return c.sendError(sql.CodeDuplicatePreparedStatementError, fmt.Sprintf("prepared statement %q already exists", name))
 		}
 	}
 
 	// Query for prepared statement
-	query, err := buf.getString()
-	if err != nil {
+	query, ok, err := c.getQuery(buf)
+	if !ok {
 		return err
 	}
 
@@ -390,58 +829,80 @@ func (c *pqConn) handleParse(ctx context.Context, buf *readBuffer) error {
 	// parse_analyze_varparams(raw_parse_tree,  query_string, &paramTypes, &numParams)
 	// is used to get numParams and paramTypes in query.
 
-	cols, args, err := c.executor.Prepare(ctx, query, args)
-	if err != nil {
-		return c.sendInternalError(err.Error())
+	// SET, SHOW, RESET, LISTEN and NOTIFY are handled by the session, not
+	// the executor.
+	pq := preparedStatement{query: query}
+	cols, ok := c.session.DescribeSessionStatement(query)
+	if !ok {
+		cols, ok = c.session.DescribeNotifyStatement(query, args)
 	}
+	if !ok {
+		start := time.Now()
+		stmt, err := c.executor.Prepare(ctx, query, args)
+		c.metrics.observe("prepare", time.Since(start))
+		if err != nil {
+			return c.sendPGError(err)
+		}
+		cols, args = stmt.Columns(), stmt.Args()
+		pq.handle = &statementHandle{stmt: stmt}
+	}
+	pq.columns = cols
 
-	pq := preparedStatement{
-		query:    query,
-		argTypes: make([]oid.Oid, 0, len(args)),
-		columns:  cols,
+	pq.argTypes, err = argTypes(args, inTypeHints)
+	if err != nil {
+		if pq.handle != nil {
+			pq.handle.stmt.Close()
+		}
+		return c.sendPGError(err)
 	}
 
+	c.setStatement(name, pq)
+	c.writeBuf.initMsg(ServerMsgParseComplete)
+	return c.writeBuf.finishMsg(c.w)
+}
+
+// argTypes returns the OIDs of the parameter types in args, taking those
+// the client specified from hints.
+func argTypes(args parser.MapArgs, hints []oid.Oid) ([]oid.Oid, error) {
+	types := make([]oid.Oid, 0, len(args))
 	for k, v := range args {
 		i, err := strconv.Atoi(k)
 		if err != nil {
-			return c.sendInternalError(fmt.Sprintf("non-integer parameter: %s", k))
+			return nil, sql.NewPGError(sql.CodeInternalError, "non-integer parameter: %s", k)
 		}
 
-		// ValArgs are 1-indexed, pq.inTypes are 0-index.
+		// ValArgs are 1-indexed, types are 0-index.
 		i--
 		if i < 0 {
-			return c.sendInternalError(fmt.Sprintf("there is no paramter $%s", k))
+			return nil, sql.NewPGError(sql.CodeInternalError, "there is no paramter $%s", k)
 		}
 
-		// Grow pq.inTypes to be at least as large as i
-		for j := len(pq.argTypes); j <= i; j++ {
-			pq.argTypes = append(pq.argTypes, 0)
-			if j < len(inTypeHints) {
-				pq.argTypes[j] = inTypeHints[j]
+		// Grow types to be at least as large as i
+		for j := len(types); j <= i; j++ {
+			types = append(types, 0)
+			if j < len(hints) {
+				types[j] = hints[j]
 			}
 		}
 
 		// OID to Datum is not a 1-1 mapping (eg: int4 and int8 both map to DummInt),
 		// so we need to maintain the types sent by the client.
-		if pq.argTypes[i] != 0 {
+		if types[i] != 0 {
 			continue
 		}
 		id, ok := datumToOid[reflect.TypeOf(v)]
 		if !ok {
-			return c.sendInternalError(fmt.Sprintf("unknown datum type: %s", v.Type()))
+			return nil, sql.NewPGError(sql.CodeInternalError, "unknown datum type: %s", v.Type())
 		}
-		pq.argTypes[i] = id
+		types[i] = id
 	}
 
-	for i := range pq.argTypes {
-		if pq.argTypes[i] == 0 {
-			return c.sendInternalError(fmt.Sprintf("could not determine data type of parameter $%d", i+1))
+	for i := range types {
+		if types[i] == 0 {
+			return nil, sql.NewPGError(sql.CodeInternalError, "could not determine data type of parameter $%d", i+1)
 		}
 	}
-
-	c.preparedStatements[name] = pq
-	c.writeBuf.initMsg(ServerMsgParseComplete)
-	return c.writeBuf.finishMsg(c.w)
+	return types, nil
 }
 
 func (c *pqConn) handleDescribe(buf *readBuffer) error {
@@ -459,7 +920,7 @@ func (c *pqConn) handleDescribe(buf *readBuffer) error {
 	case PrepareStatement:
 		stmt, ok := c.preparedStatements[name]
 		if !ok {
-			return c.sendInternalError(fmt.Sprintf("unknown prepared statement %q", name))
+			return c.sendError(sql.CodeInvalidSQLStatementNameError, fmt.Sprintf("unknown prepared statement %q", name))
 		}
 
 		c.writeBuf.initMsg(ServerMsgParameterDescription)
@@ -476,15 +937,11 @@ func (c *pqConn) handleDescribe(buf *readBuffer) error {
 	case PreparePortal:
 		p, ok := c.portals[name]
 		if !ok {
-			return c.sendInternalError(fmt.Sprintf("unknow portal %q", name))
+			return c.sendError(sql.CodeInvalidCursorNameError, fmt.Sprintf("unknown portal %q", name))
 		}
 
-		stmt, ok := c.preparedStatements[p.name]
-		if !ok {
-			return c.sendInternalError(fmt.Sprintf("unknown prepared statement %q", name))
-		}
-
-		return c.sendRowDescription(stmt.columns, p.format)
+		// The portal keeps its statement even if that has been replaced.
+		return c.sendRowDescription(p.stmt.columns, p.format)
 	default:
 		return fmt.Errorf("unknown describe type: %s", typ)
 	}
@@ -502,22 +959,26 @@ func (c *pqConn) handleClose(buf *readBuffer) error {
 		return err
 	}
 
+	// Closing something which does not exist is not an error.
 	switch typ {
 	case PrepareStatement:
 		if _, ok := c.preparedStatements[name]; ok {
-			// delete corresponding portals???
+			// The portals bound from the statement go with it.
+			for portalName, p := range c.portals {
+				if p.stmtName == name {
+					c.deletePortal(portalName)
+				}
+			}
 		}
-		delete(c.preparedStatements, name)
+		c.deleteStatement(name)
 	case PreparePortal:
-		if _, ok := c.portals[name]; ok {
-			// delete corresponding port from stmt.portNames?
-			// what is this?
-		}
-		delete(c.portals, name)
+		c.deletePortal(name)
 	default:
-		return fmt.Errorf("unknown close type: %s", typ)
+		return c.sendError(sql.CodeProtocolViolationError, fmt.Sprintf("unknown close type: %s", typ))
 	}
-	return nil
+
+	c.writeBuf.initMsg(ServerMsgCloseComplete)
+	return c.writeBuf.finishMsg(c.w)
 }
 
 func (c *pqConn) handleBind(buf *readBuffer) error {
@@ -529,7 +990,7 @@ func (c *pqConn) handleBind(buf *readBuffer) error {
 	// Unnamed portal can be freely overwritten.
 	if portalName != "" {
 		if _, ok := c.portals[portalName]; ok {
-			return c.sendInternalError(fmt.Sprintf("portal %q already exists", portalName))
+			return c.sendError(sql.CodeDuplicateCursorError, fmt.Sprintf("portal %q already exists", portalName))
 		}
 	}
 
@@ -540,7 +1001,12 @@ func (c *pqConn) handleBind(buf *readBuffer) error {
 
 	stmt, ok := c.preparedStatements[statementName]
 	if !ok {
-		return c.sendInternalError(fmt.Sprintf("unknown prepared statement %q", statementName))
+		return c.sendError(sql.CodeInvalidSQLStatementNameError, fmt.Sprintf("unknown prepared statement %q", statementName))
+	}
+	if c.batch != nil && c.batch.stmtName != statementName {
+		if err := c.runBatch(); err != nil || c.ignoreTillSync {
+			return err
+		}
 	}
 
 	numParams := int16(len(stmt.argTypes))
@@ -597,15 +1063,23 @@ func (c *pqConn) handleBind(buf *readBuffer) error {
 			return err
 		}
 		if plen == -1 {
+			params[i] = parser.DNull
 			continue
 		}
 		b, err := buf.getBytes(int(plen))
 		if err != nil {
 			return err
 		}
-		d, err := decodeOidDatum(t, paramFormatCodes[i], b)
+		if paramFormatCodes[i] == formatText {
+			s, ok, err := c.decodeClientText(b)
+			if !ok {
+				return err
+			}
+			b = []byte(s)
+		}
+		d, err := decodeOidDatum(t, paramFormatCodes[i], b, c.writeBuf.format)
 		if err != nil {
-			return c.sendInternalError(fmt.Sprintf("param $%d: %s", i+1, err))
+			return c.sendError(sql.ErrorCode(err), fmt.Sprintf("param $%d: %s", i+1, err))
 		}
 		params[i] = d
 	}
@@ -649,16 +1123,18 @@ func (c *pqConn) handleBind(buf *readBuffer) error {
 		return c.sendInternalError(fmt.Sprintf("expected, 0, 1, or %d for number of format codes, got %d", numColumns, numColumnFormatCodes))
 	}
 
-	// BindMessage bind portal with prepared statement???
-	// statement contains portal names map.  Usage???
-	// portals map contains name -> portal map.
-	c.portals[portalName] = portal{
-		name:   statementName,
-		stmt:   stmt,
-		params: params,
-		format: columnFormatCodes,
+	c.setPortal(portalName, &portal{
+		stmtName: statementName,
+		stmt:     stmt,
+		params:   params,
+		format:   columnFormatCodes,
+	})
+
+	if c.batch != nil {
+		// Sent after the responses of the batched Executes before it.
+		c.batch.binds++
+		return nil
 	}
-
 	c.writeBuf.initMsg(ServerMsgBindComplete)
 	return c.writeBuf.finishMsg(c.w)
 }
@@ -669,33 +1145,132 @@ func (c *pqConn) handleExecute(ctx context.Context, buf *readBuffer) error {
 		return err
 	}
 
-	portal, ok := c.portals[portalName]
+	p, ok := c.portals[portalName]
 	if !ok {
-		return c.sendInternalError(fmt.Sprintf("unknown portal %q", portalName))
+		return c.sendError(sql.CodeInvalidCursorNameError, fmt.Sprintf("unknown portal %q", portalName))
 	}
 	limit, err := buf.getInt32()
 	if err != nil {
 		return err
 	}
 
-	return c.executeStatements(ctx, portal.stmt.query, portal.params, portal.format, false, limit)
+	if c.canBatch(p, limit) {
+		return c.addToBatch(ctx, p)
+	}
+	if c.batch != nil {
+		if err := c.runBatch(); err != nil || c.ignoreTillSync {
+			return err
+		}
+	}
+
+	if p.done {
+		// An exhausted portal has no more rows, and its statement is not run
+		// again.
+		if err := c.session.CheckAborted(p.stmt.query); err != nil {
+			return c.sendPGError(err)
+		}
+		_, err = c.sendResponse(executor.ResultList{p.completion}, p.format, false, limit)
+		return err
+	}
+
+	c.suspended, c.completed = nil, executor.Result{}
+	if p.suspended != nil {
+		// Carry on from where the last Execute stopped.
+		result := *p.suspended
+		_, err = c.sendResponse(executor.ResultList{result}, p.format, false, limit)
+	} else {
+		err = c.executeStatements(ctx, p.stmt.query, p.stmt.handle, p.params, p.format, false, limit)
+	}
+	p.suspended, c.suspended = c.suspended, nil
+	if err == nil && p.suspended == nil && !c.ignoreTillSync {
+		p.done, p.completion = true, c.completed
+	}
+	return err
 }
 
+// executeStatements runs each statement of query in turn. Statements which
+// only touch session state are handled here, the rest by the executor. If
+// the executor prepared query, it is run as the one statement handle.
 func (c *pqConn) executeStatements(
 	ctx context.Context,
-	stmts string,
+	query string,
+	handle *statementHandle,
 	params []parser.Datum,
 	formatCodes []formatCode,
 	sendDescription bool,
 	limit int32,
 ) error {
-	results := c.executor.ExecuteStatements(ctx, stmts, params)
-	if results.Empty {
+	stmts := parser.Split(query)
+	if handle != nil {
+		stmts = []string{query}
+	}
+
+	empty := true
+	for _, stmt := range stmts {
+		// Only the end of an aborted transaction is accepted.
+		if err := c.session.CheckAborted(stmt); err != nil {
+			return c.sendPGError(err)
+		}
+		if err := c.beginImplicitTransaction(ctx); err != nil {
+			return c.sendPGError(err)
+		}
+		if len(stmts) > 1 && c.session.TxnState.Implicit {
+			c.session.TxnState.ImplicitBlock = true
+		}
+
+		var results executor.ResultList
+		if result, ok := c.session.ExecSessionStatement(stmt); ok {
+			results = executor.ResultList{result}
+		} else if result, ok := c.session.ExecNotifyStatement(stmt, params); ok {
+			results = executor.ResultList{result}
+		} else {
+			stmtCtx, cancel := c.statementContext(ctx)
+			start := time.Now()
+			var r executor.StatementResults
+			if handle != nil {
+				r = c.executor.Execute(stmtCtx, handle.stmt, params)
+			} else {
+				r = c.executor.ExecuteStatements(stmtCtx, stmt, params)
+			}
+			c.metrics.observe("execute", time.Since(start))
+			statementTimedOut(stmtCtx, r.ResultList)
+			cancel()
+			results = r.ResultList
+			if !failed(results) {
+				c.session.TrackTransaction(stmt)
+			}
+		}
+		if len(results) == 0 {
+			continue
+		}
+		empty = false
+
+		// Each statement's response is sent before the next one runs, so
+		// that a change of client_encoding or DateStyle applies from the next
+		// statement on. A failed statement ends the batch.
+		ok, err := c.sendResponse(results, formatCodes, sendDescription, limit)
+		if err != nil || !ok {
+			return err
+		}
+		c.applySettings()
+	}
+
+	if empty {
 		// Skip executor and just send EmptyQueryResponse
 		c.writeBuf.initMsg(ServerMsgEmptyQuery)
 		return c.writeBuf.finishMsg(c.w)
 	}
-	return c.sendResponse(results.ResultList, formatCodes, sendDescription, limit)
+	return nil
+}
+
+// failed reports whether any of the results is an error.
+func failed(results executor.ResultList) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *pqConn) sendCommandComplete(tag []byte) error {
@@ -705,27 +1280,28 @@ func (c *pqConn) sendCommandComplete(tag []byte) error {
 	return c.writeBuf.finishMsg(c.w)
 }
 
-func (c *pqConn) sendResponse(results executor.ResultList, formatCodes []formatCode, sendDescription bool, limit int32) error {
+// sendResponse sends the results of a statement. It returns false if one of
+// the results failed, in which case an ErrorResponse has been sent in place
+// of it and the results following it.
+func (c *pqConn) sendResponse(results executor.ResultList, formatCodes []formatCode, sendDescription bool, limit int32) (bool, error) {
 	if len(results) == 0 {
-		return c.sendCommandComplete(nil)
+		return true, c.sendCommandComplete(nil)
 	}
 
 	for _, result := range results {
-		// Handle result error?
-		if limit != 0 && len(result.Rows) > int(limit) {
-			if err := c.sendInternalError(fmt.Sprintf("execute row count limits not supported: %d of %d", limit, len(result.Rows))); err != nil {
-				return err
-			}
-			break
+		if err := c.sendNotices(result.Notices); err != nil {
+			return false, err
 		}
-
+		if result.Err != nil {
+			return false, c.sendPGError(result.Err)
+		}
+		tag := append(c.tagBuf[:0], result.PGTag...)
 		if result.PGTag == "INSERT" {
 			// From the postgres docs (49.5. Message Formats):
 			// `INSERT oid rows`... oid is the object ID of the inserted row if
 			//	rows is 1 and the target table has OIDs; otherwise oid is 0.
-			result.PGTag = "INSERT 0"
+			tag = append(tag, " 0"...)
 		}
-		tag := append(c.tagBuf[:0], result.PGTag...)
 
 		switch result.Type {
 		case executor.RowsAffected:
@@ -733,17 +1309,28 @@ func (c *pqConn) sendResponse(results executor.ResultList, formatCodes []formatC
 			tag = append(tag, ' ')
 			tag = strconv.AppendInt(tag, int64(result.RowsAffected), 10)
 			if err := c.sendCommandComplete(tag); err != nil {
-				return err
+				return false, err
 			}
 		case executor.Rows:
 			if sendDescription {
 				if err := c.sendRowDescription(result.Columns, formatCodes); err != nil {
-					return err
+					return false, err
 				}
 			}
 
+			// An Execute with a row limit sends that many rows, then
+			// PortalSuspended in place of CommandComplete. The rest are sent
+			// by the next Execute of the portal.
+			rows := result.Rows
+			if limit > 0 && len(rows) > int(limit) {
+				rest := result
+				rest.Rows, rest.Notices = rows[limit:], nil
+				c.suspended = &rest
+				rows = rows[:limit]
+			}
+
 			// Send DataRows
-			for _, row := range result.Rows {
+			for _, row := range rows {
 				c.writeBuf.initMsg(ServerMsgDataRow)
 				c.writeBuf.putInt16(int16(len(row.Values)))
 
@@ -756,37 +1343,70 @@ func (c *pqConn) sendResponse(results executor.ResultList, formatCodes []formatC
 					switch fmtCode {
 					case formatText:
 						if err := c.writeBuf.writeTextDatum(col); err != nil {
-							return err
+							if _, ok := err.(*encoding.UntranslatableError); ok {
+								return false, c.sendPGError(err)
+							}
+							return false, err
 						}
 					case formatBinary:
 						if err := c.writeBuf.writeBinaryDatum(col); err != nil {
-							return err
+							return false, err
 						}
 					default:
-						return fmt.Errorf("unsupported format cdoe %s", fmtCode)
+						return false, fmt.Errorf("unsupported format cdoe %s", fmtCode)
 					}
 				}
 
 				if err := c.writeBuf.finishMsg(c.w); err != nil {
-					return err
+					return false, err
+				}
+			}
+
+			if c.suspended != nil {
+				// The statement is counted once its last rows are sent.
+				c.writeBuf.initMsg(ServerMsgPortalSuspended)
+				if err := c.writeBuf.finishMsg(c.w); err != nil {
+					return false, err
 				}
+				continue
 			}
 
 			// Send CommandComplete
 			tag = append(tag, ' ')
-			tag = append(tag, []byte(strconv.Itoa(len(result.Rows)))...)
+			tag = append(tag, []byte(strconv.Itoa(len(rows)))...)
 
 			if err := c.sendCommandComplete(tag); err != nil {
-				return err
+				return false, err
 			}
 
 		// Ack messages do not have a corresponding protobuf field, so handle those with default
 		// This also includes DDLs which want CommandComplete as well
 		default:
 			if err := c.sendCommandComplete(tag); err != nil {
-				return err
+				return false, err
 			}
 		}
+		c.metrics.query(result.PGTag)
+		c.completed = executor.Result{Type: result.Type, PGTag: result.PGTag}
+	}
+	return true, nil
+}
+
+// sendNotices sends a NoticeResponse for each of the notices the session's
+// client_min_messages lets through.
+func (c *pqConn) sendNotices(notices []error) error {
+	for _, n := range notices {
+		e := sql.ToNotice(n)
+		if !c.session.SendsToClient(e.Severity) {
+			continue
+		}
+		c.writeBuf.initMsg(ServerMsgNoticeResponse)
+		if err := c.writeBuf.writeErrorFields(e.Fields()); err != nil {
+			return err
+		}
+		if err := c.writeBuf.finishMsg(c.w); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -801,7 +1421,7 @@ func (c *pqConn) sendRowDescription(columns []executor.ResultColumn, formatCodes
 	c.writeBuf.putInt16(int16(len(columns)))
 
 	for i, column := range columns {
-		if err := c.writeBuf.writeString(column.Name); err != nil {
+		if err := c.writeBuf.writeClientString(column.Name); err != nil {
 			return err
 		}
 
@@ -827,35 +1447,33 @@ func (c *pqConn) sendInternalError(errToSend string) error {
 }
 
 func (c *pqConn) sendError(errCode, errToSend string) error {
+	return c.sendPGError(sql.NewPGError(errCode, "%s", errToSend))
+}
+
+// sendPGError sends err as an ErrorResponse, with all the fields set in it
+// if it is a sql.PGError. As in PostgreSQL, any error inside an explicit
+// transaction aborts it.
+func (c *pqConn) sendPGError(err error) error {
+	if c.batch != nil {
+		// The batched Executes came first. If one of them failed, the
+		// message which caused err is ignored.
+		if err := c.runBatch(); err != nil || c.ignoreTillSync {
+			return err
+		}
+	}
+
+	e := sql.ToPGError(err)
+	c.metrics.error(e.Code)
 	if c.extendedQueryMessage {
 		c.ignoreTillSync = true
 	}
+	c.session.FailTransaction()
 
+	// Like any other response, it is flushed by ReadyForQuery or a Flush
+	// message.
 	c.writeBuf.initMsg(ServerMsgErrorResponse)
-	if err := c.writeBuf.WriteByte('S'); err != nil {
+	if err := c.writeBuf.writeErrorFields(e.Fields()); err != nil {
 		return err
 	}
-	if err := c.writeBuf.writeString("ERROR"); err != nil {
-		return err
-	}
-	if err := c.writeBuf.WriteByte('C'); err != nil {
-		return err
-	}
-	if err := c.writeBuf.writeString(errCode); err != nil {
-		return err
-	}
-	if err := c.writeBuf.WriteByte('M'); err != nil {
-		return err
-	}
-	if err := c.writeBuf.writeString(errToSend); err != nil {
-		return err
-	}
-	if err := c.writeBuf.WriteByte(0); err != nil {
-		return err
-	}
-	if err := c.writeBuf.finishMsg(c.w); err != nil {
-		return err
-	}
-
-	return c.w.Flush()
+	return c.writeBuf.finishMsg(c.w)
 }
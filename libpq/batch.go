@@ -0,0 +1,156 @@
+package libpq
+
+import (
+	"fmt"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/catalog"
+	"github.com/yydzero/mnt/parser"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// batch collects consecutive Executes of the same prepared statement in a
+// pipeline, to be run together by an executor.BatchExecutor. Their responses,
+// and those of the Binds between them, are held back until the batch runs so
+// that the client sees them in order.
+type batch struct {
+	// ctx is the context of the connection's main loop, which the batch runs
+	// in when a message other than its Binds and Executes arrives.
+	ctx context.Context
+
+	stmtName string
+	query    string
+	handle   executor.PreparedStatement
+	executes []batchExecute
+
+	// binds counts the BindCompletes held back since the last Execute.
+	binds int
+}
+
+type batchExecute struct {
+	portal *portal
+	params []parser.Datum
+	format []formatCode
+
+	// binds counts the BindCompletes to send before its response.
+	binds int
+}
+
+// canBatch reports whether an Execute of p can be added to a batch. Only
+// INSERT, UPDATE and DELETE statements run without a row limit are batched:
+// those a client loads data with, whose responses do not depend on the
+// session state the statements before them leave behind.
+func (c *pqConn) canBatch(p *portal, limit int32) bool {
+	if !c.batches() || p.stmt.handle == nil || limit != 0 || p.suspended != nil || p.done {
+		return false
+	}
+	stmts := parser.Split(p.stmt.query)
+	if len(stmts) != 1 {
+		return false
+	}
+	toks, err := parser.Scan(stmts[0])
+	if err != nil || len(toks) == 0 {
+		return false
+	}
+	return toks[0].Is("insert") || toks[0].Is("update") || toks[0].Is("delete")
+}
+
+// batches reports whether the session's executor runs batches itself. The
+// catalog executor wrapping it implements executor.BatchExecutor either way.
+func (c *pqConn) batches() bool {
+	if e, ok := c.executor.(*catalog.Executor); ok {
+		return e.Batches()
+	}
+	_, ok := c.executor.(executor.BatchExecutor)
+	return ok
+}
+
+// addToBatch adds an Execute of p to the batch, running the batch first if
+// it is of another statement. If that fails, the Execute is ignored.
+func (c *pqConn) addToBatch(ctx context.Context, p *portal) error {
+	if c.batch != nil && c.batch.stmtName != p.stmtName {
+		if err := c.runBatch(); err != nil || c.ignoreTillSync {
+			return err
+		}
+	}
+	if c.batch == nil {
+		c.batch = &batch{ctx: ctx, stmtName: p.stmtName, query: p.stmt.query, handle: p.stmt.handle.stmt}
+	}
+	// The portal is run to completion by the batch.
+	p.done = true
+	c.batch.executes = append(c.batch.executes, batchExecute{
+		portal: p,
+		params: p.params,
+		format: p.format,
+		binds:  c.batch.binds,
+	})
+	c.batch.binds = 0
+	return nil
+}
+
+// runBatch runs the pending batch and sends the responses held back for it.
+// A failed Execute ends it, and the client ignores the rest until Sync.
+func (c *pqConn) runBatch() error {
+	b := c.batch
+	c.batch = nil
+
+	if err := c.sendBindCompletes(b.executes[0].binds); err != nil {
+		return err
+	}
+	if err := c.session.CheckAborted(b.query); err != nil {
+		return c.sendPGError(err)
+	}
+	if err := c.beginImplicitTransaction(b.ctx); err != nil {
+		return c.sendPGError(err)
+	}
+
+	params := make([][]parser.Datum, len(b.executes))
+	for i, e := range b.executes {
+		params[i] = e.params
+	}
+	ctx, cancel := c.batchContext(b.ctx, len(b.executes))
+	start := time.Now()
+	results := c.executor.(executor.BatchExecutor).ExecuteBatch(ctx, b.handle, params)
+	c.metrics.observe("batch", time.Since(start))
+	statementTimedOut(ctx, results)
+	cancel()
+
+	for i, e := range b.executes {
+		if i > 0 {
+			if err := c.sendBindCompletes(e.binds); err != nil {
+				return err
+			}
+		}
+		if i >= len(results) {
+			return c.sendInternalError(fmt.Sprintf("batch of %d executes returned %d results", len(b.executes), len(results)))
+		}
+		ok, err := c.sendResponse(executor.ResultList{results[i]}, e.format, false, 0)
+		if err != nil || !ok {
+			return err
+		}
+		e.portal.completion = c.completed
+	}
+	return c.sendBindCompletes(b.binds)
+}
+
+// batchContext returns the context to run a batch of n Executes in. Each
+// Execute may take up to statement_timeout, but the executor runs them in
+// one call, so the batch as a whole is given n times as long: it is canceled
+// once it runs longer than its Executes could have one by one, while a
+// single slow Execute among fast ones goes unnoticed.
+func (c *pqConn) batchContext(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	if timeout := c.timeoutVar("statement_timeout"); timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(n)*timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *pqConn) sendBindCompletes(n int) error {
+	for i := 0; i < n; i++ {
+		c.writeBuf.initMsg(ServerMsgBindComplete)
+		if err := c.writeBuf.finishMsg(c.w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
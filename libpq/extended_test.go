@@ -0,0 +1,219 @@
+package libpq_test
+
+import (
+	. "github.com/yydzero/mnt/libpq"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/fake"
+	"github.com/yydzero/mnt/parser"
+	"golang.org/x/net/context"
+	"sync/atomic"
+	"time"
+)
+
+const usersQuery = "SELECT name FROM users WHERE age = $1"
+
+// countingExecutor counts the prepared statements it runs, each of which
+// inserts a row.
+type countingExecutor struct {
+	fake.FakeExecutor
+	runs int32
+}
+
+func (e *countingExecutor) Execute(ctx context.Context, stmt executor.PreparedStatement, params []parser.Datum) executor.StatementResults {
+	atomic.AddInt32(&e.runs, 1)
+	return executor.StatementResults{ResultList: executor.ResultList{
+		{Type: executor.RowsAffected, PGTag: "INSERT", RowsAffected: 1},
+	}}
+}
+
+var _ = Describe("extended query protocol", func() {
+	var w *wireConn
+
+	BeforeEach(func() {
+		w = dialWire()
+	})
+
+	AfterEach(func() {
+		w.close()
+	})
+
+	It("should run the full statement and portal lifecycle", func() {
+		w.parse("s1", usersQuery, 20)
+		w.describe('S', "s1")
+		w.bind("p1", "s1", []byte("20"))
+		w.describe('P', "p1")
+		w.execute("p1", 0)
+		w.closeMsg('P', "p1")
+		w.closeMsg('S', "s1")
+		Expect(types(w.sync())).Should(Equal("1tT2TDDDC33Z"))
+	})
+
+	It("should answer Close of unknown names with CloseComplete", func() {
+		w.closeMsg('S', "nope")
+		w.closeMsg('P', "nope")
+		Expect(types(w.sync())).Should(Equal("33Z"))
+	})
+
+	It("should suspend a portal at the row limit and resume it", func() {
+		w.parse("", usersQuery, 20)
+		w.bind("", "", []byte("20"))
+		w.execute("", 2)
+		w.execute("", 2)
+		w.execute("", 2)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("12DDsDCCZ"))
+		Expect(string(msgs[6].body)).Should(Equal("SELECT 1\x00"))
+		Expect(string(msgs[7].body)).Should(Equal("SELECT 0\x00"))
+	})
+
+	It("should not run the statement of an exhausted portal again", func() {
+		e := &countingExecutor{}
+		w := pipeWire(NewServer(WithExecutor(e)))
+		defer w.close()
+		w.startup(0x30000)
+		w.untilReady()
+
+		w.parse("", "INSERT INTO users VALUES ($1)", 20)
+		w.bind("", "", []byte("1"))
+		w.execute("", 0)
+		w.execute("", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("12CCZ"))
+		Expect(string(msgs[2].body)).Should(Equal("INSERT 0 1\x00"))
+		Expect(string(msgs[3].body)).Should(Equal("INSERT 0 0\x00"))
+		Expect(atomic.LoadInt32(&e.runs)).Should(Equal(int32(1)))
+	})
+
+	It("should describe a portal by its own statement", func() {
+		w.parse("", usersQuery, 20)
+		w.bind("p1", "", []byte("20"))
+		// Replacing the unnamed statement does not change the portal.
+		w.parse("", "SET application_name = 'x'")
+		w.describe('P', "p1")
+		Expect(types(w.sync())).Should(Equal("121TZ"))
+	})
+
+	It("should close the portals of a closed statement", func() {
+		w.parse("s1", usersQuery, 20)
+		w.bind("p1", "s1", []byte("20"))
+		w.closeMsg('S', "s1")
+		w.execute("p1", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("123EZ"))
+		Expect(errorField(msgs[3], 'C')).Should(Equal("34000"))
+	})
+
+	It("should drop portals at the end of the transaction", func() {
+		w.parse("s1", usersQuery, 20)
+		w.bind("", "s1", []byte("20"))
+		Expect(types(w.sync())).Should(Equal("12Z"))
+
+		w.execute("", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("EZ"))
+		Expect(errorField(msgs[0], 'C')).Should(Equal("34000"))
+
+		// Inside a transaction, portals outlive Sync.
+		Expect(types(w.query("BEGIN"))).Should(Equal("CZ"))
+		w.bind("p1", "s1", []byte("20"))
+		Expect(types(w.sync())).Should(Equal("2Z"))
+		w.execute("p1", 0)
+		Expect(types(w.sync())).Should(Equal("DDDCZ"))
+		Expect(types(w.query("COMMIT"))).Should(Equal("CZ"))
+		w.execute("p1", 0)
+		Expect(types(w.sync())).Should(Equal("EZ"))
+	})
+
+	It("should bind NULL parameters as NULL", func() {
+		w.parse("", "SELECT pg_notify($1, $2)")
+		w.bind("", "", nil, []byte("payload"))
+		w.execute("", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("12EZ"))
+		Expect(errorField(msgs[2], 'M')).Should(Equal("channel name cannot be empty"))
+	})
+
+	It("should run a pipeline as one implicit transaction", func() {
+		w.parse("", "SET application_name = 'pipelined'")
+		w.bind("", "")
+		w.execute("", 0)
+		w.parse("", "NOTIFY pipeline")
+		w.bind("", "")
+		w.execute("", 0)
+		// The fake executor prepares every statement with one parameter.
+		w.parse("", "RAISE 'boom'")
+		w.bind("", "", []byte("20"))
+		w.execute("", 0)
+		w.parse("", "SET application_name = 'ignored'")
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("12C12C12EZ"))
+
+		msgs = w.query("SHOW application_name")
+		Expect(string(msgs[1].body[6:])).Should(Equal(""))
+
+		// Without an error, it commits at Sync.
+		w.query("LISTEN pipeline")
+		w.parse("", "SET application_name = 'pipelined'")
+		w.bind("", "")
+		w.execute("", 0)
+		w.parse("", "NOTIFY pipeline")
+		w.bind("", "")
+		w.execute("", 0)
+		msgs = w.sync()
+		Expect(types(msgs)).Should(Equal("12C12CASZ"))
+
+		msgs = w.query("SHOW application_name")
+		Expect(string(msgs[1].body[6:])).Should(Equal("pipelined"))
+	})
+
+	It("should answer batched Executes in order", func() {
+		w.parse("ins", "INSERT INTO users VALUES ($1)", 20)
+		for _, v := range []string{"1", "2", "3"} {
+			w.bind("", "ins", []byte(v))
+			w.execute("", 0)
+		}
+		w.parse("", usersQuery, 20)
+		w.bind("", "", []byte("20"))
+		w.execute("", 0)
+		Expect(types(w.sync())).Should(Equal("12DDDC2DDDC2DDDC12DDDCZ"))
+
+		// An error binding the next row follows the rows before it, and the
+		// rest are ignored.
+		w.bind("", "ins", []byte("1"))
+		w.execute("", 0)
+		w.bind("", "ins", []byte("x"))
+		w.execute("", 0)
+		w.bind("", "ins", []byte("3"))
+		w.execute("", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("2DDDCEZ"))
+		Expect(errorField(msgs[5], 'M')).Should(HavePrefix("param $1"))
+	})
+
+	It("should not flush until Flush or Sync", func() {
+		w.parse("", usersQuery, 20)
+		w.bind("", "", []byte("20"))
+		w.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+		w.conn.SetReadDeadline(time.Time{})
+
+		w.send('H', nil)
+		Expect(w.receive().typ).Should(Equal(byte('1')))
+		Expect(w.receive().typ).Should(Equal(byte('2')))
+		Expect(types(w.sync())).Should(Equal("Z"))
+	})
+
+	It("should ignore messages until Sync after an error", func() {
+		w.parse("s1", usersQuery, 20)
+		w.parse("s1", usersQuery, 20)
+		w.bind("", "s1", []byte("20"))
+		w.execute("", 0)
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("1EZ"))
+		Expect(errorField(msgs[1], 'C')).Should(Equal("42P05"))
+	})
+})
@@ -0,0 +1,173 @@
+package libpq
+
+import (
+	"fmt"
+	"github.com/lib/pq/oid"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// A Function can be called by OID with the FunctionCall message of the
+// fast-path interface, as used by libpq's large object functions.
+type Function struct {
+	Name string
+
+	// ArgTypes are the types the arguments are decoded as.
+	ArgTypes []oid.Oid
+
+	// Call runs the function. NULL arguments are parser.DNull, and a nil or
+	// DNull result is sent as NULL.
+	Call func(ctx context.Context, args []parser.Datum) (parser.Datum, error)
+}
+
+// functionRegistry holds the functions of a Server, by OID.
+type functionRegistry struct {
+	mu    sync.RWMutex
+	funcs map[oid.Oid]Function
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{funcs: make(map[oid.Oid]Function)}
+}
+
+func (r *functionRegistry) lookup(id oid.Oid) (Function, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.funcs[id]
+	return f, ok
+}
+
+// RegisterFunction makes f callable with the FunctionCall message, replacing
+// any function registered with the same OID.
+func (s *Server) RegisterFunction(id oid.Oid, f Function) {
+	s.functions.mu.Lock()
+	defer s.functions.mu.Unlock()
+	s.functions.funcs[id] = f
+}
+
+// handleFunctionCall runs a function with the fast-path interface. Message
+// format:
+//
+//	'F'
+//	int32 function OID
+//	int16 number of argument format codes, followed by the codes
+//	int16 number of arguments, followed by each as int32 length and bytes
+//	int16 result format code
+func (c *pqConn) handleFunctionCall(ctx context.Context, buf *readBuffer) error {
+	if c.session.TxnState.State == sql.Aborted {
+		return c.sendPGError(sql.ErrTransactionAborted)
+	}
+
+	id, err := buf.getInt32()
+	if err != nil {
+		return err
+	}
+	numFormatCodes, err := buf.getInt16()
+	if err != nil {
+		return err
+	}
+	if numFormatCodes < 0 {
+		return c.sendError(sql.CodeProtocolViolationError,
+			fmt.Sprintf("invalid number of argument formats: %d", numFormatCodes))
+	}
+	formatCodes := make([]formatCode, numFormatCodes)
+	for i := range formatCodes {
+		code, err := buf.getInt16()
+		if err != nil {
+			return err
+		}
+		formatCodes[i] = formatCode(code)
+	}
+	numArgs, err := buf.getInt16()
+	if err != nil {
+		return err
+	}
+	if numArgs < 0 {
+		return c.sendError(sql.CodeProtocolViolationError, fmt.Sprintf("invalid number of arguments: %d", numArgs))
+	}
+
+	f, ok := c.functions.lookup(oid.Oid(id))
+	if !ok {
+		return c.sendError(sql.CodeUndefinedFunctionError, fmt.Sprintf("function with OID %d does not exist", id))
+	}
+	if int(numArgs) != len(f.ArgTypes) {
+		return c.sendError(sql.CodeProtocolViolationError,
+			fmt.Sprintf("function call message contains %d arguments but function requires %d", numArgs, len(f.ArgTypes)))
+	}
+	if numFormatCodes > 1 && numFormatCodes != numArgs {
+		return c.sendError(sql.CodeProtocolViolationError,
+			fmt.Sprintf("function call message contains %d argument formats but %d arguments", numFormatCodes, numArgs))
+	}
+
+	args := make([]parser.Datum, numArgs)
+	for i, t := range f.ArgTypes {
+		alen, err := buf.getInt32()
+		if err != nil {
+			return err
+		}
+		if alen == -1 {
+			args[i] = parser.DNull
+			continue
+		}
+		b, err := buf.getBytes(int(alen))
+		if err != nil {
+			return err
+		}
+		code := formatText
+		switch numFormatCodes {
+		case 0:
+		case 1:
+			code = formatCodes[0]
+		default:
+			code = formatCodes[i]
+		}
+		if code == formatText {
+			s, ok, err := c.decodeClientText(b)
+			if !ok {
+				return err
+			}
+			b = []byte(s)
+		}
+		d, err := decodeOidDatum(t, code, b, c.writeBuf.format)
+		if err != nil {
+			return c.sendError(sql.ErrorCode(err), fmt.Sprintf("argument %d of %s: %s", i+1, f.Name, err))
+		}
+		args[i] = d
+	}
+
+	resultCode, err := buf.getInt16()
+	if err != nil {
+		return err
+	}
+
+	callCtx, cancel := c.statementContext(ctx)
+	result, err := f.Call(callCtx, args)
+	if err != nil && callCtx.Err() == context.DeadlineExceeded {
+		err = errStatementTimeout
+	}
+	cancel()
+	if err != nil {
+		return c.sendPGError(err)
+	}
+	if result == nil {
+		result = parser.DNull
+	}
+
+	// The result is sent as a length followed by its bytes, the same as a
+	// column of a DataRow.
+	c.writeBuf.initMsg(ServerMsgFuncCallResponse)
+	switch formatCode(resultCode) {
+	case formatText:
+		err = c.writeBuf.writeTextDatum(result)
+	case formatBinary:
+		err = c.writeBuf.writeBinaryDatum(result)
+	default:
+		return c.sendError(sql.CodeProtocolViolationError, fmt.Sprintf("unsupported format code: %d", resultCode))
+	}
+	if err != nil {
+		return c.sendPGError(err)
+	}
+	return c.writeBuf.finishMsg(c.w)
+}
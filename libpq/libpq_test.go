@@ -4,31 +4,44 @@ import (
 	. "github.com/yydzero/mnt/libpq"
 
 	"database/sql"
+	"encoding/binary"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/lib/pq/oid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/yydzero/mnt/parser"
+	"golang.org/x/net/context"
 	"log"
 	"net"
 	"time"
 )
 
-var _ = Describe("libpq spec", func() {
-	port := "8899"
+const port = "8899"
 
-	It("should able to establish connection", func() {
-		log.SetFlags(log.Ltime | log.Lshortfile)
+var _ = BeforeSuite(func() {
+	log.SetFlags(log.Ltime | log.Lshortfile)
 
-		go startServer(port)
+	startServer(port)
+})
 
-		time.Sleep(10 * time.Millisecond)
+// openDB returns a database handle using a single connection, so that
+// session state is kept between statements.
+func openDB() *sql.DB {
+	url := fmt.Sprintf("user=pqgotest dbname=pqgotest port=%s sslmode=disable", port)
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
 
+var _ = Describe("libpq spec", func() {
+	It("should able to establish connection", func() {
 		// Now use lib/pq to send some info.
-		url := fmt.Sprintf("user=pqgotest dbname=pqgotest port=%s sslmode=disable", port)
-		db, err := sql.Open("postgres", url)
-		if err != nil {
-			panic(err)
-		}
+		db := openDB()
+		defer db.Close()
 
 		age := 20
 		rows, err := db.Query("SELECT name FROM users WHERE age = $1", age)
@@ -57,6 +70,350 @@ var _ = Describe("libpq spec", func() {
 		}
 
 	})
+
+	It("should SET, SHOW and RESET session variables", func() {
+		db := openDB()
+		defer db.Close()
+
+		var style string
+		Expect(db.QueryRow("SHOW DateStyle").Scan(&style)).Should(Succeed())
+		Expect(style).Should(Equal("ISO, MDY"))
+
+		_, err := db.Exec("SET datestyle TO German")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(db.QueryRow("SHOW DateStyle").Scan(&style)).Should(Succeed())
+		Expect(style).Should(Equal("German, DMY"))
+
+		_, err = db.Exec("SET gp_session_id = 42; SET myext.setting TO 'x'")
+		Expect(err).ShouldNot(HaveOccurred())
+		var id string
+		Expect(db.QueryRow("SHOW gp_session_id").Scan(&id)).Should(Succeed())
+		Expect(id).Should(Equal("42"))
+
+		_, err = db.Exec("RESET ALL")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(db.QueryRow("SHOW DateStyle").Scan(&style)).Should(Succeed())
+		Expect(style).Should(Equal("ISO, MDY"))
+	})
+
+	It("should scope SET LOCAL to the transaction", func() {
+		db := openDB()
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("SET LOCAL statement_timeout = 5000")
+		Expect(err).ShouldNot(HaveOccurred())
+		var timeout string
+		Expect(tx.QueryRow("SHOW statement_timeout").Scan(&timeout)).Should(Succeed())
+		Expect(timeout).Should(Equal("5s"))
+		Expect(tx.Commit()).Should(Succeed())
+
+		Expect(db.QueryRow("SHOW statement_timeout").Scan(&timeout)).Should(Succeed())
+		Expect(timeout).Should(Equal("0"))
+	})
+
+	It("should warn of SET LOCAL outside of a transaction block", func() {
+		w := dialWire()
+		defer w.close()
+
+		msgs := w.query("SET LOCAL application_name = 'alone'")
+		Expect(types(msgs)).Should(Equal("NCZ"))
+		Expect(errorField(msgs[0], 'S')).Should(Equal("WARNING"))
+		Expect(errorField(msgs[0], 'C')).Should(Equal("25P01"))
+		Expect(errorField(msgs[0], 'M')).Should(Equal("SET LOCAL can only be used in transaction blocks"))
+
+		// The statements of one query form an implicit transaction block.
+		msgs = w.query("SET LOCAL application_name = 'batch'; SHOW application_name")
+		Expect(types(msgs)).Should(Equal("CTDCZ"))
+		Expect(string(msgs[2].body)).Should(ContainSubstring("batch"))
+		msgs = w.query("SHOW application_name")
+		Expect(types(msgs)).Should(Equal("TDCZ"))
+		Expect(string(msgs[1].body)).ShouldNot(ContainSubstring("batch"))
+	})
+
+	It("should stop a batch at a failed statement", func() {
+		db := openDB()
+		defer db.Close()
+
+		// The batch is one implicit transaction, so the SET before the
+		// failure is rolled back with it.
+		_, err := db.Exec("SET application_name = 'batch'; RAISE 'boom'; RESET application_name")
+		Expect(err).Should(HaveOccurred())
+		Expect(err.(*pq.Error).Message).Should(Equal("boom"))
+
+		var name string
+		Expect(db.QueryRow("SHOW application_name").Scan(&name)).Should(Succeed())
+		Expect(name).Should(Equal(""))
+
+		_, err = db.Exec("SET application_name = 'batch'; COMMIT; RAISE 'boom'")
+		Expect(err).Should(HaveOccurred())
+		Expect(db.QueryRow("SHOW application_name").Scan(&name)).Should(Succeed())
+		Expect(name).Should(Equal("batch"))
+	})
+
+	It("should abort an explicit transaction on error", func() {
+		db := openDB()
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("RAISE 'boom'")
+		Expect(err).Should(HaveOccurred())
+
+		_, err = tx.Exec("SHOW DateStyle")
+		Expect(err).Should(HaveOccurred())
+		Expect(string(err.(*pq.Error).Code)).Should(Equal("25P02"))
+		Expect(tx.Rollback()).Should(Succeed())
+
+		var style string
+		Expect(db.QueryRow("SHOW DateStyle").Scan(&style)).Should(Succeed())
+	})
+
+	It("should skip to Sync after an error in an extended query", func() {
+		db := openDB()
+		defer db.Close()
+
+		_, err := db.Query("RAISE 'boom' $1", 1)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.(*pq.Error).Message).Should(Equal("boom"))
+
+		rows, err := db.Query("SELECT name FROM users WHERE age = $1", 20)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rows.Next()).Should(BeTrue())
+		Expect(rows.Close()).Should(Succeed())
+	})
+
+	It("should send all the fields of an error", func() {
+		db := openDB()
+		defer db.Close()
+
+		_, err := db.Exec("RAISE 'no such user' '42704' 'user \"bob\" is missing' 'create it first'")
+		Expect(err).Should(HaveOccurred())
+		e := err.(*pq.Error)
+		Expect(e.Severity).Should(Equal("ERROR"))
+		Expect(string(e.Code)).Should(Equal("42704"))
+		Expect(e.Message).Should(Equal("no such user"))
+		Expect(e.Detail).Should(Equal(`user "bob" is missing`))
+		Expect(e.Hint).Should(Equal("create it first"))
+
+		_, err = db.Exec("SET no_such_parameter = 1")
+		Expect(err).Should(HaveOccurred())
+		Expect(string(err.(*pq.Error).Code)).Should(Equal("42704"))
+	})
+
+	It("should send notices allowed by client_min_messages", func() {
+		connector, err := pq.NewConnector(fmt.Sprintf("user=pqgotest dbname=pqgotest port=%s sslmode=disable", port))
+		Expect(err).ShouldNot(HaveOccurred())
+		var notices []*pq.Error
+		db := sql.OpenDB(pq.ConnectorWithNoticeHandler(connector, func(e *pq.Error) {
+			notices = append(notices, e)
+		}))
+		db.SetMaxOpenConns(1)
+		defer db.Close()
+
+		_, err = db.Exec("RAISE NOTICE 'first'")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.Exec("SET client_min_messages = warning")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.Exec("RAISE NOTICE 'dropped'")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = db.Exec("RAISE WARNING 'second'")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(notices).Should(HaveLen(2))
+		Expect(notices[0].Severity).Should(Equal("NOTICE"))
+		Expect(notices[0].Message).Should(Equal("first"))
+		Expect(string(notices[0].Code)).Should(Equal("00000"))
+		Expect(notices[1].Severity).Should(Equal("WARNING"))
+		Expect(notices[1].Message).Should(Equal("second"))
+		Expect(string(notices[1].Code)).Should(Equal("01000"))
+	})
+
+	It("should deliver notifications to listeners on commit", func() {
+		listener := pq.NewListener(fmt.Sprintf("user=pqgotest dbname=pqgotest port=%s sslmode=disable", port),
+			time.Second, time.Second, nil)
+		defer listener.Close()
+		Expect(listener.Listen("cache")).Should(Succeed())
+
+		db := openDB()
+		defer db.Close()
+
+		tx, err := db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("NOTIFY cache, 'rolled back'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tx.Rollback()).Should(Succeed())
+
+		tx, err = db.Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = tx.Exec("NOTIFY cache, 'committed'")
+		Expect(err).ShouldNot(HaveOccurred())
+		Consistently(listener.Notify, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(tx.Commit()).Should(Succeed())
+
+		var n *pq.Notification
+		Eventually(listener.Notify).Should(Receive(&n))
+		Expect(n.Channel).Should(Equal("cache"))
+		Expect(n.Extra).Should(Equal("committed"))
+
+		_, err = db.Exec("SELECT pg_notify($1, $2)", "cache", "from pg_notify")
+		Expect(err).ShouldNot(HaveOccurred())
+		Eventually(listener.Notify).Should(Receive(&n))
+		Expect(n.Extra).Should(Equal("from pg_notify"))
+
+		_, err = db.Exec("NOTIFY other")
+		Expect(err).ShouldNot(HaveOccurred())
+		Consistently(listener.Notify, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should answer FunctionCall messages", func() {
+		w := dialWire()
+		defer w.close()
+
+		call := func(id int32, argFormat int16, arg []byte, resultFormat int16) []wireMsg {
+			var b msgBuilder
+			b.int32(id)
+			b.int16(1)
+			b.int16(argFormat)
+			b.int16(1)
+			b.value(arg)
+			b.int16(resultFormat)
+			w.send('F', b.Bytes())
+			return w.untilReady()
+		}
+
+		msgs := call(1219, 0, []byte("41"), 0)
+		Expect(types(msgs)).Should(Equal("VZ"))
+		Expect(msgs[0].body).Should(Equal([]byte{0, 0, 0, 2, '4', '2'}))
+
+		arg := make([]byte, 8)
+		binary.BigEndian.PutUint64(arg, 42)
+		msgs = call(1219, 1, arg, 1)
+		Expect(types(msgs)).Should(Equal("VZ"))
+		Expect(msgs[0].body).Should(Equal([]byte{0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 43}))
+
+		msgs = call(1219, 0, nil, 0)
+		Expect(types(msgs)).Should(Equal("VZ"))
+		Expect(msgs[0].body).Should(Equal([]byte{0xff, 0xff, 0xff, 0xff}))
+
+		msgs = call(4242, 0, []byte("1"), 0)
+		Expect(types(msgs)).Should(Equal("EZ"))
+		Expect(errorField(msgs[0], 'C')).Should(Equal("42883"))
+
+		for _, counts := range [][2]int16{{-1, 1}, {0, -1}} {
+			var b msgBuilder
+			b.int32(1219)
+			b.int16(counts[0])
+			b.int16(counts[1])
+			b.int16(0)
+			w.send('F', b.Bytes())
+			msgs = w.untilReady()
+			Expect(types(msgs)).Should(Equal("EZ"))
+			Expect(errorField(msgs[0], 'C')).Should(Equal("08P01"))
+		}
+	})
+
+	It("should refuse GSS encryption and accept the retried startup", func() {
+		w := connectWire()
+		defer w.close()
+
+		var b msgBuilder
+		b.int32(80877104)
+		w.sendUntyped(b.Bytes())
+		reply, err := w.r.ReadByte()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reply).Should(Equal(byte('N')))
+
+		w.startup(0x30000)
+		msgs := w.untilReady()
+		Expect(msgs[0].typ).Should(Equal(byte('R')))
+	})
+
+	It("should negotiate down newer minor versions and protocol options", func() {
+		w := connectWire()
+		defer w.close()
+
+		w.startup(0x30002, "_pq_.compression", "on")
+		msgs := w.untilReady()
+		Expect(msgs[0].typ).Should(Equal(byte('v')))
+		var b msgBuilder
+		b.int32(0)
+		b.int32(1)
+		b.str("_pq_.compression")
+		Expect(msgs[0].body).Should(Equal(b.Bytes()))
+		Expect(msgs[1].typ).Should(Equal(byte('R')))
+	})
+
+	It("should negotiate the protocol version before reporting bad options", func() {
+		w := connectWire()
+		defer w.conn.Close()
+
+		w.startup(0x30002, "_pq_.compression", "on", "replication", "bogus")
+		msg := w.receive()
+		Expect(msg.typ).Should(Equal(byte('v')))
+		msg = w.receive()
+		Expect(msg.typ).Should(Equal(byte('E')))
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("22023"))
+	})
+
+	It("should send FATAL for unsupported protocol versions", func() {
+		w := connectWire()
+		defer w.conn.Close()
+
+		w.startup(0x20000)
+		msg := w.receive()
+		Expect(msg.typ).Should(Equal(byte('E')))
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("0A000"))
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should set run-time parameters from the startup packet and options", func() {
+		w := connectWire()
+		defer w.close()
+
+		w.startup(0x30000, "application_name", "loader", "DateStyle", "German",
+			"options", `-c gp_session_id=42 --statement-timeout=5s -capplication_name=my\ app`)
+		w.untilReady()
+
+		show := func(name string) string {
+			var b msgBuilder
+			b.str("SHOW " + name)
+			w.send('Q', b.Bytes())
+			msgs := w.untilReady()
+			Expect(types(msgs)).Should(Equal("TDCZ"))
+			// One column: int16 count, int32 length, value.
+			return string(msgs[1].body[6:])
+		}
+		Expect(show("gp_session_id")).Should(Equal("42"))
+		Expect(show("statement_timeout")).Should(Equal("5s"))
+		Expect(show("DateStyle")).Should(Equal("German, DMY"))
+		// The startup packet wins over options.
+		Expect(show("application_name")).Should(Equal("loader"))
+	})
+
+	It("should refuse unknown startup parameters and replication", func() {
+		for _, test := range []struct {
+			name, value, code string
+		}{
+			{"no_such_parameter", "1", "42704"},
+			{"options", "-c no_such_parameter=1", "42704"},
+			{"options", "-B 100", "42601"},
+			{"server_version", "9.6", "55P02"},
+			{"replication", "database", "0A000"},
+		} {
+			w := connectWire()
+			w.startup(0x30000, test.name, test.value)
+			msg := w.receive()
+			w.conn.Close()
+			Expect(msg.typ).Should(Equal(byte('E')))
+			Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+			Expect(errorField(msg, 'C')).Should(Equal(test.code), test.value)
+		}
+	})
 })
 
 func startServer(port string) {
@@ -64,18 +421,18 @@ func startServer(port string) {
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Listening on :8899")
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			panic(err)
-		}
-		go handleConnection(conn)
-	}
-}
-
-func handleConnection(conn net.Conn) {
+	// Connections share a server, for LISTEN and NOTIFY.
 	s := NewServer()
-	s.Serve(conn)
+	s.RegisterFunction(1219, Function{
+		Name:     "int8inc",
+		ArgTypes: []oid.Oid{oid.T_int8},
+		Call: func(ctx context.Context, args []parser.Datum) (parser.Datum, error) {
+			if args[0] == parser.DNull {
+				return parser.DNull, nil
+			}
+			return args[0].(parser.DInt) + 1, nil
+		},
+	})
+	go s.Serve(ln)
 }
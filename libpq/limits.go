@@ -0,0 +1,87 @@
+package libpq
+
+import (
+	"github.com/yydzero/mnt/sql"
+)
+
+// ConnectionLimits limits the sessions of a Server, like PostgreSQL's
+// max_connections and superuser_reserved_connections settings and the
+// CONNECTION LIMIT of roles and databases. Zero means no limit.
+type ConnectionLimits struct {
+	MaxConnections int
+
+	// SuperuserReservedConnections of the MaxConnections are kept for
+	// Superusers, who are not subject to the per user and per database
+	// limits either.
+	SuperuserReservedConnections int
+	Superusers                   []string
+
+	// PerUser and PerDatabase limit the sessions by user and database name.
+	PerUser     map[string]int
+	PerDatabase map[string]int
+}
+
+// sessionCounts counts the sessions of a Server against its limits.
+type sessionCounts struct {
+	total      int
+	byUser     map[string]int
+	byDatabase map[string]int
+}
+
+func (l *ConnectionLimits) isSuperuser(user string) bool {
+	for _, u := range l.Superusers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireSession counts a new session, unless it would exceed the server's
+// connection limits. The checks are made in the same order as PostgreSQL.
+func (s *Server) acquireSession(session *sql.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := &s.limits
+	n := &s.sessions
+	superuser := l.isSuperuser(session.User)
+	if l.MaxConnections > 0 && n.total >= l.MaxConnections {
+		return tooManyConnections("sorry, too many clients already")
+	}
+	if !superuser {
+		if l.SuperuserReservedConnections > 0 && l.MaxConnections > 0 &&
+			n.total >= l.MaxConnections-l.SuperuserReservedConnections {
+			return tooManyConnections("remaining connection slots are reserved for non-replication superuser connections")
+		}
+		if max := l.PerUser[session.User]; max > 0 && n.byUser[session.User] >= max {
+			return tooManyConnections("too many connections for role %q", session.User)
+		}
+		if max := l.PerDatabase[session.Database]; max > 0 && n.byDatabase[session.Database] >= max {
+			return tooManyConnections("too many connections for database %q", session.Database)
+		}
+	}
+
+	n.total++
+	n.byUser[session.User]++
+	n.byDatabase[session.Database]++
+	return nil
+}
+
+func (s *Server) releaseSession(session *sql.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := &s.sessions
+	n.total--
+	if n.byUser[session.User]--; n.byUser[session.User] == 0 {
+		delete(n.byUser, session.User)
+	}
+	if n.byDatabase[session.Database]--; n.byDatabase[session.Database] == 0 {
+		delete(n.byDatabase, session.Database)
+	}
+}
+
+func tooManyConnections(format string, args ...interface{}) error {
+	return sql.NewPGError(sql.CodeTooManyConnectionsError, format, args...)
+}
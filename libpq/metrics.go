@@ -0,0 +1,314 @@
+package libpq
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// executor latency histograms; the defaults of the Prometheus clients.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts the traffic of the servers it is given to with
+// WithMetrics, labeled by the port each connection was made to. It serves
+// them over HTTP in the Prometheus text format.
+type Metrics struct {
+	mu    sync.Mutex
+	ports map[string]*portMetrics
+}
+
+// NewMetrics returns a Metrics with nothing counted yet.
+func NewMetrics() *Metrics {
+	return &Metrics{ports: make(map[string]*portMetrics)}
+}
+
+// portMetrics holds the metrics of one port. Its methods do nothing on a
+// nil *portMetrics, which is what connections of a server without metrics
+// have.
+type portMetrics struct {
+	// Accessed atomically.
+	connections      int64
+	connectionsTotal int64
+	rejected         int64
+	bytesRead        int64
+	bytesWritten     int64
+
+	mu       sync.Mutex
+	messages map[ClientMessageType]int64
+	queries  map[string]int64
+	errors   map[string]int64
+	latency  map[string]*histogram
+}
+
+// histogram counts observations in latencyBuckets.
+type histogram struct {
+	counts []int64 // counts[i] is the observations in bucket i alone
+	count  int64
+	sum    float64
+}
+
+// port returns the metrics of the port addr is on, or nil if m is.
+func (m *Metrics) port(addr net.Addr) *portMetrics {
+	if m == nil {
+		return nil
+	}
+	label := portLabel(addr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.ports[label]
+	if !ok {
+		p = &portMetrics{
+			messages: make(map[ClientMessageType]int64),
+			queries:  make(map[string]int64),
+			errors:   make(map[string]int64),
+			latency:  make(map[string]*histogram),
+		}
+		m.ports[label] = p
+	}
+	return p
+}
+
+// portLabel returns the port of a listening address: the TCP port, or the
+// one in the name of a Unix domain socket made by ListenUnix.
+func portLabel(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return strconv.Itoa(a.Port)
+	case *net.UnixAddr:
+		return strings.TrimPrefix(filepath.Base(a.Name), ".s.PGSQL.")
+	}
+	return addr.String()
+}
+
+func (p *portMetrics) connect() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.connections, 1)
+	atomic.AddInt64(&p.connectionsTotal, 1)
+}
+
+func (p *portMetrics) disconnect() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.connections, -1)
+}
+
+// reject counts a connection refused during startup with an error of code.
+func (p *portMetrics) reject(code string) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.rejected, 1)
+	p.error(code)
+}
+
+func (p *portMetrics) message(typ ClientMessageType) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.messages[typ]++
+	p.mu.Unlock()
+}
+
+// query counts a statement which completed with tag.
+func (p *portMetrics) query(tag string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.queries[tag]++
+	p.mu.Unlock()
+}
+
+// error counts an error sent to a client.
+func (p *portMetrics) error(code string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.errors[code]++
+	p.mu.Unlock()
+}
+
+// observe records the time an executor took for op: "prepare", "execute"
+// or "batch".
+func (p *portMetrics) observe(op string, d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.latency[op]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		p.latency[op] = h
+	}
+	secs := d.Seconds()
+	h.count++
+	h.sum += secs
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// countBytes returns conn counting the bytes read from and written to it.
+func (p *portMetrics) countBytes(conn net.Conn) net.Conn {
+	if p == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, metrics: p}
+}
+
+type countingConn struct {
+	net.Conn
+	metrics *portMetrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.metrics.bytesRead, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.metrics.bytesWritten, int64(n))
+	return n, err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// write writes each metric with the samples of every port, sorted so that
+// the output is stable.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	labels := make([]string, 0, len(m.ports))
+	ports := make(map[string]*portMetrics, len(m.ports))
+	for label, p := range m.ports {
+		labels = append(labels, label)
+		ports[label] = p
+	}
+	m.mu.Unlock()
+	sort.Strings(labels)
+
+	scalars := []struct {
+		name, typ, help string
+		value           func(p *portMetrics) *int64
+	}{
+		{"libpq_connections", "gauge", "Connections being served.",
+			func(p *portMetrics) *int64 { return &p.connections }},
+		{"libpq_connections_total", "counter", "Connections accepted.",
+			func(p *portMetrics) *int64 { return &p.connectionsTotal }},
+		{"libpq_connections_rejected_total", "counter", "Connections refused during startup.",
+			func(p *portMetrics) *int64 { return &p.rejected }},
+		{"libpq_read_bytes_total", "counter", "Bytes read from clients.",
+			func(p *portMetrics) *int64 { return &p.bytesRead }},
+		{"libpq_written_bytes_total", "counter", "Bytes written to clients.",
+			func(p *portMetrics) *int64 { return &p.bytesWritten }},
+	}
+	for _, metric := range scalars {
+		writeHeader(w, metric.name, metric.typ, metric.help)
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s{port=\"%s\"} %d\n", metric.name, escapeLabel(label),
+				atomic.LoadInt64(metric.value(ports[label])))
+		}
+	}
+
+	counts := []struct {
+		name, help, label string
+		counts            func(p *portMetrics) map[string]int64
+	}{
+		{"libpq_messages_total", "Messages received by type.", "type", func(p *portMetrics) map[string]int64 {
+			counts := make(map[string]int64, len(p.messages))
+			for typ, n := range p.messages {
+				counts[string(rune(typ))] = n
+			}
+			return counts
+		}},
+		{"libpq_queries_total", "Statements completed by command tag.", "tag",
+			func(p *portMetrics) map[string]int64 { return p.queries }},
+		{"libpq_errors_total", "Errors sent to clients by SQLSTATE.", "sqlstate",
+			func(p *portMetrics) map[string]int64 { return p.errors }},
+	}
+	for _, metric := range counts {
+		writeHeader(w, metric.name, "counter", metric.help)
+		for _, label := range labels {
+			p := ports[label]
+			p.mu.Lock()
+			c := metric.counts(p)
+			for _, k := range sortedKeys(c) {
+				fmt.Fprintf(w, "%s{port=\"%s\",%s=\"%s\"} %d\n", metric.name, escapeLabel(label),
+					metric.label, escapeLabel(k), c[k])
+			}
+			p.mu.Unlock()
+		}
+	}
+
+	const latency = "libpq_executor_duration_seconds"
+	writeHeader(w, latency, "histogram", "Time taken by the executor to prepare, execute and execute batches of statements.")
+	for _, label := range labels {
+		p := ports[label]
+		p.mu.Lock()
+		ops := make([]string, 0, len(p.latency))
+		for op := range p.latency {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			h := p.latency[op]
+			l := fmt.Sprintf("port=\"%s\",op=\"%s\"", escapeLabel(label), op)
+			var cumulative int64
+			for i, le := range latencyBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", latency, l, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", latency, l, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", latency, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", latency, l, h.count)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value as the text format requires.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
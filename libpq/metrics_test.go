@@ -0,0 +1,84 @@
+package libpq_test
+
+import (
+	. "github.com/yydzero/mnt/libpq"
+
+	"bufio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http/httptest"
+)
+
+var _ = Describe("Metrics", func() {
+	scrape := func(m *Metrics) string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(rec.Header().Get("Content-Type")).Should(HavePrefix("text/plain; version=0.0.4"))
+		return rec.Body.String()
+	}
+	dial := func(port string) *wireConn {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		Expect(err).ShouldNot(HaveOccurred())
+		return &wireConn{conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	It("should count the traffic of each port", func() {
+		m := NewMetrics()
+		s1 := NewServer(WithMetrics(m), WithConnectionLimits(ConnectionLimits{MaxConnections: 1}))
+		defer s1.Close()
+		s2 := NewServer(WithMetrics(m))
+		defer s2.Close()
+		p1, p2 := listen(s1), listen(s2)
+
+		w := dial(p1)
+		w.startup(0x30000)
+		w.untilReady()
+		Expect(types(w.query("SELECT 1"))).Should(Equal("TDDDCZ"))
+		Expect(types(w.query("RAISE 'boom' '22012'"))).Should(Equal("EZ"))
+		w.parse("s1", "SELECT name FROM users WHERE age = $1")
+		w.bind("", "s1", []byte("20"))
+		w.execute("", 0)
+		Expect(types(w.sync())).Should(Equal("12DDDCZ"))
+
+		refused := dial(p1)
+		refused.startup(0x30000)
+		Expect(errorField(refused.untilReadyOrError()[0], 'C')).Should(Equal("53300"))
+
+		other := dial(p2)
+		other.startup(0x30000)
+		other.untilReady()
+		other.query("BEGIN")
+
+		Eventually(func() string { return scrape(m) }).Should(ContainSubstring(`libpq_connections{port="` + p1 + `"} 1`))
+		out := scrape(m)
+		for _, line := range []string{
+			`# TYPE libpq_connections gauge`,
+			`libpq_connections{port="` + p2 + `"} 1`,
+			`libpq_connections_total{port="` + p1 + `"} 2`,
+			`libpq_connections_rejected_total{port="` + p1 + `"} 1`,
+			`libpq_connections_rejected_total{port="` + p2 + `"} 0`,
+			`libpq_messages_total{port="` + p1 + `",type="Q"} 2`,
+			`libpq_messages_total{port="` + p1 + `",type="P"} 1`,
+			`libpq_messages_total{port="` + p2 + `",type="Q"} 1`,
+			`libpq_queries_total{port="` + p1 + `",tag="SELECT"} 2`,
+			`libpq_queries_total{port="` + p2 + `",tag="BEGIN"} 1`,
+			`libpq_errors_total{port="` + p1 + `",sqlstate="22012"} 1`,
+			`libpq_errors_total{port="` + p1 + `",sqlstate="53300"} 1`,
+			`# TYPE libpq_executor_duration_seconds histogram`,
+			`libpq_executor_duration_seconds_bucket{port="` + p1 + `",op="execute",le="+Inf"} 3`,
+			`libpq_executor_duration_seconds_count{port="` + p1 + `",op="execute"} 3`,
+			`libpq_executor_duration_seconds_count{port="` + p1 + `",op="prepare"} 1`,
+		} {
+			Expect(out).Should(ContainSubstring(line + "\n"))
+		}
+		Expect(out).Should(MatchRegexp(`libpq_read_bytes_total\{port="` + p1 + `"\} [1-9]`))
+		Expect(out).Should(MatchRegexp(`libpq_written_bytes_total\{port="` + p1 + `"\} [1-9]`))
+		Expect(out).Should(MatchRegexp(`(?m)^libpq_executor_duration_seconds_bucket\{port="` + p1 +
+			`",op="execute",le="0.005"\} \d+$`))
+
+		w.close()
+		other.close()
+		Eventually(func() string { return scrape(m) }).Should(ContainSubstring(`libpq_connections{port="` + p1 + `"} 0`))
+	})
+})
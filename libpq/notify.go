@@ -0,0 +1,147 @@
+package libpq
+
+import (
+	"github.com/yydzero/mnt/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// notificationHub delivers LISTEN/NOTIFY notifications between the
+// connections of a Server.
+type notificationHub struct {
+	mu        sync.Mutex
+	listeners map[string]map[*pqConn]bool // channel -> listening connections
+
+	lastPID int32
+}
+
+func newNotificationHub() *notificationHub {
+	return &notificationHub{listeners: make(map[string]map[*pqConn]bool)}
+}
+
+// newPID returns the process ID of a new connection, which identifies it as
+// the sender of its notifications.
+func (h *notificationHub) newPID() int32 {
+	return atomic.AddInt32(&h.lastPID, 1)
+}
+
+func (h *notificationHub) listen(c *pqConn, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns, ok := h.listeners[channel]
+	if !ok {
+		conns = make(map[*pqConn]bool)
+		h.listeners[channel] = conns
+	}
+	conns[c] = true
+}
+
+// unlisten stops c listening on channel, or on all channels if it is empty.
+func (h *notificationHub) unlisten(c *pqConn, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, conns := range h.listeners {
+		if channel != "" && ch != channel {
+			continue
+		}
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.listeners, ch)
+		}
+	}
+}
+
+// notify queues n on each connection listening on its channel.
+func (h *notificationHub) notify(n sql.Notification) {
+	h.mu.Lock()
+	var conns []*pqConn
+	for c := range h.listeners[n.Channel] {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range conns {
+		c.queueNotification(n)
+	}
+}
+
+// deliverNotifications applies the LISTEN and UNLISTEN commands and sends the
+// notifications of the transactions the session has committed.
+func (c *pqConn) deliverNotifications() {
+	listens, notifications := c.session.TakeNotifications()
+	for _, l := range listens {
+		if l.Listen {
+			c.hub.listen(c, l.Channel)
+		} else {
+			c.hub.unlisten(c, l.Channel)
+		}
+	}
+	for _, n := range notifications {
+		n.PID = c.pid
+		c.hub.notify(n)
+	}
+}
+
+// queueNotification queues n for the client. An idle connection is woken to
+// send it straight away; a busy one sends it before the next ReadyForQuery,
+// so that it does not end up in the middle of a response. Either way the
+// notifying session never waits on this connection's client.
+func (c *pqConn) queueNotification(n sql.Notification) {
+	c.queueMu.Lock()
+	c.notifications = append(c.notifications, n)
+	c.queueMu.Unlock()
+
+	select {
+	case c.notifyPending <- struct{}{}:
+	default:
+	}
+}
+
+// notifyIdle sends the notifications queued while the connection is idle,
+// until it is closed.
+func (c *pqConn) notifyIdle() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.notifyPending:
+		}
+
+		c.notifyMu.Lock()
+		if c.idle {
+			err := c.sendNotifications()
+			if err == nil {
+				err = c.w.Flush()
+			}
+			if err != nil {
+				c.server.logf("failed to send notification: %v", err)
+			}
+		}
+		c.notifyMu.Unlock()
+	}
+}
+
+// sendNotifications writes the queued notifications. c.notifyMu must be held.
+func (c *pqConn) sendNotifications() error {
+	c.queueMu.Lock()
+	notifications := c.notifications
+	c.notifications = nil
+	c.queueMu.Unlock()
+
+	for _, n := range notifications {
+		c.writeBuf.initMsg(ServerMsgNotificationResponse)
+		c.writeBuf.putInt32(n.PID)
+		if err := c.writeBuf.writeClientString(n.Channel); err != nil {
+			return err
+		}
+		if err := c.writeBuf.writeClientString(n.Payload); err != nil {
+			return err
+		}
+		if err := c.writeBuf.finishMsg(c.w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package libpq
+
+import (
+	"crypto/tls"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/sql"
+	"log"
+)
+
+// An Option configures a Server.
+type Option func(*Server)
+
+// An Authenticator checks the password a client gives for its session. It
+// is given in clear text, so TLS should be used. Errors other than a
+// sql.PGError are reported as a failed password authentication.
+type Authenticator func(s *sql.Session, password string) error
+
+// Hooks are called as sessions come and go.
+type Hooks struct {
+	// OnConnect is called once a session has been authenticated and has
+	// its executor. An error refuses the connection.
+	OnConnect func(s *sql.Session) error
+
+	// OnDisconnect is called when a session which OnConnect accepted ends.
+	OnDisconnect func(s *sql.Session)
+}
+
+// WithExecutor makes all sessions share e.
+func WithExecutor(e executor.Executor) Option {
+	return func(s *Server) {
+		s.factory = func(*sql.Session) (executor.Executor, func(), error) {
+			return e, nil, nil
+		}
+	}
+}
+
+// WithExecutorFactory makes f create the executor of each session.
+func WithExecutorFactory(f ExecutorFactory) Option {
+	return func(s *Server) {
+		s.factory = f
+	}
+}
+
+// WithTLSConfig accepts SSL requests, encrypting the connection with
+// config.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithAuthenticator asks each client for a password and checks it with a.
+// Without it, clients are trusted.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.authenticator = a
+	}
+}
+
+// WithLogger logs to l rather than the standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithMaxMessageSize limits the size of the messages clients can send.
+// Connections sending a larger one are closed.
+func WithMaxMessageSize(n int) Option {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithConnectionLimits refuses sessions beyond limits with FATAL
+// too_many_connections errors.
+func WithConnectionLimits(limits ConnectionLimits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithMetrics counts the server's traffic in m, which may be shared with
+// other servers.
+func WithMetrics(m *Metrics) Option {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// WithHooks calls h as sessions come and go.
+func WithHooks(h Hooks) Option {
+	return func(s *Server) {
+		s.hooks = h
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"github.com/yydzero/mnt/util/datetime"
+	"github.com/yydzero/mnt/util/encoding"
 	"io"
 	"strconv"
 	"time"
@@ -23,6 +26,9 @@ const maxMessageSize = 1 << 24
 type readBuffer struct {
 	msg []byte
 	tmp [4]byte
+
+	// maxSize is the largest message accepted, or 0 for maxMessageSize.
+	maxSize int
 }
 
 // reset sets b.msg to exactly size, attempting to use spare capacity
@@ -58,8 +64,12 @@ func (b *readBuffer) readUntypedMsg(rd io.Reader) (int, error) {
 	}
 	size := int(binary.BigEndian.Uint32(b.tmp[:]))
 	size -= 4 // size includes itself.
-	if size > maxMessageSize || size < 0 {
-		return nread, fmt.Errorf("message size %d out of bounds (0..%d)", size, maxMessageSize)
+	maxSize := b.maxSize
+	if maxSize == 0 {
+		maxSize = maxMessageSize
+	}
+	if size > maxSize || size < 0 {
+		return nread, fmt.Errorf("message size %d out of bounds (0..%d)", size, maxSize)
 	}
 
 	b.reset(size)
@@ -128,6 +138,12 @@ func (b *readBuffer) getInt32() (int32, error) {
 type writeBuffer struct {
 	bytes.Buffer
 	putbuf [64]byte
+
+	// encoding is the client encoding text is converted to. nil means UTF8.
+	encoding *encoding.Encoding
+
+	// format controls the text format of date/time values.
+	format textFormat
 }
 
 // writeString writes a null-terminated string.
@@ -138,6 +154,33 @@ func (b *writeBuffer) writeString(s string) error {
 	return b.WriteByte(0)
 }
 
+// writeClientString writes a null-terminated string converted to the client
+// encoding. Characters the client encoding cannot represent are replaced, so
+// it is only used for names and messages, never for data.
+func (b *writeBuffer) writeClientString(s string) error {
+	if b.encoding == nil {
+		return b.writeString(s)
+	}
+	if _, err := b.Write(b.encoding.EncodeLossy(s)); err != nil {
+		return err
+	}
+	return b.WriteByte(0)
+}
+
+// writeErrorFields writes the fields of an ErrorResponse or NoticeResponse,
+// followed by the terminating zero byte.
+func (b *writeBuffer) writeErrorFields(fields []sql.PGErrorField) error {
+	for _, f := range fields {
+		if err := b.WriteByte(f.Type); err != nil {
+			return err
+		}
+		if err := b.writeClientString(f.Value); err != nil {
+			return err
+		}
+	}
+	return b.WriteByte(0)
+}
+
 func (b *writeBuffer) putInt16(v int16) {
 	binary.BigEndian.PutUint16(b.putbuf[:], uint16(v))
 	b.Write(b.putbuf[:2])
@@ -216,26 +259,34 @@ func (b *writeBuffer) writeTextDatum(d parser.Datum) error {
 		return err
 
 	case parser.DString:
+		if b.encoding != nil {
+			s, err := b.encoding.Encode(string(v))
+			if err != nil {
+				return err
+			}
+			b.putInt32(int32(len(s)))
+			_, err = b.Write(s)
+			return err
+		}
 		b.putInt32(int32(len(v)))
 		_, err := b.WriteString(string(v))
 		return err
 
 	case parser.DDate:
 		t := time.Unix(int64(v) * secondsInDay, 0).UTC()
-		s := formatTs(t)
+		s := datetime.FormatDate(t, b.format.dateStyle)
 		b.putInt32(int32(len(s)))
-		_, err := b.Write(s)
+		_, err := b.WriteString(s)
 		return err
 
 	case parser.DTimestamp:
-		t := v.UTC()
-		s := formatTs(t)
+		s := datetime.FormatTimestamp(v.Time, b.format.dateStyle, b.format.loc())
 		b.putInt32(int32(len(s)))
-		_, err := b.Write(s)
+		_, err := b.WriteString(s)
 		return err
 
 	case parser.DInterval:
-		s := v.String()
+		s := v.Format(b.format.intervalStyle)
 		b.putInt32(int32(len(s)))
 		_, err := b.WriteString(s)
 		return err
@@ -1,12 +1,17 @@
 package libpq
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/catalog"
 	"io"
 	"net"
 	"github.com/yydzero/mnt/executor/fake"
+	"github.com/yydzero/mnt/sql"
 	"log"
+	"sync"
+	"time"
 )
 
 // ErrSSLRequired is returned when a client attemps to connect to a
@@ -14,9 +19,11 @@ import (
 const ErrSSLRequired = "cleartext connections are not permitted"
 
 const (
-	version30  = 0x30000
-	versionSSL = 0x4D2162F
-	versionQE  = 0x70030000
+	version30     = 0x30000
+	versionCancel = 0x4D2162E
+	versionSSL    = 0x4D2162F
+	versionGSSENC = 0x4D21630
+	versionQE     = 0x70030000
 )
 
 var (
@@ -24,18 +31,63 @@ var (
 	sslUnsupported = []byte{'N'}
 )
 
+// ExecutorFactory creates the executor of a session, once its startup
+// parameters have been applied. teardown, if not nil, is called when the
+// client disconnects. An error refuses the connection.
+type ExecutorFactory func(s *sql.Session) (e executor.Executor, teardown func(), err error)
+
 // Server implements the server side of the PostgreSQL wire protocol.
 type Server struct {
-	executor executor.Executor
+	// factory creates the executor of each session, which is wrapped to
+	// answer the catalog queries of client tools.
+	factory ExecutorFactory
+
+	tlsConfig      *tls.Config
+	authenticator  Authenticator
+	logger         *log.Logger
+	maxMessageSize int
+	limits         ConnectionLimits
+	hooks          Hooks
+	metrics        *Metrics
+
+	// hub and functions are shared by the connections of the server.
+	hub       *notificationHub
+	functions *functionRegistry
+
+	// mu guards the listeners and connections being served, which are
+	// closed on shutdown, and the sessions counted against the limits.
+	// conns maps each connection to its pqConn, once it has one.
+	mu         sync.Mutex
+	listeners  map[net.Listener]bool
+	conns      map[net.Conn]*pqConn
+	sessions   sessionCounts
+	inShutdown int32 // accessed atomically
 }
 
-func NewServer() Server {
-	s := Server{
-		executor: &fake.FakeExecutor{},
+// NewServer returns a Server configured with opts. By default each session
+// gets a fake executor, and clients are trusted.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		factory:   newFakeExecutor,
+		hub:       newNotificationHub(),
+		functions: newFunctionRegistry(),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]*pqConn),
+		sessions: sessionCounts{
+			byUser:     make(map[string]int),
+			byDatabase: make(map[string]int),
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	return s
 }
 
+func newFakeExecutor(*sql.Session) (executor.Executor, func(), error) {
+	return &fake.FakeExecutor{}, nil, nil
+}
+
 // IsPQConnection returns true if rd appears to be a Postgres connection.
 func IsPQConnection(rd io.Reader) bool {
 	var buf readBuffer
@@ -48,42 +100,260 @@ func IsPQConnection(rd io.Reader) bool {
 	if err != nil {
 		return false
 	}
-	return version == version30 || version == versionSSL
+	return version>>16 == 3 || version == versionCancel || version == versionSSL || version == versionGSSENC
 }
 
-// Serve serves a single connection, driving the handshake process
-// and delegating to the appropriate connection type.
-func (s *Server) Serve(conn net.Conn) error {
-	var buf readBuffer
-	_, err := buf.readUntypedMsg(conn)
+// logf logs with the server's logger, or the standard one.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Output(2, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, args...))
+}
+
+// ListenAndServe listens on the TCP address addr and serves the
+// connections made to it.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	s.logf("Listening on %s", l.Addr())
+	return s.Serve(l)
+}
 
-	log.Println("Processed startup message.")
+// Serve accepts connections on l and serves each in a goroutine of its
+// own. Temporary accept errors, such as running out of file descriptors,
+// are retried after a growing delay; any other ends Serve. After Shutdown
+// or Close, it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
 
-	version, err := buf.getInt32()
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrackConn(conn)
+			if err := s.serveConn(conn); err != nil && err != io.EOF && !s.shuttingDown() {
+				s.logf("failed to handle a connection: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single connection, driving the handshake process
+// and delegating to the appropriate connection type. conn is closed when it
+// returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+	if !s.trackConn(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackConn(conn)
+	return s.serveConn(conn)
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	raw := conn
+	metrics := s.metrics.port(conn.LocalAddr())
+	metrics.connect()
+	defer metrics.disconnect()
+	conn = metrics.countBytes(conn)
+
+	buf := readBuffer{maxSize: s.maxMessageSize}
+	var version int32
+	for {
+		_, err := buf.readUntypedMsg(conn)
+		if err != nil {
+			return err
+		}
+
+		s.logf("Processed startup message.")
+
+		version, err = buf.getInt32()
+		if err != nil {
+			return err
+		}
+
+		s.logf("libpq version = %d", version)
+
+		if version == versionSSL && s.tlsConfig != nil {
+			if _, err := conn.Write(sslSupported); err != nil {
+				return err
+			}
+			conn = tls.Server(conn, s.tlsConfig)
+			continue
+		}
+		if version != versionSSL && version != versionGSSENC {
+			break
+		}
+		// GSSAPI encryption is not supported, nor SSL without a TLS config.
+		// The client may carry on in the clear, with a new startup packet.
+		if _, err := conn.Write(sslUnsupported); err != nil {
+			return err
+		}
+	}
+
+	// No BackendKeyData is sent, so a CancelRequest cannot name a session
+	// here. As PostgreSQL does for an unknown key, the connection is closed
+	// without a reply.
+	if version == versionCancel {
+		conn.Close()
+		return nil
+	}
+
+	// Only version 3.0 of the protocol is supported, plus the QE's. Clients
+	// asking for a later 3.x are told to fall back to 3.0.
+	if version != versionQE && version>>16 != 3 {
+		defer conn.Close()
+		return sendStartupError(conn, metrics, sql.NewPGError(sql.CodeFeatureNotSupportedError,
+			"unsupported frontend protocol %d.%d: server supports 3.0 to 3.0", version>>16, version&0xffff))
+	}
+
+	sessionArgs, protocolOptions, argsErr := parseOptions(buf.msg)
+
+	// Make a connection regardless of argsErr. If there was an error parsing
+	// the args, the connection will only be used to send a report of that error.
+	pqConn := newPQConn(conn, s, sessionArgs)
+	pqConn.metrics = metrics
+	defer pqConn.close()
+	s.setPQConn(raw, pqConn)
+
+	// The client learns which protocol is spoken before anything else,
+	// even an error in the startup packet.
+	if version != versionQE && (version != version30 || len(protocolOptions) > 0) {
+		if err := pqConn.sendNegotiateProtocolVersion(protocolOptions); err != nil {
+			return err
+		}
+	}
+
+	if argsErr == nil {
+		argsErr = pqConn.session.InitVars(sessionArgs)
+	}
+	if argsErr != nil {
+		return sendStartupError(conn, metrics, argsErr)
+	}
+
+	if s.authenticator != nil {
+		if err := pqConn.authenticate(s.authenticator); err != nil {
+			return sendStartupError(conn, metrics, err)
+		}
+	}
+
+	if err := s.acquireSession(pqConn.session); err != nil {
+		return sendStartupError(conn, metrics, err)
+	}
+	defer s.releaseSession(pqConn.session)
+
+	e, teardown, err := s.factory(pqConn.session)
 	if err != nil {
-		return err
+		return sendStartupError(conn, metrics, err)
 	}
+	pqConn.executor = catalog.New(e, pgTypes, datumOid)
+	pqConn.teardown = teardown
 
-	log.Printf("libpq version = %d\n", version)
+	if s.hooks.OnConnect != nil {
+		if err := s.hooks.OnConnect(pqConn.session); err != nil {
+			return sendStartupError(conn, metrics, err)
+		}
+	}
+	if s.hooks.OnDisconnect != nil {
+		defer s.hooks.OnDisconnect(pqConn.session)
+	}
 
+	return pqConn.serve()
+}
 
-	if version == version30 || version == versionQE {
-		sessionArgs, argsErr := parseOptions(buf.msg)
+// authenticate asks the client for its password in clear text, and checks
+// it with auth.
+func (c *pqConn) authenticate(auth Authenticator) error {
+	c.writeBuf.initMsg(ServerMsgAuth)
+	c.writeBuf.putInt32(AuthCleartextPassword)
+	if err := c.writeBuf.finishMsg(c.w); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
 
-		// Make a connection regardless of argsErr. If there was an error parsing
-		// the args, the connection will only be used to send a report of that error.
-		pqConn := newPQConn(conn, s.executor, sessionArgs)
-		defer pqConn.close()
+	typ, _, err := c.readBuf.readTypedMsg(c.r)
+	if err != nil {
+		return err
+	}
+	c.metrics.message(typ)
+	if typ != ClientMsgPassword {
+		return sql.NewPGError(sql.CodeProtocolViolationError, "expected password response, got message type %c", typ)
+	}
+	password, err := c.readBuf.getString()
+	if err != nil {
+		return err
+	}
 
-		if argsErr != nil {
-			return pqConn.sendInternalError(err.Error())
+	if err := auth(c.session, password); err != nil {
+		if _, ok := err.(*sql.PGError); ok {
+			return err
 		}
+		return sql.NewPGError(sql.CodeInvalidPasswordError, "password authentication failed for user %q", c.session.User)
+	}
+	return nil
+}
+
+// sendStartupError sends err as a FATAL ErrorResponse to a client which is
+// refused before its connection is set up, counting it in metrics.
+func sendStartupError(w io.Writer, metrics *portMetrics, err error) error {
+	e := *sql.ToPGError(err)
+	e.Severity = sql.SeverityFatal
+	metrics.reject(e.Code)
 
-		return pqConn.serve(nil)
+	var buf writeBuffer
+	buf.initMsg(ServerMsgErrorResponse)
+	if err := buf.writeErrorFields(e.Fields()); err != nil {
+		return err
 	}
+	return buf.finishMsg(w)
+}
 
-	return fmt.Errorf("unknow protocol version %d", version)
+// sendNegotiateProtocolVersion tells the client that the server only supports
+// protocol 3.0, and none of the protocol options it asked for. It is flushed
+// at once, ahead of any startup error sent straight to the connection.
+func (c *pqConn) sendNegotiateProtocolVersion(protocolOptions []string) error {
+	c.writeBuf.initMsg(ServerMsgNegotiateProtocol)
+	c.writeBuf.putInt32(version30 & 0xffff)
+	c.writeBuf.putInt32(int32(len(protocolOptions)))
+	for _, name := range protocolOptions {
+		if err := c.writeBuf.writeString(name); err != nil {
+			return err
+		}
+	}
+	if err := c.writeBuf.finishMsg(c.w); err != nil {
+		return err
+	}
+	return c.w.Flush()
 }
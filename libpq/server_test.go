@@ -0,0 +1,583 @@
+package libpq_test
+
+import (
+	. "github.com/yydzero/mnt/libpq"
+
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	dbsql "database/sql"
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/fake"
+	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// pipeWire serves a connection of its own with s.
+func pipeWire(s *Server) *wireConn {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return &wireConn{conn: client, r: bufio.NewReader(client)}
+}
+
+// listen serves s on a port of its own, returning the port.
+func listen(s *Server) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	Expect(err).ShouldNot(HaveOccurred())
+	go s.Serve(l)
+	_, p, err := net.SplitHostPort(l.Addr().String())
+	Expect(err).ShouldNot(HaveOccurred())
+	return p
+}
+
+// selfSignedConfig returns a TLS config with a throwaway certificate.
+func selfSignedConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	Expect(err).ShouldNot(HaveOccurred())
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// flakyListener fails Accept with the given errors, then with closed.
+type flakyListener struct {
+	net.Listener
+	errs    []error
+	accepts int
+}
+
+var errClosed = errors.New("closed")
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if len(l.errs) == 0 {
+		return nil, errClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *flakyListener) Close() error {
+	return nil
+}
+
+// blockingExecutor runs "SLEEP" until released, signalling started once it
+// has begun.
+type blockingExecutor struct {
+	fake.FakeExecutor
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingExecutor) ExecuteStatements(ctx context.Context, stmts string, params []parser.Datum) executor.StatementResults {
+	if stmts == "SLEEP" {
+		close(e.started)
+		<-e.release
+	}
+	return e.FakeExecutor.ExecuteStatements(ctx, stmts, params)
+}
+
+// closingExecutor counts the Close calls of the statements it prepares.
+type closingExecutor struct {
+	fake.FakeExecutor
+	closes int32
+}
+
+type closingStatement struct {
+	executor.PreparedStatement
+	closes *int32
+}
+
+func (s *closingStatement) Close() {
+	atomic.AddInt32(s.closes, 1)
+	s.PreparedStatement.Close()
+}
+
+func (e *closingExecutor) Prepare(ctx context.Context, query string, args parser.MapArgs) (executor.PreparedStatement, error) {
+	stmt, err := e.FakeExecutor.Prepare(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &closingStatement{stmt, &e.closes}, nil
+}
+
+func (e *closingExecutor) closed() int32 {
+	return atomic.LoadInt32(&e.closes)
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+var _ = Describe("Server", func() {
+	It("should create an executor for each session and tear it down", func() {
+		var sessions []*sql.Session
+		torndown := make(chan *sql.Session, 2)
+		s := NewServer(WithExecutorFactory(func(session *sql.Session) (executor.Executor, func(), error) {
+			sessions = append(sessions, session)
+			return &fake.FakeExecutor{}, func() { torndown <- session }, nil
+		}))
+
+		w := pipeWire(s)
+		w.startup(0x30000, "application_name", "factory")
+		Expect(types(w.untilReady())).Should(ContainSubstring("Z"))
+		Expect(sessions).Should(HaveLen(1))
+		Expect(sessions[0].User).Should(Equal("pqgotest"))
+		Expect(sessions[0].Database).Should(Equal("pqgotest"))
+		Expect(sessions[0].GetVar("application_name")).Should(Equal("factory"))
+		Expect(sessions[0].RemoteAddr).ShouldNot(BeNil())
+
+		Expect(types(w.query("SELECT name FROM users"))).Should(Equal("TDDDCZ"))
+		w.close()
+		Eventually(torndown).Should(Receive(Equal(sessions[0])))
+	})
+
+	It("should close each prepared statement once all its references are gone", func() {
+		e := &closingExecutor{}
+		s := NewServer(WithExecutorFactory(func(*sql.Session) (executor.Executor, func(), error) {
+			return e, nil, nil
+		}))
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+
+		// Close of a statement without portals.
+		w.parse("s1", usersQuery, 20)
+		w.closeMsg('S', "s1")
+		Expect(types(w.sync())).Should(Equal("13Z"))
+		Expect(e.closed()).Should(Equal(int32(1)))
+
+		// Closing a statement closes its portals, and the handle once.
+		w.parse("s2", usersQuery, 20)
+		w.bind("p2", "s2", []byte("20"))
+		w.closeMsg('S', "s2")
+		Expect(types(w.sync())).Should(Equal("123Z"))
+		Expect(e.closed()).Should(Equal(int32(2)))
+
+		// A portal keeps the unnamed statement a Parse replaced open until
+		// the portal is closed too.
+		Expect(types(w.query("BEGIN"))).Should(Equal("CZ"))
+		w.parse("", usersQuery, 20)
+		w.bind("p3", "", []byte("20"))
+		w.parse("", usersQuery, 20)
+		Expect(types(w.sync())).Should(Equal("121Z"))
+		Expect(e.closed()).Should(Equal(int32(2)))
+		w.closeMsg('P', "p3")
+		Expect(types(w.sync())).Should(Equal("3Z"))
+		Expect(e.closed()).Should(Equal(int32(3)))
+		Expect(types(w.query("COMMIT"))).Should(Equal("CZ"))
+
+		// The statements left, s4 and the unnamed one, are closed on
+		// disconnect.
+		w.parse("s4", usersQuery, 20)
+		Expect(types(w.sync())).Should(Equal("1Z"))
+		w.close()
+		Eventually(e.closed).Should(Equal(int32(5)))
+		Consistently(e.closed).Should(Equal(int32(5)))
+	})
+
+	It("should refuse the connection if the factory fails", func() {
+		s := NewServer(WithExecutorFactory(func(*sql.Session) (executor.Executor, func(), error) {
+			return nil, nil, sql.NewPGError(sql.CodeInvalidParameterValueError, "no executor for you")
+		}))
+		w := pipeWire(s)
+		w.startup(0x30000)
+		msg := w.receive()
+		Expect(msg.typ).Should(Equal(byte('E')))
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'M')).Should(Equal("no executor for you"))
+
+		s = NewServer(WithExecutorFactory(func(*sql.Session) (executor.Executor, func(), error) {
+			return nil, nil, errors.New("unavailable")
+		}))
+		w = pipeWire(s)
+		w.startup(0x30000)
+		Expect(errorField(w.receive(), 'M')).Should(Equal("unavailable"))
+	})
+
+	It("should share an executor given with WithExecutor", func() {
+		s := NewServer(WithExecutor(&fake.FakeExecutor{}))
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+		Expect(types(w.query("RAISE 'shared'"))).Should(Equal("EZ"))
+		w.close()
+	})
+
+	It("should ask for a password with an authenticator", func() {
+		s := NewServer(WithAuthenticator(func(session *sql.Session, password string) error {
+			if password != "secret" {
+				return errors.New("wrong password")
+			}
+			return nil
+		}))
+
+		var b msgBuilder
+		b.str("secret")
+		w := pipeWire(s)
+		w.startup(0x30000)
+		msg := w.receive()
+		Expect(msg.typ).Should(Equal(byte('R')))
+		Expect(msg.body).Should(Equal([]byte{0, 0, 0, 3}))
+		w.send('p', b.Bytes())
+		Expect(w.receive().body).Should(Equal([]byte{0, 0, 0, 0}))
+		w.untilReady()
+		w.close()
+
+		b.Reset()
+		b.str("guess")
+		w = pipeWire(s)
+		w.startup(0x30000)
+		w.receive()
+		w.send('p', b.Bytes())
+		msg = w.receive()
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("28P01"))
+		Expect(errorField(msg, 'M')).Should(Equal(`password authentication failed for user "pqgotest"`))
+	})
+
+	It("should negotiate the protocol version before asking for a password", func() {
+		s := NewServer(WithAuthenticator(func(session *sql.Session, password string) error {
+			return nil
+		}))
+
+		w := pipeWire(s)
+		defer w.conn.Close()
+		w.startup(0x30002)
+		Expect(w.receive().typ).Should(Equal(byte('v')))
+		msg := w.receive()
+		Expect(msg.typ).Should(Equal(byte('R')))
+		Expect(msg.body).Should(Equal([]byte{0, 0, 0, 3}))
+	})
+
+	It("should close a CancelRequest without a reply", func() {
+		var b msgBuilder
+		b.int32(0x4D2162E)
+		b.int32(1)
+		b.int32(2)
+		w := pipeWire(NewServer())
+		defer w.conn.Close()
+		w.sendUntyped(b.Bytes())
+		_, err := w.r.ReadByte()
+		Expect(err).Should(Equal(io.EOF))
+	})
+
+	It("should call hooks as sessions come and go", func() {
+		disconnected := make(chan string, 1)
+		s := NewServer(WithHooks(Hooks{
+			OnConnect: func(session *sql.Session) error {
+				if session.User == "nobody" {
+					return errors.New("go away")
+				}
+				return nil
+			},
+			OnDisconnect: func(session *sql.Session) {
+				disconnected <- session.User
+			},
+		}))
+
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+		w.close()
+		Eventually(disconnected).Should(Receive(Equal("pqgotest")))
+
+		w = pipeWire(s)
+		w.startup(0x30000, "user", "nobody")
+		Expect(errorField(w.receive(), 'M')).Should(Equal("go away"))
+		Consistently(disconnected).ShouldNot(Receive())
+	})
+
+	It("should close connections sending messages over the size limit", func() {
+		s := NewServer(WithMaxMessageSize(64))
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+
+		// A Query of 256 bytes.
+		go w.conn.Write([]byte{'Q', 0, 0, 1, 0})
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should serve TLS connections with a TLS config", func() {
+		p := listen(NewServer(WithTLSConfig(selfSignedConfig())))
+		db, err := dbsql.Open("postgres", fmt.Sprintf("user=pqgotest dbname=pqgotest host=localhost port=%s sslmode=require", p))
+		Expect(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+
+		var name, description string
+		var age int
+		Expect(db.QueryRow("SELECT name FROM users").Scan(&name, &age, &description)).Should(Succeed())
+		Expect(name).Should(Equal("xiaowang"))
+	})
+
+	It("should retry temporary accept errors", func() {
+		l := &flakyListener{errs: []error{temporaryError{}, temporaryError{}}}
+		Expect(NewServer().Serve(l)).Should(Equal(errClosed))
+		Expect(l.accepts).Should(Equal(3))
+	})
+
+	It("should let statements finish on shutdown and terminate idle sessions", func() {
+		e := &blockingExecutor{started: make(chan struct{}), release: make(chan struct{})}
+		s := NewServer(WithExecutor(e))
+		l, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ShouldNot(HaveOccurred())
+		served := make(chan error, 1)
+		go func() { served <- s.Serve(l) }()
+
+		idle := pipeWire(s)
+		idle.startup(0x30000)
+		idle.untilReady()
+		busy := pipeWire(s)
+		busy.startup(0x30000)
+		busy.untilReady()
+		var b msgBuilder
+		b.str("SLEEP")
+		busy.send('Q', b.Bytes())
+		Eventually(e.started).Should(BeClosed())
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- s.Shutdown(context.Background()) }()
+		Eventually(served).Should(Receive(Equal(ErrServerClosed)))
+
+		msg := idle.receive()
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("57P01"))
+		Consistently(shutdown).ShouldNot(Receive())
+
+		close(e.release)
+		msgs := []wireMsg{busy.receive(), busy.receive(), busy.receive(), busy.receive(), busy.receive(), busy.receive()}
+		Expect(types(msgs)).Should(Equal("TDDDCE"))
+		Expect(errorField(msgs[5], 'C')).Should(Equal("57P01"))
+		Eventually(shutdown).Should(Receive(BeNil()))
+
+		client, server := net.Pipe()
+		defer client.Close()
+		Expect(s.ServeConn(server)).Should(Equal(ErrServerClosed))
+	})
+
+	It("should terminate idle sessions concurrently on shutdown", func() {
+		s := NewServer()
+		// None of the clients reads the termination, so each write waits
+		// for its deadline.
+		for i := 0; i < 3; i++ {
+			w := pipeWire(s)
+			w.startup(0x30000)
+			w.untilReady()
+			defer w.conn.Close()
+		}
+		// Nor does a connection which never finishes starting up hold it up.
+		// The write returns once the server is reading the packet.
+		starting := pipeWire(s)
+		defer starting.conn.Close()
+		_, err := starting.conn.Write([]byte{0, 0, 0, 8})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		start := time.Now()
+		Expect(s.Shutdown(context.Background())).Should(Succeed())
+		Expect(time.Since(start)).Should(BeNumerically("<", 2500*time.Millisecond))
+	})
+
+	It("should terminate busy sessions when shutdown runs out of time", func() {
+		s := NewServer()
+		busy := pipeWire(s)
+		busy.startup(0x30000)
+		busy.untilReady()
+		var b msgBuilder
+		b.str("SELECT pg_sleep(10)")
+		busy.send('Q', b.Bytes())
+		// A session in the middle of an extended query is busy too.
+		pipelining := pipeWire(s)
+		pipelining.startup(0x30000)
+		pipelining.untilReady()
+		pipelining.parse("", usersQuery)
+
+		// The clients read until the server closes the connection, keeping
+		// the last message.
+		var lasts []chan wireMsg
+		for _, w := range []*wireConn{busy, pipelining} {
+			last := make(chan wireMsg, 1)
+			go func(w *wireConn) {
+				var msg wireMsg
+				for {
+					m, err := w.tryReceive()
+					if err != nil {
+						last <- msg
+						return
+					}
+					msg = m
+				}
+			}(w)
+			lasts = append(lasts, last)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(s.Shutdown(ctx)).Should(Equal(context.DeadlineExceeded))
+
+		for _, last := range lasts {
+			var msg wireMsg
+			Eventually(last).Should(Receive(&msg))
+			Expect(msg.typ).Should(Equal(byte('E')))
+			Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+			Expect(errorField(msg, 'C')).Should(Equal("57P01"))
+		}
+	})
+
+	It("should not hold up a NOTIFY on a listener which does not read", func() {
+		s := NewServer()
+		defer s.Close()
+		listener := pipeWire(s)
+		listener.startup(0x30000)
+		listener.untilReady()
+		Expect(types(listener.query("LISTEN jobs"))).Should(Equal("CZ"))
+		defer listener.conn.Close()
+
+		// The pipe is unbuffered, so writing to the listener blocks.
+		sender := pipeWire(s)
+		sender.startup(0x30000)
+		sender.untilReady()
+		done := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+			sender.query("NOTIFY jobs, 'one'")
+			done <- types(sender.query("NOTIFY jobs, 'two'"))
+		}()
+		Eventually(done).Should(Receive(Equal("CZ")))
+
+		// The listener gets both once it reads again.
+		msg := listener.receive()
+		Expect(string(msg.typ)).Should(Equal("A"))
+		Expect(msg.body).Should(ContainSubstring("one"))
+		msg = listener.receive()
+		Expect(string(msg.typ)).Should(Equal("A"))
+		Expect(msg.body).Should(ContainSubstring("two"))
+	})
+
+	It("should close all connections on Close", func() {
+		s := NewServer()
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+
+		Expect(s.Close()).Should(Succeed())
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should serve Unix domain sockets with a lock file", func() {
+		dir, err := ioutil.TempDir("", "mnt")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, ".s.PGSQL.5999")
+		Expect(UnixSocketPath(dir, 5999)).Should(Equal(path))
+
+		s := NewServer()
+		served := make(chan error, 1)
+		go func() { served <- s.ListenAndServeUnix(dir, 5999) }()
+		Eventually(func() error { _, err := os.Stat(path); return err }).Should(Succeed())
+		lock, err := ioutil.ReadFile(path + ".lock")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(lock)).Should(HavePrefix(strconv.Itoa(os.Getpid()) + "\n"))
+
+		db, err := dbsql.Open("postgres", fmt.Sprintf("user=pqgotest dbname=pqgotest host=%s port=5999 sslmode=disable", dir))
+		Expect(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		var name, description string
+		var age int
+		Expect(db.QueryRow("SELECT name FROM users").Scan(&name, &age, &description)).Should(Succeed())
+
+		_, err = ListenUnix(dir, 5999)
+		Expect(err).Should(MatchError(ContainSubstring("already exists")))
+
+		Expect(s.Close()).Should(Succeed())
+		Eventually(served).Should(Receive(Equal(ErrServerClosed)))
+		_, err = os.Stat(path)
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+		_, err = os.Stat(path + ".lock")
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("should replace the lock file and socket of a process which is gone", func() {
+		dir, err := ioutil.TempDir("", "mnt")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := UnixSocketPath(dir, 5999)
+		Expect(ioutil.WriteFile(path+".lock", []byte("2147483647\n"), 0600)).Should(Succeed())
+		Expect(ioutil.WriteFile(path, nil, 0600)).Should(Succeed())
+
+		l, err := ListenUnix(dir, 5999)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(l.Close()).Should(Succeed())
+	})
+
+	It("should refuse connections beyond the limits with too_many_connections", func() {
+		refusal := func(s *Server, params ...string) string {
+			w := pipeWire(s)
+			w.startup(0x30000, params...)
+			msgs := w.untilReadyOrError()
+			last := msgs[len(msgs)-1]
+			if last.typ == 'Z' {
+				return ""
+			}
+			Expect(errorField(last, 'S')).Should(Equal("FATAL"))
+			Expect(errorField(last, 'C')).Should(Equal("53300"))
+			return errorField(last, 'M')
+		}
+
+		s := NewServer(WithConnectionLimits(ConnectionLimits{
+			MaxConnections:               2,
+			SuperuserReservedConnections: 1,
+			Superusers:                   []string{"gpadmin"},
+		}))
+		Expect(refusal(s)).Should(BeEmpty())
+		Expect(refusal(s)).Should(Equal("remaining connection slots are reserved for non-replication superuser connections"))
+		Expect(refusal(s, "user", "gpadmin")).Should(BeEmpty())
+		Expect(refusal(s, "user", "gpadmin")).Should(Equal("sorry, too many clients already"))
+		s.Close()
+
+		s = NewServer(WithConnectionLimits(ConnectionLimits{
+			PerUser:     map[string]int{"pqgotest": 1},
+			PerDatabase: map[string]int{"db2": 1},
+		}))
+		w := pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+		Expect(refusal(s)).Should(Equal(`too many connections for role "pqgotest"`))
+		Expect(refusal(s, "user", "u2", "database", "db2")).Should(BeEmpty())
+		Expect(refusal(s, "user", "u3", "database", "db2")).Should(Equal(`too many connections for database "db2"`))
+
+		// A session which ends frees its slot.
+		w.close()
+		Eventually(func() string { return refusal(s) }).Should(BeEmpty())
+		s.Close()
+	})
+})
@@ -0,0 +1,206 @@
+package libpq
+
+import (
+	"errors"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ServeConn after Shutdown or Close.
+var ErrServerClosed = errors.New("libpq: Server closed")
+
+// shutdownPollInterval is how often Shutdown looks for sessions which have
+// become idle.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// shutdownWriteTimeout limits the time spent telling a client that its
+// session is being terminated.
+const shutdownWriteTimeout = time.Second
+
+// Shutdown stops the server gracefully. It closes the listeners and the
+// connections still starting up, then terminates each session with a FATAL
+// admin_shutdown error once it is idle, letting statements in progress
+// finish. If ctx is done first, the remaining sessions have their statements
+// canceled and are terminated at once, and its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.beginShutdown()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.terminateIdle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.terminateAll()
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server immediately, closing its listeners and all its
+// connections.
+func (s *Server) Close() error {
+	s.beginShutdown()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// beginShutdown refuses new connections and closes the listeners.
+func (s *Server) beginShutdown() {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// terminateIdle terminates the idle sessions. It reports whether all
+// connections are gone.
+func (s *Server) terminateIdle() bool {
+	conns, ok := s.trackedSessions()
+	if ok {
+		return true
+	}
+	eachConn(conns, func(c *pqConn) { c.terminateIfIdle() })
+	return false
+}
+
+// terminateAll terminates every session, once Shutdown has run out of time.
+func (s *Server) terminateAll() {
+	conns, _ := s.trackedSessions()
+	eachConn(conns, (*pqConn).terminate)
+}
+
+// trackedSessions returns the pqConns of the connections, closing those still
+// starting up, which would otherwise hold up the shutdown until they fail
+// or finish authenticating. It reports whether no connections are left.
+func (s *Server) trackedSessions() ([]*pqConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []*pqConn
+	for conn, c := range s.conns {
+		if c == nil {
+			conn.Close()
+			continue
+		}
+		conns = append(conns, c)
+	}
+	return conns, len(s.conns) == 0
+}
+
+// eachConn calls f for each of conns concurrently. Writing to a slow client
+// must hold up neither the server's lock nor the termination of the other
+// sessions.
+func eachConn(conns []*pqConn, f func(*pqConn)) {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *pqConn) {
+			defer wg.Done()
+			f(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.Close()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.conns[conn] = nil
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+}
+
+// setPQConn records the pqConn serving conn, so that Shutdown can
+// terminate it.
+func (s *Server) setPQConn(conn net.Conn, c *pqConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = c
+}
+
+// terminateIfIdle terminates the session if it is waiting for a query, and
+// reports whether it did. One which is busy is terminated by the main loop
+// before its next ReadyForQuery.
+func (c *pqConn) terminateIfIdle() bool {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	if !c.idle {
+		return false
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(shutdownWriteTimeout))
+	if err := c.sendAdminShutdown(); err != nil {
+		c.server.logf("failed to terminate session: %v", err)
+	}
+	c.idle = false
+	c.terminated = true
+	c.conn.Close()
+	return true
+}
+
+// terminate terminates the session, idle or not. A busy session has its
+// statement canceled and its wait for the next message cut short, so that
+// the main loop sends the FATAL error, as only it may write then. It is
+// given shutdownWriteTimeout to do so.
+func (c *pqConn) terminate() {
+	if c.terminateIfIdle() {
+		return
+	}
+	c.cancel()
+	c.conn.SetWriteDeadline(time.Now().Add(shutdownWriteTimeout))
+	c.conn.SetReadDeadline(time.Now())
+	select {
+	case <-c.done:
+	case <-time.After(shutdownWriteTimeout):
+	}
+}
+
+// sendAdminShutdown tells the client that the session is being terminated.
+func (c *pqConn) sendAdminShutdown() error {
+	return c.sendFatal(sql.NewPGError(sql.CodeAdminShutdownError, "terminating connection due to administrator command"))
+}
@@ -0,0 +1,114 @@
+package libpq
+
+import (
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/sql"
+	"golang.org/x/net/context"
+	"net"
+	"time"
+)
+
+// errStatementTimeout replaces the error of a statement which failed after
+// statement_timeout canceled it.
+var errStatementTimeout = sql.NewPGError(sql.CodeQueryCanceledError, "canceling statement due to statement timeout")
+
+// timeoutVar returns the value of a timeout parameter, zero meaning none.
+func (c *pqConn) timeoutVar(name string) time.Duration {
+	v, err := c.session.GetVar(name)
+	if err != nil {
+		return 0
+	}
+	d, err := sql.ParseMillis(v)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// statementContext returns the context to run a statement in, which is
+// canceled once statement_timeout has passed.
+func (c *pqConn) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := c.timeoutVar("statement_timeout"); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// statementTimedOut replaces the errors of results which failed because
+// statement_timeout expired, as the executor returns them, with a
+// query_canceled error.
+func statementTimedOut(ctx context.Context, results executor.ResultList) {
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Err = errStatementTimeout
+		}
+	}
+}
+
+// setIdleDeadline sets the deadline for the client's next command, as
+// idle_in_transaction_session_timeout or idle_session_timeout allow, and
+// returns the error to terminate the session with when it passes. With
+// neither set, any deadline is cleared.
+func (c *pqConn) setIdleDeadline() (*sql.PGError, error) {
+	var timeout time.Duration
+	var e *sql.PGError
+	switch c.session.TxnState.State {
+	case sql.Open, sql.Aborted:
+		timeout = c.timeoutVar("idle_in_transaction_session_timeout")
+		e = sql.NewPGError(sql.CodeIdleInTransactionSessionTimeoutError,
+			"terminating connection due to idle-in-transaction timeout")
+	default:
+		timeout = c.timeoutVar("idle_session_timeout")
+		e = sql.NewPGError(sql.CodeIdleSessionTimeoutError,
+			"terminating connection due to idle-session timeout")
+	}
+	if timeout <= 0 {
+		return nil, c.clearReadDeadline()
+	}
+	c.readDeadline = true
+	return e, c.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// clearReadDeadline clears the deadline set by setIdleDeadline, so that
+// the rest of an extended query is not cut short.
+func (c *pqConn) clearReadDeadline() error {
+	if !c.readDeadline {
+		return nil
+	}
+	c.readDeadline = false
+	return c.conn.SetReadDeadline(time.Time{})
+}
+
+// isTimeout reports whether err is a read which hit its deadline.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// terminateIdleSession terminates the session with e, the error of the idle
+// timeout which expired.
+func (c *pqConn) terminateIdleSession(e *sql.PGError) error {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.idle = false
+	return c.sendFatal(e)
+}
+
+// sendFatal sends e as a FATAL error and flushes it, before the connection
+// is closed.
+func (c *pqConn) sendFatal(e *sql.PGError) error {
+	fatal := *e
+	fatal.Severity = sql.SeverityFatal
+	c.metrics.error(fatal.Code)
+	c.writeBuf.initMsg(ServerMsgErrorResponse)
+	if err := c.writeBuf.writeErrorFields(fatal.Fields()); err != nil {
+		return err
+	}
+	if err := c.writeBuf.finishMsg(c.w); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,135 @@
+package libpq_test
+
+import (
+	. "github.com/yydzero/mnt/libpq"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/executor/fake"
+	"github.com/yydzero/mnt/parser"
+	"golang.org/x/net/context"
+	"sync/atomic"
+	"time"
+)
+
+// slowBatchExecutor runs batches itself, taking as many milliseconds for
+// each set of parameters as its first parameter.
+type slowBatchExecutor struct {
+	fake.FakeExecutor
+	batches int32
+}
+
+func (e *slowBatchExecutor) ExecuteBatch(ctx context.Context, stmt executor.PreparedStatement, params [][]parser.Datum) executor.ResultList {
+	atomic.AddInt32(&e.batches, 1)
+	var results executor.ResultList
+	for _, p := range params {
+		select {
+		case <-time.After(time.Duration(p[0].(parser.DInt)) * time.Millisecond):
+			results = append(results, e.Execute(ctx, stmt, p).ResultList...)
+		case <-ctx.Done():
+			return append(results, executor.Result{Err: ctx.Err()})
+		}
+	}
+	return results
+}
+
+var _ = Describe("Timeouts", func() {
+	var s *Server
+	var w *wireConn
+
+	BeforeEach(func() {
+		s = NewServer()
+		w = pipeWire(s)
+		w.startup(0x30000)
+		w.untilReady()
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("should cancel statements running longer than statement_timeout", func() {
+		Expect(types(w.query("SET statement_timeout = 50"))).Should(Equal("CZ"))
+
+		start := time.Now()
+		msgs := w.query("SELECT pg_sleep(10)")
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+		Expect(types(msgs)).Should(Equal("EZ"))
+		Expect(errorField(msgs[0], 'C')).Should(Equal("57014"))
+		Expect(errorField(msgs[0], 'M')).Should(Equal("canceling statement due to statement timeout"))
+
+		Expect(types(w.query("SELECT pg_sleep(0)"))).Should(Equal("TDCZ"))
+
+		// The timeout applies to the extended protocol too.
+		w.parse("", "SELECT pg_sleep(10)")
+		w.bind("", "", []byte("1"))
+		w.execute("", 0)
+		msgs = w.sync()
+		Expect(types(msgs)).Should(Equal("12EZ"))
+		Expect(errorField(msgs[2], 'C')).Should(Equal("57014"))
+	})
+
+	It("should allow a batch of Executes statement_timeout for each of them", func() {
+		e := &slowBatchExecutor{}
+		w := pipeWire(NewServer(WithExecutor(e)))
+		defer w.close()
+		w.startup(0x30000)
+		w.untilReady()
+		Expect(types(w.query("SET statement_timeout = 50"))).Should(Equal("CZ"))
+
+		// Longer than statement_timeout in all, but not any one Execute.
+		w.parse("ins", "INSERT INTO users VALUES ($1)", 20)
+		for _, ms := range []string{"30", "30", "30"} {
+			w.bind("", "ins", []byte(ms))
+			w.execute("", 0)
+		}
+		Expect(types(w.sync())).Should(Equal("12DDDC2DDDC2DDDCZ"))
+		Expect(atomic.LoadInt32(&e.batches)).Should(Equal(int32(1)))
+
+		// The batch is canceled once it runs longer than its Executes could
+		// have one by one.
+		for _, ms := range []string{"10", "1000"} {
+			w.bind("", "ins", []byte(ms))
+			w.execute("", 0)
+		}
+		msgs := w.sync()
+		Expect(types(msgs)).Should(Equal("2DDDC2EZ"))
+		Expect(errorField(msgs[6], 'C')).Should(Equal("57014"))
+	})
+
+	It("should terminate sessions idle in a transaction with idle_in_transaction_session_timeout", func() {
+		w.query("SET idle_in_transaction_session_timeout = 50")
+		Expect(types(w.query("SELECT 1"))).Should(Equal("TDDDCZ"))
+		time.Sleep(100 * time.Millisecond)
+
+		Expect(types(w.query("BEGIN"))).Should(Equal("CZ"))
+		msg := w.receive()
+		Expect(string(msg.typ)).Should(Equal("E"))
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("25P03"))
+		Expect(errorField(msg, 'M')).Should(Equal("terminating connection due to idle-in-transaction timeout"))
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should terminate idle sessions with idle_session_timeout", func() {
+		w.query("SET idle_session_timeout = 50")
+		msg := w.receive()
+		Expect(string(msg.typ)).Should(Equal("E"))
+		Expect(errorField(msg, 'S')).Should(Equal("FATAL"))
+		Expect(errorField(msg, 'C')).Should(Equal("57P05"))
+		Expect(errorField(msg, 'M')).Should(Equal("terminating connection due to idle-session timeout"))
+		_, err := w.r.ReadByte()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should not apply idle timeouts inside an extended query", func() {
+		w.query("SET idle_session_timeout = 200")
+		w.parse("", "SELECT 1")
+		time.Sleep(400 * time.Millisecond)
+		w.bind("", "", []byte("1"))
+		w.execute("", 0)
+		Expect(types(w.sync())).Should(Equal("12DDDCZ"))
+	})
+})
@@ -5,17 +5,35 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"github.com/lib/pq"
 	"github.com/lib/pq/oid"
+	"github.com/yydzero/mnt/executor/catalog"
 	"github.com/yydzero/mnt/parser"
+	"github.com/yydzero/mnt/util/datetime"
+	"github.com/yydzero/mnt/util/duration"
+	"math"
 	"reflect"
 	"strconv"
 	"time"
 )
 
-const pgTimeStampFormat = "2016-01-02 15:04:05.999999999-07:00"
 const secondsInDay = 24 * 60 * 60
 
+// textFormat holds the session settings which control the text format of
+// date/time and interval values, both in results and in parameters.
+type textFormat struct {
+	dateStyle     datetime.DateStyle
+	intervalStyle duration.Style
+	location      *time.Location
+}
+
+// loc returns the session time zone, UTC if none has been set.
+func (f textFormat) loc() *time.Location {
+	if f.location == nil {
+		return time.UTC
+	}
+	return f.location
+}
+
 // http://www.postgresql.org/docs/9.5/static/protocol-overview.html#PROTOCOL-FORMAT-CODES
 type formatCode int16
 
@@ -111,8 +129,32 @@ var (
 	}
 )
 
-// decodeOidDatum decodes bytes according to specified Oid and format code into a datum
-func decodeOidDatum(id oid.Oid, code formatCode, b []byte) (parser.Datum, error) {
+// pgTypes describes the types in oidToDatum, as reported by the emulated pg_type.
+var pgTypes = []catalog.Type{
+	{Oid: oid.T_bool, Name: "bool", Len: 1, Category: 'B'},
+	{Oid: oid.T_bytea, Name: "bytea", Len: -1, Category: 'U'},
+	{Oid: oid.T_int8, Name: "int8", Len: 8, Category: 'N'},
+	{Oid: oid.T_int2, Name: "int2", Len: 2, Category: 'N'},
+	{Oid: oid.T_int4, Name: "int4", Len: 4, Category: 'N'},
+	{Oid: oid.T_text, Name: "text", Len: -1, Category: 'S'},
+	{Oid: oid.T_float4, Name: "float4", Len: 4, Category: 'N'},
+	{Oid: oid.T_float8, Name: "float8", Len: 8, Category: 'N'},
+	{Oid: oid.T_varchar, Name: "varchar", Len: -1, Category: 'S'},
+	{Oid: oid.T_date, Name: "date", Len: 4, Category: 'D'},
+	{Oid: oid.T_timestamp, Name: "timestamp", Len: 8, Category: 'D'},
+	{Oid: oid.T_timestamptz, Name: "timestamptz", Len: 8, Category: 'D'},
+	{Oid: oid.T_interval, Name: "interval", Len: 16, Category: 'T'},
+	{Oid: oid.T_numeric, Name: "numeric", Len: -1, Category: 'N'},
+}
+
+// datumOid returns the OID of the type a datum is described with.
+func datumOid(d parser.Datum) oid.Oid {
+	return typeForDatum(d).oid
+}
+
+// decodeOidDatum decodes bytes according to specified Oid and format code into a datum.
+// Text format dates and timestamps are read according to f.
+func decodeOidDatum(id oid.Oid, code formatCode, b []byte, f textFormat) (parser.Datum, error) {
 	var d parser.Datum
 
 	switch id {
@@ -270,9 +312,9 @@ func decodeOidDatum(id oid.Oid, code formatCode, b []byte) (parser.Datum, error)
 	case oid.T_timestamp, oid.T_timestamptz:
 		switch code {
 		case formatText:
-			ts, err := parseTs(string(b))
+			ts, err := datetime.ParseTimestamp(string(b), f.dateStyle.Order, f.loc())
 			if err != nil {
-				return d, fmt.Errorf("could not parse string %q as timestamp", b)
+				return d, err
 			}
 			d = parser.DTimestamp{Time: ts}
 		default:
@@ -282,9 +324,9 @@ func decodeOidDatum(id oid.Oid, code formatCode, b []byte) (parser.Datum, error)
 	case oid.T_date:
 		switch code {
 		case formatText:
-			ts, err := parseTs(string(b))
+			ts, err := datetime.ParseDate(string(b), f.dateStyle.Order)
 			if err != nil {
-				return d, fmt.Errorf("could not parse string %q as date", b)
+				return d, err
 			}
 			daysSinceEpoch := ts.Unix() / secondsInDay
 			d = parser.DDate(daysSinceEpoch)
@@ -292,57 +334,35 @@ func decodeOidDatum(id oid.Oid, code formatCode, b []byte) (parser.Datum, error)
 			return d, fmt.Errorf("unsupported date format code: %d", code)
 		}
 
+	case oid.T_interval:
+		switch code {
+		case formatText:
+			dur, err := duration.ParseWithStyle(string(b), f.intervalStyle)
+			if err != nil {
+				return d, err
+			}
+			d = parser.DInterval{Duration: dur}
+		case formatBinary:
+			// Microseconds, days and months, as sent by interval_send.
+			if len(b) != 16 {
+				return d, fmt.Errorf("invalid binary interval length: %d", len(b))
+			}
+			micros := int64(binary.BigEndian.Uint64(b[:8]))
+			if micros > math.MaxInt64/int64(time.Microsecond) || micros < math.MinInt64/int64(time.Microsecond) {
+				return d, duration.ErrIntervalOverflow
+			}
+			d = parser.DInterval{Duration: duration.Duration{
+				Nanos:  micros * int64(time.Microsecond),
+				Days:   int64(int32(binary.BigEndian.Uint32(b[8:12]))),
+				Months: int64(int32(binary.BigEndian.Uint32(b[12:]))),
+			}}
+		default:
+			return d, fmt.Errorf("unsupported interval format code: %d", code)
+		}
+
 	default:
 		return d, fmt.Errorf("unsupported OID: %v", id)
 	}
 
 	return d, nil
 }
-
-// parseTs parses timestamps in any of the formats that PostgreSQL accepts over the wire protocol.
-//
-// PostgreSQL is lenient in what it accepts as a timestamp, so we must also be lenient.
-func parseTs(s string) (time.Time, error) {
-	// RFC3339Nano is sent by github.com/lib/pq (go).
-	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
-		return ts, nil
-	}
-
-	// pq.ParseTimestamp parses the timestamp format.
-	return pq.ParseTimestamp(nil, s)
-}
-
-// formatTs formats t into a format pq understands.
-func formatTs(t time.Time) (b []byte) {
-	// Need to send dates before 0001 A.D. with " BC" suffix, instead of the
-	// minus sign preferred by Go.
-	// Beware "0000" in ISO is "1 BC", "-0001" is "2 BC" and so on
-	bc := false
-	if t.Year() <= 0 {
-		// flip the year sign, and add 1, eg: "0" will be "1" and "-10" will be "11"
-		t = t.AddDate((-t.Year())*2+1, 0, 0)
-		bc = true
-	}
-
-	b = []byte(t.Format(pgTimeStampFormat))
-
-	_, offset := t.Zone()
-	offset = offset % 60
-	if offset != 0 {
-		// RFC3339Nano already printed the minus sign
-		if offset < 0 {
-			offset = -offset
-		}
-		b = append(b, ':')
-		if offset < 10 {
-			b = append(b, '0')
-		}
-		b = strconv.AppendInt(b, int64(offset), 10)
-	}
-
-	if bc {
-		b = append(b, " BC"...)
-	}
-
-	return b
-}
@@ -0,0 +1,133 @@
+package libpq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UnixSocketPath returns the path of the Unix domain socket for port in dir,
+// named as PostgreSQL names it, eg: /tmp/.s.PGSQL.5432. Clients connect to it
+// with host=dir.
+func UnixSocketPath(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf(".s.PGSQL.%d", port))
+}
+
+// ListenUnix listens on the Unix domain socket for port in dir. Like the
+// PostgreSQL server, it guards the socket with a lock file next to it,
+// holding the PID of the process, and fails if another live process holds
+// it. Closing the listener removes both files.
+func ListenUnix(dir string, port int) (net.Listener, error) {
+	path := UnixSocketPath(dir, port)
+	lockPath := path + ".lock"
+	if err := createLockFile(lockPath, path, dir, port); err != nil {
+		return nil, err
+	}
+
+	// A socket left behind by a process which is gone can be removed, as
+	// its lock file was.
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.Remove(lockPath)
+		return nil, err
+	}
+	// Any local user may connect, as with unix_socket_permissions 0777.
+	if err := os.Chmod(path, 0777); err != nil {
+		l.Close()
+		os.Remove(lockPath)
+		return nil, err
+	}
+	return &unixListener{Listener: l, lockPath: lockPath}, nil
+}
+
+// ListenAndServeUnix listens on the Unix domain socket for port in dir and
+// serves the connections made to it.
+func (s *Server) ListenAndServeUnix(dir string, port int) error {
+	l, err := ListenUnix(dir, port)
+	if err != nil {
+		return err
+	}
+	s.logf("Listening on %s", l.Addr())
+	return s.Serve(l)
+}
+
+// unixListener removes its lock file once closed.
+type unixListener struct {
+	net.Listener
+	lockPath string
+	once     sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		os.Remove(l.lockPath)
+	})
+	return err
+}
+
+// createLockFile creates the lock file of the socket at path. Its lines are
+// the PID, the data directory (empty), the start time, the port and the
+// socket directory, as in PostgreSQL's. A lock file whose process is gone is
+// replaced.
+func createLockFile(lockPath, path, dir string, port int) error {
+	contents := fmt.Sprintf("%d\n\n%d\n%d\n%s\n", os.Getpid(), time.Now().Unix(), port, dir)
+	for retried := false; ; retried = true {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(contents)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+			}
+			return err
+		}
+		if !os.IsExist(err) || retried {
+			return err
+		}
+
+		if pid, ok := lockOwner(lockPath); ok {
+			return fmt.Errorf("lock file %q already exists: is another server (PID %d) using socket file %q?",
+				lockPath, pid, path)
+		}
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// lockOwner returns the PID in a lock file, if that process is running.
+// Servers in this process hold their locks too.
+func lockOwner(lockPath string) (int, bool) {
+	b, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.SplitN(string(b), "\n", 2)[0])
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if pid == os.Getpid() {
+		return pid, true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, false
+	}
+	// Signal 0 checks that the process exists. EPERM means it does, but
+	// belongs to another user.
+	if err := p.Signal(syscall.Signal(0)); err != nil && !os.IsPermission(err) {
+		return 0, false
+	}
+	return pid, true
+}
@@ -0,0 +1,226 @@
+package libpq_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+)
+
+// wireConn speaks the protocol directly, for messages and sequences lib/pq
+// does not send.
+type wireConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type wireMsg struct {
+	typ  byte
+	body []byte
+}
+
+// dialWire connects and completes the startup, up to the first
+// ReadyForQuery.
+func dialWire() *wireConn {
+	w := connectWire()
+	w.startup(0x30000)
+	w.untilReady()
+	return w
+}
+
+// connectWire connects without sending a startup packet.
+func connectWire() *wireConn {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	Expect(err).ShouldNot(HaveOccurred())
+	return &wireConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// startup sends a startup packet for the test user and database, plus the
+// given name and value pairs.
+func (w *wireConn) startup(version int32, params ...string) {
+	var b msgBuilder
+	b.int32(version)
+	for _, p := range append([]string{"user", "pqgotest", "database", "pqgotest"}, params...) {
+		b.str(p)
+	}
+	b.str("")
+	w.sendUntyped(b.Bytes())
+}
+
+// sendUntyped sends a message without a type, as in the startup phase.
+func (w *wireConn) sendUntyped(body []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)+4))
+	_, err := w.conn.Write(append(length, body...))
+	Expect(err).ShouldNot(HaveOccurred())
+}
+
+func (w *wireConn) close() {
+	w.send('X', nil)
+	w.conn.Close()
+}
+
+func (w *wireConn) send(typ byte, body []byte) {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	_, err := w.conn.Write(append(msg, body...))
+	Expect(err).ShouldNot(HaveOccurred())
+}
+
+func (w *wireConn) receive() wireMsg {
+	msg, err := w.tryReceive()
+	Expect(err).ShouldNot(HaveOccurred())
+	return msg
+}
+
+// tryReceive is like receive, but returns the error of a failed read, so
+// that it can be called outside of the test's goroutine.
+func (w *wireConn) tryReceive() (wireMsg, error) {
+	typ, err := w.r.ReadByte()
+	if err != nil {
+		return wireMsg{}, err
+	}
+	length := make([]byte, 4)
+	if _, err = io.ReadFull(w.r, length); err != nil {
+		return wireMsg{}, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(length)-4)
+	if _, err = io.ReadFull(w.r, body); err != nil {
+		return wireMsg{}, err
+	}
+	return wireMsg{typ, body}, nil
+}
+
+// untilReady returns the messages received up to and including the next
+// ReadyForQuery.
+func (w *wireConn) untilReady() []wireMsg {
+	var msgs []wireMsg
+	for {
+		msg := w.receive()
+		msgs = append(msgs, msg)
+		if msg.typ == 'Z' {
+			return msgs
+		}
+	}
+}
+
+// untilReadyOrError returns the messages received up to and including the
+// next ReadyForQuery or ErrorResponse.
+func (w *wireConn) untilReadyOrError() []wireMsg {
+	var msgs []wireMsg
+	for {
+		msg := w.receive()
+		msgs = append(msgs, msg)
+		if msg.typ == 'Z' || msg.typ == 'E' {
+			return msgs
+		}
+	}
+}
+
+// types returns the message types of msgs, eg: "1T2DCZ".
+func types(msgs []wireMsg) string {
+	var b []byte
+	for _, m := range msgs {
+		b = append(b, m.typ)
+	}
+	return string(b)
+}
+
+// errorField returns a field of an ErrorResponse or NoticeResponse.
+func errorField(msg wireMsg, field byte) string {
+	for _, f := range bytes.Split(msg.body, []byte{0}) {
+		if len(f) > 0 && f[0] == field {
+			return string(f[1:])
+		}
+	}
+	return ""
+}
+
+// msgBuilder builds the body of a message.
+type msgBuilder struct {
+	bytes.Buffer
+}
+
+func (b *msgBuilder) int16(v int16) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *msgBuilder) int32(v int32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *msgBuilder) str(s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+}
+
+// value writes a length prefixed value, or NULL if v is nil.
+func (b *msgBuilder) value(v []byte) {
+	if v == nil {
+		b.int32(-1)
+		return
+	}
+	b.int32(int32(len(v)))
+	b.Write(v)
+}
+
+func (w *wireConn) parse(name, query string, paramTypes ...int32) {
+	var b msgBuilder
+	b.str(name)
+	b.str(query)
+	b.int16(int16(len(paramTypes)))
+	for _, t := range paramTypes {
+		b.int32(t)
+	}
+	w.send('P', b.Bytes())
+}
+
+// bind binds text parameters, nil for NULL, with text results.
+func (w *wireConn) bind(portal, stmt string, params ...[]byte) {
+	var b msgBuilder
+	b.str(portal)
+	b.str(stmt)
+	b.int16(0)
+	b.int16(int16(len(params)))
+	for _, p := range params {
+		b.value(p)
+	}
+	b.int16(0)
+	w.send('B', b.Bytes())
+}
+
+func (w *wireConn) describe(typ byte, name string) {
+	var b msgBuilder
+	b.WriteByte(typ)
+	b.str(name)
+	w.send('D', b.Bytes())
+}
+
+func (w *wireConn) execute(portal string, limit int32) {
+	var b msgBuilder
+	b.str(portal)
+	b.int32(limit)
+	w.send('E', b.Bytes())
+}
+
+func (w *wireConn) closeMsg(typ byte, name string) {
+	var b msgBuilder
+	b.WriteByte(typ)
+	b.str(name)
+	w.send('C', b.Bytes())
+}
+
+func (w *wireConn) sync() []wireMsg {
+	w.send('S', nil)
+	return w.untilReady()
+}
+
+func (w *wireConn) query(q string) []wireMsg {
+	var b msgBuilder
+	b.str(q)
+	w.send('Q', b.Bytes())
+	return w.untilReady()
+}
@@ -0,0 +1,325 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenKind identifies the lexical class of a Token.
+type TokenKind int
+
+const (
+	// Ident is an unquoted identifier or keyword, folded to lower case.
+	Ident TokenKind = iota
+	// QuotedIdent is a double-quoted identifier, case preserved.
+	QuotedIdent
+	// String is a single-quoted (or dollar-quoted) string literal, unescaped.
+	String
+	// Number is a numeric literal.
+	Number
+	// Param is a positional parameter such as $1; Val holds the digits.
+	Param
+	// Punct is an operator or punctuation, eg: "(", ",", "=", "::", "<>".
+	Punct
+)
+
+// Token is a single lexical element of a SQL statement.
+type Token struct {
+	Kind TokenKind
+	Val  string
+}
+
+// Is reports whether t is the unquoted keyword kw (lower case) or the
+// punctuation kw.
+func (t Token) Is(kw string) bool {
+	return (t.Kind == Ident || t.Kind == Punct) && t.Val == kw
+}
+
+func (t Token) String() string {
+	switch t.Kind {
+	case QuotedIdent:
+		return `"` + strings.Replace(t.Val, `"`, `""`, -1) + `"`
+	case String:
+		return "'" + strings.Replace(t.Val, "'", "''", -1) + "'"
+	case Param:
+		return "$" + t.Val
+	default:
+		return t.Val
+	}
+}
+
+// Split splits a query string into its individual statements on top level
+// semicolons, skipping over string literals, quoted identifiers and comments.
+// Empty statements, including those consisting only of comments, are dropped.
+//
+// This is not a parser: it only knows enough lexical structure to find
+// statement boundaries.
+func Split(sql string) []string {
+	var stmts []string
+	start := 0
+	for i := 0; i < len(sql); {
+		switch c := sql[i]; {
+		case c == ';':
+			if s := strings.TrimSpace(sql[start:i]); !isBlank(s) {
+				stmts = append(stmts, s)
+			}
+			i++
+			start = i
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case c == '$':
+			if tag, ok := dollarTag(sql, i); ok {
+				i = skipDollarQuoted(sql, i, tag)
+			} else {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	if s := strings.TrimSpace(sql[start:]); !isBlank(s) {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// isBlank reports whether s contains nothing but whitespace and comments.
+func isBlank(s string) bool {
+	for i := 0; i < len(s); {
+		switch {
+		case isSpace(s[i]):
+			i++
+		case strings.HasPrefix(s[i:], "--"):
+			i = skipLineComment(s, i)
+		case strings.HasPrefix(s[i:], "/*"):
+			i = skipBlockComment(s, i)
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// multiCharOps are the operators made of more than one character, longest
+// first.
+var multiCharOps = [...]string{"!~*", "::", "<>", "!=", ">=", "<=", "||", "!~", "~*"}
+
+// Scan breaks a single statement into tokens. Comments and whitespace are
+// discarded. A trailing semicolon is ignored.
+func Scan(sql string) ([]Token, error) {
+	var toks []Token
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case isSpace(c):
+			i++
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+
+		case c == '\'' || ((c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\''):
+			escapes := c != '\''
+			if escapes {
+				i++
+			}
+			end := skipQuoted(sql, i, '\'')
+			if end > len(sql) || sql[end-1] != '\'' || end-i < 2 {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", i+1)
+			}
+			body := strings.Replace(sql[i+1:end-1], "''", "'", -1)
+			if escapes {
+				body = unescapeString(body)
+			}
+			toks = append(toks, Token{String, body})
+			i = end
+
+		case c == '"':
+			end := skipQuoted(sql, i, '"')
+			if end > len(sql) || sql[end-1] != '"' || end-i < 2 {
+				return nil, fmt.Errorf("unterminated quoted identifier at position %d", i+1)
+			}
+			toks = append(toks, Token{QuotedIdent, strings.Replace(sql[i+1:end-1], `""`, `"`, -1)})
+			i = end
+
+		case c == '$':
+			if tag, ok := dollarTag(sql, i); ok {
+				end := skipDollarQuoted(sql, i, tag)
+				if end > len(sql) || !strings.HasSuffix(sql[:end], tag) || end-i < 2*len(tag) {
+					return nil, fmt.Errorf("unterminated dollar-quoted string at position %d", i+1)
+				}
+				toks = append(toks, Token{String, sql[i+len(tag) : end-len(tag)]})
+				i = end
+				break
+			}
+			j := i + 1
+			for j < len(sql) && isDigit(sql[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("syntax error at or near \"$\"")
+			}
+			toks = append(toks, Token{Param, sql[i+1 : j]})
+			i = j
+
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(sql) && isIdentChar(sql[j]) {
+				j++
+			}
+			toks = append(toks, Token{Ident, strings.ToLower(sql[i:j])})
+			i = j
+
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			j := i
+			for j < len(sql) && (isDigit(sql[j]) || sql[j] == '.') {
+				j++
+			}
+			if j < len(sql) && (sql[j] == 'e' || sql[j] == 'E') {
+				k := j + 1
+				if k < len(sql) && (sql[k] == '+' || sql[k] == '-') {
+					k++
+				}
+				if k < len(sql) && isDigit(sql[k]) {
+					for j = k; j < len(sql) && isDigit(sql[j]); j++ {
+					}
+				}
+			}
+			toks = append(toks, Token{Number, sql[i:j]})
+			i = j
+
+		case c == ';':
+			i++
+
+		default:
+			op := sql[i : i+1]
+			for _, long := range multiCharOps {
+				if strings.HasPrefix(sql[i:], long) {
+					op = long
+					break
+				}
+			}
+			toks = append(toks, Token{Punct, op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+// skipQuoted returns the index just past the closing quote of the quoted
+// section starting at sql[i]. Doubled quotes are treated as escapes.
+func skipQuoted(sql string, i int, quote byte) int {
+	// E'...' strings allow backslash escapes of the quote character.
+	escapes := quote == '\'' && i > 0 && (sql[i-1] == 'e' || sql[i-1] == 'E') &&
+		(i == 1 || !isIdentChar(sql[i-2]))
+	for j := i + 1; j < len(sql); j++ {
+		if sql[j] == quote {
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+		if sql[j] == '\\' && escapes {
+			j++
+		}
+	}
+	return len(sql) + 1
+}
+
+func skipLineComment(sql string, i int) int {
+	if n := strings.IndexByte(sql[i:], '\n'); n >= 0 {
+		return i + n + 1
+	}
+	return len(sql)
+}
+
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for j := i; j < len(sql)-1; j++ {
+		switch sql[j : j+2] {
+		case "/*":
+			depth++
+			j++
+		case "*/":
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the dollar-quote tag ("$$" or "$tag$") starting at sql[i].
+func dollarTag(sql string, i int) (string, bool) {
+	for j := i + 1; j < len(sql); j++ {
+		switch c := sql[j]; {
+		case c == '$':
+			return sql[i : j+1], true
+		case isIdentChar(c) && !(j == i+1 && isDigit(c)):
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func skipDollarQuoted(sql string, i int, tag string) int {
+	if n := strings.Index(sql[i+len(tag):], tag); n >= 0 {
+		return i + len(tag) + n + len(tag)
+	}
+	return len(sql) + 1
+}
+
+func unescapeString(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b = append(b, '\n')
+		case 't':
+			b = append(b, '\t')
+		case 'r':
+			b = append(b, '\r')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		default:
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
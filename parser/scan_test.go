@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	testData := []struct {
+		sql      string
+		expected []Token
+	}{
+		{`SELECT a FROM "My Table"`, []Token{
+			{Ident, "select"}, {Ident, "a"}, {Ident, "from"}, {QuotedIdent, "My Table"},
+		}},
+		{`"a""b"`, []Token{{QuotedIdent, `a"b`}}},
+		{`'it''s'`, []Token{{String, "it's"}}},
+		{`E'a\nb\'c'`, []Token{{String, "a\nb'c"}}},
+		{`e'\\'`, []Token{{String, `\`}}},
+		{`'a\n'`, []Token{{String, `a\n`}}},
+		{`$$it's $1$$`, []Token{{String, "it's $1"}}},
+		{`$fn$ $$ $fn$`, []Token{{String, " $$ "}}},
+		{`$1 + $23`, []Token{{Param, "1"}, {Punct, "+"}, {Param, "23"}}},
+		{"a -- comment\nb /* block /* nested */ */ c", []Token{
+			{Ident, "a"}, {Ident, "b"}, {Ident, "c"},
+		}},
+		{`1 2.5 .5 1e10 1.5E-3 1e`, []Token{
+			{Number, "1"}, {Number, "2.5"}, {Number, ".5"}, {Number, "1e10"}, {Number, "1.5E-3"},
+			{Number, "1"}, {Ident, "e"},
+		}},
+		{`a::int<>b!=c>=d<=e||f`, []Token{
+			{Ident, "a"}, {Punct, "::"}, {Ident, "int"}, {Punct, "<>"}, {Ident, "b"}, {Punct, "!="},
+			{Ident, "c"}, {Punct, ">="}, {Ident, "d"}, {Punct, "<="}, {Ident, "e"}, {Punct, "||"},
+			{Ident, "f"},
+		}},
+		{`a ~ b !~ c ~* d !~* e`, []Token{
+			{Ident, "a"}, {Punct, "~"}, {Ident, "b"}, {Punct, "!~"}, {Ident, "c"}, {Punct, "~*"},
+			{Ident, "d"}, {Punct, "!~*"}, {Ident, "e"},
+		}},
+		{`SELECT 1;`, []Token{{Ident, "select"}, {Number, "1"}}},
+	}
+	for _, d := range testData {
+		toks, err := Scan(d.sql)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", d.sql, err)
+			continue
+		}
+		if !reflect.DeepEqual(toks, d.expected) {
+			t.Errorf("%q: expected %v, but found %v", d.sql, d.expected, toks)
+		}
+	}
+}
+
+func TestScanError(t *testing.T) {
+	testData := []struct {
+		sql      string
+		expected string
+	}{
+		{`'abc`, "unterminated quoted string at position 1"},
+		{`a "abc`, "unterminated quoted identifier at position 3"},
+		{`$$abc`, "unterminated dollar-quoted string at position 1"},
+		{`$`, `syntax error at or near "$"`},
+	}
+	for _, d := range testData {
+		if _, err := Scan(d.sql); err == nil || err.Error() != d.expected {
+			t.Errorf("%q: expected error %q, but found %v", d.sql, d.expected, err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	testData := []struct {
+		sql      string
+		expected []string
+	}{
+		{"SELECT 1; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';'; SELECT \";\"", []string{"SELECT ';'", `SELECT ";"`}},
+		{"SELECT $$;$$; SELECT $a$;$a$", []string{"SELECT $$;$$", "SELECT $a$;$a$"}},
+		{"SELECT 1 -- ;\n; /* ; */ ;", []string{"SELECT 1 -- ;"}},
+		{";;", nil},
+	}
+	for _, d := range testData {
+		if stmts := Split(d.sql); !reflect.DeepEqual(stmts, d.expected) {
+			t.Errorf("%q: expected %q, but found %q", d.sql, d.expected, stmts)
+		}
+	}
+}
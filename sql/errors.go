@@ -1,17 +1,119 @@
 package sql
 
-import "errors"
+import (
+	"errors"
+	"github.com/yydzero/mnt/util/duration"
+	"github.com/yydzero/mnt/util/encoding"
+)
 
 const (
 	// PG error codes from:
 	// http://www.postgresql.org/docs/9.5/static/errcodes-appendix.html
 
+	// CodeSuccessfulCompletion is the SQLSTATE of notices which are not
+	// warnings.
+	CodeSuccessfulCompletion string = "00000"
+	// CodeWarning is the SQLSTATE of warnings without a more specific one.
+	CodeWarning string = "01000"
+	// CodeFeatureNotSupportedError signals a request for something which is
+	// not implemented, eg: a newer protocol version.
+	CodeFeatureNotSupportedError string = "0A000"
+	// CodeProtocolViolationError signals a malformed protocol message.
+	CodeProtocolViolationError string = "08P01"
+	// CodeInvalidPasswordError signals a failed password authentication.
+	CodeInvalidPasswordError string = "28P01"
+	// CodeInvalidSQLStatementNameError signals a reference to an unknown
+	// prepared statement.
+	CodeInvalidSQLStatementNameError string = "26000"
+	// CodeInvalidCursorNameError signals a reference to an unknown portal.
+	CodeInvalidCursorNameError string = "34000"
 	// CodeUniquenessConstraintViolationError represents violations of uniqueness
 	// constraints.
 	CodeUniquenessConstraintViolationError string = "23505"
+	// CodeIdleInTransactionSessionTimeoutError signals that a session was
+	// terminated for being idle in a transaction for longer than
+	// idle_in_transaction_session_timeout.
+	CodeIdleInTransactionSessionTimeoutError string = "25P03"
+	// CodeNoActiveSQLTransactionError signals a statement which only has an
+	// effect in a transaction block, such as SET LOCAL, run outside of one.
+	CodeNoActiveSQLTransactionError string = "25P01"
 	// CodeTransactionAbortedError signals that the user tried to execute a
 	// statement in the context of a SQL txn that's already aborted.
 	CodeTransactionAbortedError string = "25P02"
+	// CodeInvalidDatetimeFormatError signals a date/time value which cannot
+	// be parsed.
+	CodeInvalidDatetimeFormatError string = "22007"
+	// CodeDatetimeFieldOverflowError signals a date/time value out of range.
+	CodeDatetimeFieldOverflowError string = "22008"
+	// CodeDivisionByZeroError signals a division by zero.
+	CodeDivisionByZeroError string = "22012"
+	// CodeIntervalFieldOverflowError signals an interval value out of range.
+	CodeIntervalFieldOverflowError string = "22015"
+	// CodeInvalidParameterValueError signals an invalid value for a run-time
+	// parameter.
+	CodeInvalidParameterValueError string = "22023"
+	// CodeInvalidTextRepresentationError signals text which cannot be
+	// converted to the type asked for.
+	CodeInvalidTextRepresentationError string = "22P02"
+	// CodeInvalidRegularExpressionError signals a malformed regular
+	// expression.
+	CodeInvalidRegularExpressionError string = "2201B"
+	// CodeSubstringError signals invalid bounds given to substring.
+	CodeSubstringError string = "22011"
+	// CodeCardinalityViolationError signals a scalar subquery which returned
+	// more than one row.
+	CodeCardinalityViolationError string = "21000"
+	// CodeSyntaxError signals a statement which could not be parsed.
+	CodeSyntaxError string = "42601"
+	// CodeUndefinedObjectError signals a reference to an unknown object, eg:
+	// a run-time parameter.
+	CodeUndefinedObjectError string = "42704"
+	// CodeUndefinedFunctionError signals a call of an unknown function or
+	// operator.
+	CodeUndefinedFunctionError string = "42883"
+	// CodeUndefinedTableError signals a reference to an unknown relation.
+	CodeUndefinedTableError string = "42P01"
+	// CodeUndefinedColumnError signals a reference to an unknown column.
+	CodeUndefinedColumnError string = "42703"
+	// CodeAmbiguousColumnError signals a column name which more than one
+	// relation of the FROM clause has.
+	CodeAmbiguousColumnError string = "42702"
+	// CodeInvalidColumnReferenceError signals an ORDER BY position outside
+	// the select list.
+	CodeInvalidColumnReferenceError string = "42P10"
+	// CodeDatatypeMismatchError signals a value of the wrong type, eg: a
+	// non-boolean condition.
+	CodeDatatypeMismatchError string = "42804"
+	// CodeUndefinedParameterError signals a reference to a parameter ($n)
+	// which was not bound.
+	CodeUndefinedParameterError string = "42P02"
+	// CodeDuplicateCursorError signals a Bind to a named portal which
+	// already exists.
+	CodeDuplicateCursorError string = "42P03"
+	// CodeDuplicatePreparedStatementError signals a Parse of a named
+	// statement which already exists.
+	CodeDuplicatePreparedStatementError string = "42P05"
+	// CodeCantChangeRuntimeParamError signals an attempt to change a
+	// read-only run-time parameter.
+	CodeCantChangeRuntimeParamError string = "55P02"
+	// CodeCharacterNotInRepertoireError signals input which is not valid in
+	// the client encoding.
+	CodeCharacterNotInRepertoireError string = "22021"
+	// CodeUntranslatableCharacterError signals a character which has no
+	// equivalent in the client encoding.
+	CodeUntranslatableCharacterError string = "22P05"
+	// CodeTooManyConnectionsError signals that a connection limit has been
+	// reached.
+	CodeTooManyConnectionsError string = "53300"
+	// CodeQueryCanceledError signals a statement canceled, eg: for running
+	// longer than statement_timeout.
+	CodeQueryCanceledError string = "57014"
+	// CodeAdminShutdownError signals that the session is terminated because
+	// the server is shutting down.
+	CodeAdminShutdownError string = "57P01"
+	// CodeIdleSessionTimeoutError signals that a session was terminated for
+	// being idle for longer than idle_session_timeout.
+	CodeIdleSessionTimeoutError string = "57P05"
 	// CodeInternalError represents all internal cockroach errors, plus acts
 	// as a catch-all for random errors for which we haven't implemented the
 	// appropriate error code.
@@ -27,7 +129,38 @@ const (
 	CodeTransactionCommittedError string = "CR001"
 )
 
+// ErrTransactionAborted is returned for statements other than COMMIT and
+// ROLLBACK in an aborted transaction.
+var ErrTransactionAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
+
 var errNoTransactionInProgress = errors.New("there is no transaction in progress")
 var errStaleMetadata = errors.New("metadata is still stale")
 var errTransactionInProgress = errors.New("there is already a transaction in progress")
 var errNotRetriable = errors.New("the transaction is not in a retriable state")
+
+// ErrorCode returns the SQLSTATE for an error returned by this package or the
+// datum packages, or CodeInternalError if it has none.
+func ErrorCode(err error) string {
+	if e, ok := err.(*PGError); ok && e.Code != "" {
+		return e.Code
+	}
+	switch err {
+	case ErrTransactionAborted:
+		return CodeTransactionAbortedError
+	case duration.ErrIntervalOverflow:
+		return CodeIntervalFieldOverflowError
+	case duration.ErrTimestampOverflow:
+		return CodeDatetimeFieldOverflowError
+	case duration.ErrDivisionByZero:
+		return CodeDivisionByZeroError
+	}
+	switch err.(type) {
+	case *duration.SyntaxError:
+		return CodeInvalidDatetimeFormatError
+	case *encoding.UntranslatableError:
+		return CodeUntranslatableCharacterError
+	case *encoding.InvalidByteSequenceError:
+		return CodeCharacterNotInRepertoireError
+	}
+	return CodeInternalError
+}
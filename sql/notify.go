@@ -0,0 +1,196 @@
+package sql
+
+import (
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"strconv"
+)
+
+// maxNotifyPayload is the longest payload NOTIFY accepts, in bytes.
+const maxNotifyPayload = 8000
+
+// Notification is a message sent with NOTIFY or pg_notify() to the sessions
+// listening on its channel.
+type Notification struct {
+	PID     int32 // The process ID of the sending session.
+	Channel string
+	Payload string
+}
+
+// ListenChange is a LISTEN, or an UNLISTEN if Listen is false. UNLISTEN *
+// has an empty Channel.
+type ListenChange struct {
+	Channel string
+	Listen  bool
+}
+
+// notifyState holds the LISTEN, UNLISTEN and NOTIFY commands of a session.
+// As in PostgreSQL, they take effect when the transaction commits, and are
+// dropped if it rolls back.
+type notifyState struct {
+	pending          []Notification
+	pendingListens   []ListenChange
+	committed        []Notification
+	committedListens []ListenChange
+}
+
+func (n *notifyState) commit() {
+	n.committed = append(n.committed, n.pending...)
+	n.committedListens = append(n.committedListens, n.pendingListens...)
+	n.pending, n.pendingListens = nil, nil
+}
+
+func (n *notifyState) abort() {
+	n.pending, n.pendingListens = nil, nil
+}
+
+// TakeNotifications returns the listen changes and notifications of the
+// transactions committed since it was last called.
+func (s *Session) TakeNotifications() ([]ListenChange, []Notification) {
+	listens, notifications := s.notify.committedListens, s.notify.committed
+	s.notify.committedListens, s.notify.committed = nil, nil
+	return listens, notifications
+}
+
+// ExecNotifyStatement runs LISTEN, UNLISTEN, NOTIFY and SELECT pg_notify()
+// statements. It reports false for any other statement.
+func (s *Session) ExecNotifyStatement(stmt string, params []parser.Datum) (executor.Result, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return executor.Result{}, false
+	}
+
+	switch {
+	case toks[0].Is("listen"):
+		result := executor.Result{Type: executor.Ack, PGTag: "LISTEN"}
+		if len(toks) != 2 || !isName(toks[1]) {
+			result.Err = syntaxError(toks[1:])
+			return result, true
+		}
+		s.notify.pendingListens = append(s.notify.pendingListens, ListenChange{Channel: toks[1].Val, Listen: true})
+		return result, true
+
+	case toks[0].Is("unlisten"):
+		result := executor.Result{Type: executor.Ack, PGTag: "UNLISTEN"}
+		if len(toks) != 2 || !(isName(toks[1]) || toks[1].Is("*")) {
+			result.Err = syntaxError(toks[1:])
+			return result, true
+		}
+		channel := toks[1].Val
+		if toks[1].Is("*") {
+			channel = ""
+		}
+		s.notify.pendingListens = append(s.notify.pendingListens, ListenChange{Channel: channel})
+		return result, true
+
+	case toks[0].Is("notify"):
+		result := executor.Result{Type: executor.Ack, PGTag: "NOTIFY"}
+		var payload string
+		switch {
+		case len(toks) == 2 && isName(toks[1]):
+		case len(toks) == 4 && isName(toks[1]) && toks[2].Is(",") && toks[3].Kind == parser.String:
+			payload = toks[3].Val
+		default:
+			result.Err = syntaxError(toks[1:])
+			return result, true
+		}
+		result.Err = s.queueNotification(toks[1].Val, payload)
+		return result, true
+
+	case isPGNotify(toks):
+		result := executor.Result{
+			Type:    executor.Rows,
+			PGTag:   "SELECT",
+			Columns: []executor.ResultColumn{{Name: "pg_notify", Typ: parser.DummyString}},
+			Rows:    []executor.ResultRow{{Values: []parser.Datum{parser.DString("")}}},
+		}
+		channel, err := stringArg(toks[3], params)
+		if err == nil {
+			var payload string
+			if payload, err = stringArg(toks[5], params); err == nil {
+				err = s.queueNotification(channel, payload)
+			}
+		}
+		result.Err = err
+		return result, true
+	}
+	return executor.Result{}, false
+}
+
+// DescribeNotifyStatement returns the result columns of a statement run by
+// ExecNotifyStatement, adding the types of any parameters of pg_notify() to
+// args. It reports false for any other statement.
+func (s *Session) DescribeNotifyStatement(stmt string, args parser.MapArgs) ([]executor.ResultColumn, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return nil, false
+	}
+
+	switch {
+	case toks[0].Is("listen"), toks[0].Is("unlisten"), toks[0].Is("notify"):
+		return nil, true
+	case isPGNotify(toks):
+		for _, t := range []parser.Token{toks[3], toks[5]} {
+			if t.Kind == parser.Param {
+				args[t.Val] = parser.DummyString
+			}
+		}
+		return []executor.ResultColumn{{Name: "pg_notify", Typ: parser.DummyString}}, true
+	}
+	return nil, false
+}
+
+// queueNotification adds a notification to the current transaction. As in
+// PostgreSQL, duplicates within a transaction are sent once.
+func (s *Session) queueNotification(channel, payload string) error {
+	if channel == "" {
+		return NewPGError(CodeInvalidParameterValueError, "channel name cannot be empty")
+	}
+	if len(payload) >= maxNotifyPayload {
+		return NewPGError(CodeInvalidParameterValueError, "payload string too long")
+	}
+	n := Notification{Channel: channel, Payload: payload}
+	for _, p := range s.notify.pending {
+		if p == n {
+			return nil
+		}
+	}
+	s.notify.pending = append(s.notify.pending, n)
+	return nil
+}
+
+// isPGNotify reports whether toks is "SELECT pg_notify(channel, payload)".
+func isPGNotify(toks []parser.Token) bool {
+	return len(toks) == 7 && toks[0].Is("select") && toks[1].Is("pg_notify") && toks[2].Is("(") &&
+		isStringArg(toks[3]) && toks[4].Is(",") && isStringArg(toks[5]) && toks[6].Is(")")
+}
+
+func isStringArg(t parser.Token) bool {
+	return t.Kind == parser.String || t.Kind == parser.Param
+}
+
+// stringArg returns the value of a string literal or text parameter.
+func stringArg(t parser.Token, params []parser.Datum) (string, error) {
+	if t.Kind == parser.String {
+		return t.Val, nil
+	}
+	i, err := strconv.Atoi(t.Val)
+	if err != nil || i < 1 || i > len(params) {
+		return "", NewPGError(CodeUndefinedParameterError, "there is no parameter $%s", t.Val)
+	}
+	switch v := params[i-1].(type) {
+	case parser.DString:
+		return string(v), nil
+	case parser.DBytes:
+		return string(v), nil
+	}
+	if params[i-1] == parser.DNull {
+		return "", nil
+	}
+	return "", NewPGError(CodeInvalidParameterValueError, "parameter $%s is not text", t.Val)
+}
+
+// isName reports whether t can be a channel name.
+func isName(t parser.Token) bool {
+	return t.Kind == parser.Ident || t.Kind == parser.QuotedIdent
+}
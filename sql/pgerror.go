@@ -0,0 +1,169 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is the severity of an error or notice, as sent in the S and V
+// fields of ErrorResponse and NoticeResponse messages.
+type Severity string
+
+const (
+	SeverityPanic   Severity = "PANIC"
+	SeverityFatal   Severity = "FATAL"
+	SeverityError   Severity = "ERROR"
+	SeverityWarning Severity = "WARNING"
+	SeverityNotice  Severity = "NOTICE"
+	SeverityDebug   Severity = "DEBUG"
+	SeverityInfo    Severity = "INFO"
+	SeverityLog     Severity = "LOG"
+)
+
+// PGError is an error carrying the fields of a PostgreSQL ErrorResponse. See:
+// http://www.postgresql.org/docs/9.5/static/protocol-error-fields.html
+//
+// Executors return it from Result.Err and Prepare to control exactly what
+// the client receives. Empty fields are not sent.
+type PGError struct {
+	Severity Severity // S and V; SeverityError if empty.
+	Code     string   // C: the SQLSTATE; CodeInternalError if empty.
+	Message  string   // M
+	Detail   string   // D
+	Hint     string   // H
+
+	// Position is the 1-based character index of the error in the query
+	// (P). InternalPosition and InternalQuery (p and q) are the same for an
+	// internally generated query. Zero means none.
+	Position         int
+	InternalPosition int
+	InternalQuery    string
+
+	Where string // W: the context of the error, eg: a call stack.
+
+	// The object the error is associated with (s, t, c, d and n).
+	SchemaName     string
+	TableName      string
+	ColumnName     string
+	DataTypeName   string
+	ConstraintName string
+
+	// Where in the source the error was raised (F, L and R).
+	File    string
+	Line    int
+	Routine string
+}
+
+// NewPGError returns an error with the given SQLSTATE and message.
+func NewPGError(code string, format string, args ...interface{}) *PGError {
+	return &PGError{Severity: SeverityError, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *PGError) Error() string {
+	return e.Message
+}
+
+// ToPGError converts err to a PGError. Other errors are given the SQLSTATE
+// returned by ErrorCode.
+func ToPGError(err error) *PGError {
+	if e, ok := err.(*PGError); ok {
+		return e
+	}
+	return &PGError{Severity: SeverityError, Code: ErrorCode(err), Message: err.Error()}
+}
+
+// ToNotice converts err to a PGError to be sent as a NoticeResponse. The
+// severity defaults to NOTICE, and the SQLSTATE to the one for its severity.
+func ToNotice(err error) *PGError {
+	var e PGError
+	if pe, ok := err.(*PGError); ok {
+		e = *pe
+	} else {
+		e.Message = err.Error()
+	}
+	if e.Severity == "" {
+		e.Severity = SeverityNotice
+	}
+	if e.Code == "" {
+		e.Code = CodeSuccessfulCompletion
+		if e.Severity == SeverityWarning {
+			e.Code = CodeWarning
+		}
+	}
+	return &e
+}
+
+// messageLevels ranks the values of client_min_messages and the severities
+// of the messages they filter. DEBUG messages are sent from debug1 down.
+var messageLevels = map[string]int{
+	"debug5": 1, "debug4": 2, "debug3": 3, "debug2": 4, "debug1": 5,
+	"debug": 5, "log": 6, "notice": 7, "warning": 8, "error": 9,
+}
+
+// SendsToClient reports whether a message of the given severity is sent to
+// the client, according to client_min_messages. INFO messages always are.
+func (s *Session) SendsToClient(severity Severity) bool {
+	if severity == SeverityInfo {
+		return true
+	}
+	level, ok := messageLevels[strings.ToLower(string(severity))]
+	if !ok {
+		// ERROR and above.
+		return true
+	}
+	min, err := s.GetVar("client_min_messages")
+	if err != nil {
+		return true
+	}
+	return level >= messageLevels[strings.ToLower(min)]
+}
+
+// PGErrorField is one field of an ErrorResponse or NoticeResponse message.
+type PGErrorField struct {
+	Type  byte
+	Value string
+}
+
+// Fields returns the populated fields of e in the order they are sent.
+func (e *PGError) Fields() []PGErrorField {
+	severity := e.Severity
+	if severity == "" {
+		severity = SeverityError
+	}
+	code := e.Code
+	if code == "" {
+		code = CodeInternalError
+	}
+	fields := []PGErrorField{
+		{'S', string(severity)},
+		{'V', string(severity)},
+		{'C', code},
+		{'M', e.Message},
+	}
+	add := func(typ byte, value string) {
+		if value != "" {
+			fields = append(fields, PGErrorField{typ, value})
+		}
+	}
+	itoa := func(i int) string {
+		if i == 0 {
+			return ""
+		}
+		return fmt.Sprint(i)
+	}
+	add('D', e.Detail)
+	add('H', e.Hint)
+	add('P', itoa(e.Position))
+	add('p', itoa(e.InternalPosition))
+	add('q', e.InternalQuery)
+	add('W', e.Where)
+	add('s', e.SchemaName)
+	add('t', e.TableName)
+	add('c', e.ColumnName)
+	add('d', e.DataTypeName)
+	add('n', e.ConstraintName)
+	add('F', e.File)
+	add('L', itoa(e.Line))
+	add('R', e.Routine)
+	return fields
+}
@@ -1,17 +1,25 @@
 package sql
 
 import (
-	"github.com/yydzero/mnt/executor"
+	"golang.org/x/net/context"
 	"log"
 	"net"
+	"sort"
+	"strings"
 )
 
 // connstr for libpq connection
 type ConnectionArgs struct {
-	Database       string
-	User           string
-	ClientEncoding string
-	DateStyle      string
+	Database string
+	User     string
+
+	// Replication is the replication startup parameter. Replication
+	// connections are not supported, so it must be empty or false.
+	Replication string
+
+	// Vars are the run-time parameters set at startup, eg: client_encoding,
+	// application_name or gp_session_id, by lower case name.
+	Vars map[string]string
 }
 
 // Session contains the state of a SQL client connection.
@@ -19,7 +27,13 @@ type Session struct {
 	Database string
 	User     string
 
+	// RemoteAddr is the address of the client, if known.
+	RemoteAddr net.Addr
+
 	TxnState txnState
+
+	vars   varValues
+	notify notifyState
 }
 
 type TxnStateEnum int
@@ -33,13 +47,30 @@ const (
 // txnState contains state associated with an ongoing SQL txn.
 type txnState struct {
 	State TxnStateEnum
+
+	// Implicit is set while statements run in an implicit transaction,
+	// outside of a transaction block. State stays Idle, and ImplicitFailed
+	// is set if one of them fails.
+	Implicit       bool
+	ImplicitFailed bool
+
+	// ImplicitBlock is set when the implicit transaction runs several
+	// statements of one query, which then act as a transaction block: SET
+	// LOCAL lasts until the last of them without a warning.
+	ImplicitBlock bool
 }
 
 // NewSession creates and initializes new Session object. remote can be nil
-func NewSession(args ConnectionArgs, e executor.Executor, remote net.Addr) *Session {
+func NewSession(args ConnectionArgs, remote net.Addr) *Session {
 	s := Session{}
 	s.Database = args.Database
 	s.User = args.User
+	s.RemoteAddr = remote
+	s.vars = varValues{
+		reset:   make(map[string]string),
+		session: make(map[string]string),
+		local:   make(map[string]string),
+	}
 
 	remoteStr := ""
 	if remote != nil {
@@ -48,3 +79,66 @@ func NewSession(args ConnectionArgs, e executor.Executor, remote net.Addr) *Sess
 	log.Printf("remote address: %q\n", remoteStr)
 	return &s
 }
+
+// InitVars sets the run-time parameters given in the startup packet. These
+// become the values RESET returns to.
+func (s *Session) InitVars(args ConnectionArgs) error {
+	if err := checkReplication(args.Replication); err != nil {
+		return err
+	}
+	if err := s.initVar("session_authorization", args.User); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(args.Vars))
+	for name := range args.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, err := lookupVar(name)
+		if err != nil {
+			return err
+		}
+		if v.flags&ReadOnly != 0 {
+			return NewPGError(CodeCantChangeRuntimeParamError, "parameter %q cannot be changed", v.name)
+		}
+		if err := s.initVar(name, args.Vars[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReplication validates the replication startup parameter, which asks
+// for a physical ("true") or logical ("database") replication connection.
+func checkReplication(value string) error {
+	if value == "" {
+		return nil
+	}
+	if strings.EqualFold(value, "database") {
+		return NewPGError(CodeFeatureNotSupportedError, "replication connections are not supported")
+	}
+	on, err := validateBool(value, "")
+	if err != nil {
+		return NewPGError(CodeInvalidParameterValueError, "invalid value for parameter \"replication\": %q", value)
+	}
+	if on == "on" {
+		return NewPGError(CodeFeatureNotSupportedError, "replication connections are not supported")
+	}
+	return nil
+}
+
+type sessionKey struct{}
+
+// NewContext returns a context carrying the given session, so that executors
+// can look up per-connection state.
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// FromContext returns the session stored in ctx, if any.
+func FromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok
+}
@@ -0,0 +1,291 @@
+package sql
+
+import (
+	"github.com/yydzero/mnt/executor"
+	"github.com/yydzero/mnt/parser"
+	"strings"
+)
+
+// ExecSessionStatement runs SET, SHOW and RESET statements against the
+// session's run-time parameters. It reports false for any other statement,
+// which must be run by the executor.
+func (s *Session) ExecSessionStatement(stmt string) (executor.Result, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return executor.Result{}, false
+	}
+
+	switch {
+	case toks[0].Is("set"):
+		return s.execSet(toks[1:])
+	case toks[0].Is("show"):
+		return s.execShow(toks[1:])
+	case toks[0].Is("reset"):
+		return s.execReset(toks[1:])
+	}
+	return executor.Result{}, false
+}
+
+// DescribeSessionStatement returns the result columns of a SET, SHOW or
+// RESET statement without running it. It reports false for any other
+// statement.
+func (s *Session) DescribeSessionStatement(stmt string) ([]executor.ResultColumn, bool) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return nil, false
+	}
+
+	switch {
+	case toks[0].Is("set"):
+		return nil, !setsOther(toks[1:])
+	case toks[0].Is("show"):
+		// SHOW has no side effects.
+		result, ok := s.execShow(toks[1:])
+		return result.Columns, ok
+	case toks[0].Is("reset"):
+		return nil, true
+	}
+	return nil, false
+}
+
+// execSet runs
+//
+//	SET [SESSION | LOCAL] name { TO | = } { value [, ...] | DEFAULT }
+//	SET [SESSION | LOCAL] TIME ZONE { value | LOCAL | DEFAULT }
+func (s *Session) execSet(toks []parser.Token) (executor.Result, bool) {
+	if setsOther(toks) {
+		return executor.Result{}, false
+	}
+
+	local := false
+	if len(toks) > 0 && toks[0].Is("local") {
+		local = true
+		toks = toks[1:]
+	} else if len(toks) > 0 && toks[0].Is("session") {
+		toks = toks[1:]
+	}
+	if len(toks) == 0 {
+		return executor.Result{Err: syntaxError(toks)}, true
+	}
+
+	var name string
+	var valueToks []parser.Token
+	if toks[0].Is("time") && len(toks) > 1 && toks[1].Is("zone") {
+		name = "TimeZone"
+		valueToks = toks[2:]
+		if len(valueToks) == 1 && valueToks[0].Is("local") {
+			valueToks = []parser.Token{{Kind: parser.Ident, Val: "default"}}
+		}
+	} else {
+		var n int
+		var err error
+		name, n, err = varName(toks)
+		if err != nil {
+			return executor.Result{Err: err}, true
+		}
+		toks = toks[n:]
+		if len(toks) == 0 || !(toks[0].Is("to") || toks[0].Is("=")) {
+			return executor.Result{Err: syntaxError(toks)}, true
+		}
+		valueToks = toks[1:]
+	}
+
+	result := executor.Result{Type: executor.Ack, PGTag: "SET"}
+	if local && s.TxnState.State == Idle && !s.TxnState.ImplicitBlock {
+		result.Notices = append(result.Notices, &PGError{
+			Severity: SeverityWarning,
+			Code:     CodeNoActiveSQLTransactionError,
+			Message:  "SET LOCAL can only be used in transaction blocks",
+		})
+	}
+	if len(valueToks) == 1 && valueToks[0].Is("default") {
+		if local {
+			// SET LOCAL x TO DEFAULT is transaction scoped too.
+			value, err := s.resetValue(name)
+			if err == nil {
+				err = s.SetVar(name, value, true)
+			}
+			result.Err = err
+			return result, true
+		}
+		result.Err = s.ResetVar(name)
+		return result, true
+	}
+
+	value, err := varValue(valueToks)
+	if err != nil {
+		return executor.Result{Err: err}, true
+	}
+	result.Err = s.SetVar(name, value, local)
+	return result, true
+}
+
+// setsOther reports whether a SET statement changes something other than a
+// run-time parameter, eg: SET TRANSACTION or SET ROLE.
+func setsOther(toks []parser.Token) bool {
+	if len(toks) > 0 && (toks[0].Is("local") || toks[0].Is("session")) {
+		toks = toks[1:]
+	}
+	if len(toks) == 0 {
+		return false
+	}
+	for _, kw := range []string{"transaction", "characteristics", "role", "authorization", "constraints"} {
+		if toks[0].Is(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// execShow runs
+//
+//	SHOW name
+//	SHOW TIME ZONE
+//	SHOW ALL
+func (s *Session) execShow(toks []parser.Token) (executor.Result, bool) {
+	if len(toks) > 0 && toks[0].Is("transaction") {
+		return executor.Result{}, false
+	}
+
+	result := executor.Result{Type: executor.Rows, PGTag: "SHOW"}
+	if len(toks) == 1 && toks[0].Is("all") {
+		result.Columns = []executor.ResultColumn{
+			{Name: "name", Typ: parser.DummyString},
+			{Name: "setting", Typ: parser.DummyString},
+			{Name: "description", Typ: parser.DummyString},
+		}
+		for _, setting := range s.Settings() {
+			result.Rows = append(result.Rows, executor.ResultRow{Values: []parser.Datum{
+				parser.DString(setting.Name), parser.DString(setting.Value), parser.DString(setting.Desc),
+			}})
+		}
+		return result, true
+	}
+
+	var name string
+	if len(toks) == 2 && toks[0].Is("time") && toks[1].Is("zone") {
+		name = "TimeZone"
+	} else {
+		var n int
+		var err error
+		name, n, err = varName(toks)
+		if err != nil {
+			return executor.Result{Err: err}, true
+		}
+		if n != len(toks) {
+			return executor.Result{Err: syntaxError(toks[n:])}, true
+		}
+	}
+
+	v, err := lookupVar(name)
+	if err != nil {
+		return executor.Result{Err: err}, true
+	}
+	value, err := s.GetVar(name)
+	if err != nil {
+		return executor.Result{Err: err}, true
+	}
+	result.Columns = []executor.ResultColumn{{Name: v.name, Typ: parser.DummyString}}
+	result.Rows = []executor.ResultRow{{Values: []parser.Datum{parser.DString(value)}}}
+	return result, true
+}
+
+// execReset runs
+//
+//	RESET name
+//	RESET TIME ZONE
+//	RESET ALL
+func (s *Session) execReset(toks []parser.Token) (executor.Result, bool) {
+	result := executor.Result{Type: executor.Ack, PGTag: "RESET"}
+	switch {
+	case len(toks) == 1 && toks[0].Is("all"):
+		s.ResetAllVars()
+	case len(toks) == 2 && toks[0].Is("time") && toks[1].Is("zone"):
+		result.Err = s.ResetVar("TimeZone")
+	default:
+		name, n, err := varName(toks)
+		if err == nil && n != len(toks) {
+			err = syntaxError(toks[n:])
+		}
+		if err == nil {
+			err = s.ResetVar(name)
+		}
+		result.Err = err
+	}
+	return result, true
+}
+
+// resetValue returns the value RESET would restore a parameter to.
+func (s *Session) resetValue(name string) (string, error) {
+	v, err := lookupVar(name)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := s.vars.reset[strings.ToLower(v.name)]; ok {
+		return value, nil
+	}
+	return v.value, nil
+}
+
+// varName parses a possibly dotted parameter name, returning it and the
+// number of tokens used.
+func varName(toks []parser.Token) (string, int, error) {
+	if len(toks) == 0 || (toks[0].Kind != parser.Ident && toks[0].Kind != parser.QuotedIdent) {
+		return "", 0, syntaxError(toks)
+	}
+	name := toks[0].Val
+	n := 1
+	for n+1 < len(toks) && toks[n].Is(".") &&
+		(toks[n+1].Kind == parser.Ident || toks[n+1].Kind == parser.QuotedIdent) {
+		name += "." + toks[n+1].Val
+		n += 2
+	}
+	return name, n, nil
+}
+
+// varValue joins a comma separated list of values into the string form of a
+// parameter value.
+func varValue(toks []parser.Token) (string, error) {
+	var values []string
+	for len(toks) > 0 {
+		sign := ""
+		if toks[0].Is("-") || toks[0].Is("+") {
+			sign = toks[0].Val
+			toks = toks[1:]
+			if len(toks) == 0 || toks[0].Kind != parser.Number {
+				return "", syntaxError(toks)
+			}
+		}
+
+		switch toks[0].Kind {
+		case parser.Ident, parser.String, parser.Number:
+			values = append(values, sign+toks[0].Val)
+		case parser.QuotedIdent:
+			values = append(values, toks[0].String())
+		default:
+			return "", syntaxError(toks)
+		}
+		toks = toks[1:]
+
+		if len(toks) > 0 {
+			if !toks[0].Is(",") {
+				return "", syntaxError(toks)
+			}
+			toks = toks[1:]
+			if len(toks) == 0 {
+				return "", syntaxError(toks)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return "", syntaxError(toks)
+	}
+	return strings.Join(values, ", "), nil
+}
+
+func syntaxError(toks []parser.Token) error {
+	if len(toks) == 0 {
+		return NewPGError(CodeSyntaxError, "syntax error at end of input")
+	}
+	return NewPGError(CodeSyntaxError, "syntax error at or near %q", toks[0].String())
+}
@@ -0,0 +1,134 @@
+package sql
+
+import "github.com/yydzero/mnt/parser"
+
+// TrackTransaction updates the transaction state of the session after stmt
+// has been run by the executor.
+func (s *Session) TrackTransaction(stmt string) {
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return
+	}
+
+	switch {
+	case toks[0].Is("begin"), toks[0].Is("start") && len(toks) > 1 && toks[1].Is("transaction"):
+		if s.TxnState.State == Idle {
+			// The implicit transaction, if any, becomes the transaction
+			// block, keeping what it did so far.
+			if !s.TxnState.Implicit {
+				s.beginTxnVars()
+			}
+			s.TxnState.State = Open
+			s.TxnState.Implicit = false
+		}
+
+	case toks[0].Is("commit"), toks[0].Is("end"):
+		if len(toks) > 1 && toks[1].Is("prepared") {
+			return
+		}
+		if s.TxnState.State == Idle {
+			// Ends the implicit transaction; another starts with the next
+			// statement.
+			s.EndImplicit(true)
+			return
+		}
+		if s.TxnState.State == Aborted {
+			// COMMIT of a failed transaction rolls it back.
+			s.abortTxnVars()
+			s.notify.abort()
+		} else {
+			s.commitTxnVars()
+			s.notify.commit()
+		}
+		s.TxnState.State = Idle
+
+	case toks[0].Is("rollback"), toks[0].Is("abort"):
+		for _, t := range toks[1:] {
+			if t.Is("to") {
+				// Rolling back to a savepoint recovers an aborted transaction.
+				if s.TxnState.State == Aborted {
+					s.TxnState.State = Open
+				}
+				return
+			}
+			if t.Is("prepared") {
+				return
+			}
+		}
+		if s.TxnState.State == Idle {
+			s.EndImplicit(false)
+			return
+		}
+		s.abortTxnVars()
+		s.notify.abort()
+		s.TxnState.State = Idle
+
+	case toks[0].Is("prepare") && len(toks) > 1 && toks[1].Is("transaction"):
+		s.commitTxnVars()
+		s.notify.commit()
+		s.TxnState.State = Idle
+	}
+}
+
+// FailTransaction marks an open transaction as aborted, after a statement in
+// it failed. An implicit transaction is rolled back when it ends.
+func (s *Session) FailTransaction() {
+	switch s.TxnState.State {
+	case Open:
+		s.TxnState.State = Aborted
+	case Idle:
+		if s.TxnState.Implicit {
+			s.TxnState.ImplicitFailed = true
+		}
+	}
+}
+
+// BeginImplicit starts an implicit transaction for the statements run
+// outside of a transaction block, unless one is already in progress. It
+// reports whether it started one.
+func (s *Session) BeginImplicit() bool {
+	if s.TxnState.State != Idle || s.TxnState.Implicit {
+		return false
+	}
+	s.TxnState.Implicit = true
+	s.TxnState.ImplicitFailed = false
+	s.beginTxnVars()
+	return true
+}
+
+// EndImplicit commits or rolls back the implicit transaction, if one is in
+// progress. It is always rolled back if a statement in it failed.
+func (s *Session) EndImplicit(commit bool) {
+	if !s.TxnState.Implicit {
+		return
+	}
+	if commit && !s.TxnState.ImplicitFailed {
+		s.commitTxnVars()
+		s.notify.commit()
+	} else {
+		s.abortTxnVars()
+		s.notify.abort()
+	}
+	s.TxnState.Implicit = false
+	s.TxnState.ImplicitFailed = false
+	s.TxnState.ImplicitBlock = false
+}
+
+// CheckAborted returns ErrTransactionAborted if the transaction is aborted
+// and stmt does not end it or roll back to a savepoint.
+func (s *Session) CheckAborted(stmt string) error {
+	if s.TxnState.State != Aborted {
+		return nil
+	}
+	toks, err := parser.Scan(stmt)
+	if err != nil || len(toks) == 0 {
+		return ErrTransactionAborted
+	}
+	switch {
+	case toks[0].Is("commit"), toks[0].Is("end"), toks[0].Is("rollback"), toks[0].Is("abort"):
+		return nil
+	case toks[0].Is("prepare") && len(toks) > 1 && toks[1].Is("transaction"):
+		return nil
+	}
+	return ErrTransactionAborted
+}
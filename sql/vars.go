@@ -0,0 +1,385 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/yydzero/mnt/util/datetime"
+	"github.com/yydzero/mnt/util/encoding"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VarFlags describe how a run-time parameter behaves.
+type VarFlags int
+
+const (
+	// GUCReport marks parameters whose changes are reported to the client
+	// with ParameterStatus messages.
+	GUCReport VarFlags = 1 << iota
+	// ReadOnly marks parameters which cannot be changed by SET.
+	ReadOnly
+)
+
+// sessionVar describes a run-time parameter (GUC).
+type sessionVar struct {
+	name  string // Canonical spelling, eg: "DateStyle".
+	value string // Boot value.
+	flags VarFlags
+	desc  string
+
+	// validate checks a new value and returns its canonical form. cur is the
+	// value being replaced. A nil validate accepts any value.
+	validate func(value, cur string) (string, error)
+
+	// vartype is the pg_settings.vartype of the parameter: "bool",
+	// "integer", "enum" or "string".
+	vartype string
+}
+
+// sessionVars is the registry of known parameters, keyed by lower case name.
+var sessionVars = make(map[string]*sessionVar)
+
+func init() {
+	for _, v := range []*sessionVar{
+		{"application_name", "", GUCReport, "Sets the application name to be reported in statistics and logs.", nil, "string"},
+		{"client_encoding", "UTF8", GUCReport, "Sets the client's character set encoding.", validateEncoding, "string"},
+		{"client_min_messages", "notice", 0, "Sets the message levels that are sent to the client.",
+			validateEnum("debug5", "debug4", "debug3", "debug2", "debug1", "log", "notice", "warning", "error"), "enum"},
+		{"DateStyle", datetime.DefaultDateStyle.String(), GUCReport, "Sets the display format for date and time values.", validateDateStyle, "string"},
+		{"extra_float_digits", "0", 0, "Sets the number of digits displayed for floating-point values.", validateInt, "integer"},
+		{"idle_in_transaction_session_timeout", "0", 0, "Sets the maximum allowed idle time within a transaction.", validateMillis, "integer"},
+		{"idle_session_timeout", "0", 0, "Sets the maximum allowed idle time between queries, when not in a transaction.", validateMillis, "integer"},
+		{"integer_datetimes", "on", GUCReport | ReadOnly, "Datetimes are integer based.", nil, "bool"},
+		{"IntervalStyle", "postgres", GUCReport, "Sets the display format for interval values.",
+			validateEnum("postgres", "postgres_verbose", "sql_standard", "iso_8601"), "enum"},
+		{"is_superuser", "on", GUCReport | ReadOnly, "Shows whether the current user is a superuser.", nil, "bool"},
+		{"lock_timeout", "0", 0, "Sets the maximum allowed duration of any wait for a lock.", validateMillis, "integer"},
+		{"search_path", `"$user", public`, 0, "Sets the schema search order for names that are not schema-qualified.", nil, "string"},
+		{"server_encoding", "UTF8", GUCReport | ReadOnly, "Sets the server (database) character set encoding.", nil, "string"},
+		{"server_version", "9.5.0", GUCReport | ReadOnly, "Shows the server version.", nil, "string"},
+		{"session_authorization", "", GUCReport | ReadOnly, "Sets the session user name.", nil, "string"},
+		{"standard_conforming_strings", "on", GUCReport, "Causes '...' strings to treat backslashes literally.", validateBool, "bool"},
+		{"statement_timeout", "0", 0, "Sets the maximum allowed duration of any statement.", validateMillis, "integer"},
+		{"TimeZone", "UTC", GUCReport, "Sets the time zone for displaying and interpreting time stamps.", validateTimeZone, "string"},
+
+		// Greenplum parameters the QD sets on every QE connection.
+		{"gp_command_count", "0", 0, "Shows the number of commands received from the client in this session.", validateInt, "integer"},
+		{"gp_contentid", "-1", 0, "The segment content id of this server.", validateInt, "integer"},
+		{"gp_dbid", "-1", 0, "The database id of this server.", validateInt, "integer"},
+		{"gp_debug_linger", "0", 0, "Number of seconds for QD/QE process to linger upon fatal internal error.", validateInt, "integer"},
+		{"gp_interconnect_type", "udpifc", 0, "Sets the protocol used for inter-node communication.", validateEnum("udpifc", "tcp"), "enum"},
+		{"gp_is_writer", "off", 0, "True in a worker process which can directly update its local database segment.", validateBool, "bool"},
+		{"gp_log_gang", "off", 0, "Sets the verbosity of logged messages pertaining to worker process creation and management.", nil, "string"},
+		{"gp_max_packet_size", "8192", 0, "Sets the max packet size for the Interconnect.", validateInt, "integer"},
+		{"gp_qd_hostname", "", 0, "The hostname of the QD for this session.", nil, "string"},
+		{"gp_qd_port", "0", 0, "The port of the QD for this session.", validateInt, "integer"},
+		{"gp_role", "utility", 0, "Sets the role for the session.", validateEnum("dispatch", "execute", "utility"), "enum"},
+		{"gp_session_id", "-1", 0, "Global ID used to uniquely identify a particular session in an Greenplum Database array.", validateInt, "integer"},
+		{"gp_vmem_idle_resource_timeout", "18s", 0, "Sets the time a session can be idle (in milliseconds) before we release gangs.", validateMillis, "integer"},
+	} {
+		sessionVars[strings.ToLower(v.name)] = v
+	}
+}
+
+// lookupVar returns the definition of a parameter. Custom parameters, whose
+// names contain a dot, are created on demand as in PostgreSQL.
+func lookupVar(name string) (*sessionVar, error) {
+	name = strings.ToLower(name)
+	if v, ok := sessionVars[name]; ok {
+		return v, nil
+	}
+	if strings.Contains(name, ".") {
+		return &sessionVar{name: name, vartype: "string"}, nil
+	}
+	return nil, NewPGError(CodeUndefinedObjectError, "unrecognized configuration parameter %q", name)
+}
+
+func validateEncoding(value, cur string) (string, error) {
+	e, err := encoding.Lookup(value)
+	if err != nil {
+		return "", err
+	}
+	return e.Name, nil
+}
+
+func validateDateStyle(value, cur string) (string, error) {
+	curStyle, err := datetime.ParseDateStyle(cur, datetime.DefaultDateStyle)
+	if err != nil {
+		curStyle = datetime.DefaultDateStyle
+	}
+	d, err := datetime.ParseDateStyle(value, curStyle)
+	if err != nil {
+		return "", err
+	}
+	return d.String(), nil
+}
+
+func validateTimeZone(value, cur string) (string, error) {
+	if _, err := datetime.LoadLocation(value); err != nil {
+		return "", fmt.Errorf("invalid value for parameter \"TimeZone\": %q", value)
+	}
+	return value, nil
+}
+
+func validateEnum(values ...string) func(string, string) (string, error) {
+	return func(value, cur string) (string, error) {
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("invalid value %q, available values: %s", value, strings.Join(values, ", "))
+	}
+}
+
+func validateBool(value, cur string) (string, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1", "t", "y":
+		return "on", nil
+	case "off", "false", "no", "0", "f", "n":
+		return "off", nil
+	}
+	return "", fmt.Errorf("requires a Boolean value")
+}
+
+func validateInt(value, cur string) (string, error) {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value %q, requires an integer value", value)
+	}
+	return strconv.FormatInt(i, 10), nil
+}
+
+// millisUnits are the time units accepted by parameters measured in
+// milliseconds, largest first.
+var millisUnits = []struct {
+	unit   string
+	millis int64
+}{
+	{"d", 24 * 60 * 60 * 1000},
+	{"h", 60 * 60 * 1000},
+	{"min", 60 * 1000},
+	{"s", 1000},
+	{"ms", 1},
+}
+
+// ParseMillis parses a duration parameter such as "500", "30s" or "2min".
+// Values without a unit are in milliseconds.
+func ParseMillis(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	i := 0
+	for i < len(value) && (value[i] == '-' || ('0' <= value[i] && value[i] <= '9')) {
+		i++
+	}
+	n, err := strconv.ParseInt(value[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q, requires an integer value", value)
+	}
+	unit := strings.TrimSpace(value[i:])
+	if unit == "" {
+		return time.Duration(n) * time.Millisecond, nil
+	}
+	for _, u := range millisUnits {
+		if u.unit == unit {
+			return time.Duration(n*u.millis) * time.Millisecond, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid value %q, valid units are \"ms\", \"s\", \"min\", \"h\", and \"d\"", value)
+}
+
+func validateMillis(value, cur string) (string, error) {
+	d, err := ParseMillis(value)
+	if err != nil {
+		return "", err
+	}
+	ms := int64(d / time.Millisecond)
+	if ms == 0 {
+		return "0", nil
+	}
+	for _, u := range millisUnits {
+		if ms%u.millis == 0 {
+			return strconv.FormatInt(ms/u.millis, 10) + u.unit, nil
+		}
+	}
+	return strconv.FormatInt(ms, 10) + "ms", nil
+}
+
+// Setting is the current value of a run-time parameter.
+type Setting struct {
+	Name  string
+	Value string
+	Desc  string
+	Flags VarFlags
+	// Type is the kind of value the parameter takes, as in
+	// pg_settings.vartype.
+	Type string
+}
+
+// varValues holds the values of run-time parameters for a session.
+type varValues struct {
+	// reset holds the values RESET returns to: the boot value overridden by
+	// the startup packet.
+	reset map[string]string
+	// session holds values set by SET.
+	session map[string]string
+	// local holds values set by SET LOCAL, discarded when the transaction
+	// ends.
+	local map[string]string
+	// saved is a copy of session taken when a transaction starts, restored
+	// if the transaction rolls back.
+	saved map[string]string
+}
+
+func copyVars(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// GetVar returns the current value of a run-time parameter.
+func (s *Session) GetVar(name string) (string, error) {
+	v, err := lookupVar(name)
+	if err != nil {
+		return "", err
+	}
+	key := strings.ToLower(v.name)
+	if value, ok := s.vars.local[key]; ok {
+		return value, nil
+	}
+	if value, ok := s.vars.session[key]; ok {
+		return value, nil
+	}
+	if value, ok := s.vars.reset[key]; ok {
+		return value, nil
+	}
+	return v.value, nil
+}
+
+// SetVar changes a run-time parameter. A local change only lasts until the
+// end of the current transaction, explicit or implicit, and has no effect
+// outside of one.
+func (s *Session) SetVar(name, value string, local bool) error {
+	v, err := lookupVar(name)
+	if err != nil {
+		return err
+	}
+	if v.flags&ReadOnly != 0 {
+		return NewPGError(CodeCantChangeRuntimeParamError, "parameter %q cannot be changed", v.name)
+	}
+	cur, _ := s.GetVar(v.name)
+	if v.validate != nil {
+		if value, err = v.validate(value, cur); err != nil {
+			return NewPGError(CodeInvalidParameterValueError, "%s", err)
+		}
+	}
+
+	key := strings.ToLower(v.name)
+	if local {
+		if s.TxnState.State == Idle && !s.TxnState.Implicit {
+			return nil
+		}
+		s.vars.local[key] = value
+		return nil
+	}
+	s.vars.session[key] = value
+	delete(s.vars.local, key)
+	return nil
+}
+
+// initVar sets the value RESET returns a parameter to; it is used for
+// parameters from the startup packet. Read-only parameters may be set.
+func (s *Session) initVar(name, value string) error {
+	v, err := lookupVar(name)
+	if err != nil {
+		return err
+	}
+	if v.validate != nil {
+		if value, err = v.validate(value, v.value); err != nil {
+			return NewPGError(CodeInvalidParameterValueError, "%s", err)
+		}
+	}
+	s.vars.reset[strings.ToLower(v.name)] = value
+	return nil
+}
+
+// ResetVar returns a run-time parameter to its reset value.
+func (s *Session) ResetVar(name string) error {
+	v, err := lookupVar(name)
+	if err != nil {
+		return err
+	}
+	if v.flags&ReadOnly != 0 {
+		return NewPGError(CodeCantChangeRuntimeParamError, "parameter %q cannot be changed", v.name)
+	}
+	key := strings.ToLower(v.name)
+	delete(s.vars.session, key)
+	delete(s.vars.local, key)
+	return nil
+}
+
+// ResetAllVars returns every run-time parameter to its reset value.
+func (s *Session) ResetAllVars() {
+	s.vars.session = make(map[string]string)
+	s.vars.local = make(map[string]string)
+}
+
+// Settings returns the values of all run-time parameters, sorted by name.
+func (s *Session) Settings() []Setting {
+	names := make(map[string]bool)
+	for key := range sessionVars {
+		names[key] = true
+	}
+	for _, m := range []map[string]string{s.vars.reset, s.vars.session, s.vars.local} {
+		for key := range m {
+			names[key] = true
+		}
+	}
+
+	settings := make([]Setting, 0, len(names))
+	for key := range names {
+		v, err := lookupVar(key)
+		if err != nil {
+			continue
+		}
+		value, _ := s.GetVar(key)
+		settings = append(settings, Setting{Name: v.name, Value: value, Desc: v.desc, Flags: v.flags, Type: v.vartype})
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return strings.ToLower(settings[i].Name) < strings.ToLower(settings[j].Name)
+	})
+	return settings
+}
+
+// ReportedSettings returns the parameters reported to the client with
+// ParameterStatus messages.
+func (s *Session) ReportedSettings() []Setting {
+	var reported []Setting
+	for _, setting := range s.Settings() {
+		if setting.Flags&GUCReport != 0 {
+			reported = append(reported, setting)
+		}
+	}
+	return reported
+}
+
+// beginTxnVars, commitTxnVars and abortTxnVars maintain parameter values
+// across transaction boundaries.
+func (s *Session) beginTxnVars() {
+	s.vars.saved = copyVars(s.vars.session)
+}
+
+func (s *Session) commitTxnVars() {
+	s.vars.local = make(map[string]string)
+	s.vars.saved = nil
+}
+
+func (s *Session) abortTxnVars() {
+	if s.vars.saved != nil {
+		s.vars.session = s.vars.saved
+	}
+	s.vars.local = make(map[string]string)
+	s.vars.saved = nil
+}
@@ -0,0 +1,109 @@
+// Package datetime implements the PostgreSQL date/time output styles.
+package datetime
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DateFormat is the output format part of DateStyle.
+type DateFormat int
+
+const (
+	ISO DateFormat = iota
+	SQL
+	Postgres
+	German
+)
+
+// DateOrder is the field order part of DateStyle, used to interpret and
+// display ambiguous dates.
+type DateOrder int
+
+const (
+	MDY DateOrder = iota
+	DMY
+	YMD
+)
+
+// DateStyle is a parsed value of the DateStyle run-time parameter.
+type DateStyle struct {
+	Format DateFormat
+	Order  DateOrder
+}
+
+// DefaultDateStyle is the boot value of DateStyle.
+var DefaultDateStyle = DateStyle{Format: ISO, Order: MDY}
+
+// ParseDateStyle parses a DateStyle setting such as "SQL, DMY". Parts that
+// are not specified are taken from cur, as PostgreSQL does.
+func ParseDateStyle(s string, cur DateStyle) (DateStyle, error) {
+	d := cur
+	haveFormat, haveOrder := false, false
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var conflict bool
+		switch strings.ToLower(part) {
+		case "iso":
+			conflict, d.Format = haveFormat && d.Format != ISO, ISO
+			haveFormat = true
+		case "sql":
+			conflict, d.Format = haveFormat && d.Format != SQL, SQL
+			haveFormat = true
+		case "postgres":
+			conflict, d.Format = haveFormat && d.Format != Postgres, Postgres
+			haveFormat = true
+		case "german":
+			conflict, d.Format = haveFormat && d.Format != German, German
+			haveFormat = true
+			// German also sets DMY, unless explicitly overridden.
+			if !haveOrder {
+				d.Order = DMY
+			}
+		case "ymd":
+			conflict, d.Order = haveOrder && d.Order != YMD, YMD
+			haveOrder = true
+		case "dmy", "euro", "european":
+			conflict, d.Order = haveOrder && d.Order != DMY, DMY
+			haveOrder = true
+		case "mdy", "us", "noneuro", "noneuropean":
+			conflict, d.Order = haveOrder && d.Order != MDY, MDY
+			haveOrder = true
+		case "default":
+			d = DefaultDateStyle
+			haveFormat, haveOrder = true, true
+		default:
+			return cur, fmt.Errorf("unrecognized \"DateStyle\" key word: %q", part)
+		}
+		if conflict {
+			return cur, fmt.Errorf("conflicting \"DateStyle\" specifications")
+		}
+	}
+	return d, nil
+}
+
+func (f DateFormat) String() string {
+	switch f {
+	case SQL:
+		return "SQL"
+	case Postgres:
+		return "Postgres"
+	case German:
+		return "German"
+	}
+	return "ISO"
+}
+
+func (o DateOrder) String() string {
+	switch o {
+	case DMY:
+		return "DMY"
+	case YMD:
+		return "YMD"
+	}
+	return "MDY"
+}
+
+// String returns the canonical form of d, eg: "ISO, MDY".
+func (d DateStyle) String() string {
+	return d.Format.String() + ", " + d.Order.String()
+}
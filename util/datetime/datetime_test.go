@@ -0,0 +1,106 @@
+package datetime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	ny, err := LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := LoadLocation("+05:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 1, 2, 15, 4, 5, 123456789, time.UTC)
+
+	tests := []struct {
+		style    string
+		loc      *time.Location
+		t        time.Time
+		expected string
+	}{
+		{"ISO, MDY", time.UTC, ts, "2016-01-02 15:04:05.123456+00"},
+		{"ISO, MDY", ny, ts, "2016-01-02 10:04:05.123456-05"},
+		{"ISO, MDY", kolkata, ts, "2016-01-02 20:34:05.123456+05:30"},
+		{"ISO, MDY", time.UTC, ts.Truncate(time.Second), "2016-01-02 15:04:05+00"},
+		{"SQL, MDY", ny, ts, "01/02/2016 10:04:05.123456 EST"},
+		{"SQL, DMY", ny, ts, "02/01/2016 10:04:05.123456 EST"},
+		{"SQL, DMY", kolkata, ts, "02/01/2016 20:34:05.123456 +05:30"},
+		{"Postgres, MDY", ny, ts, "Sat Jan 02 10:04:05.123456 2016 EST"},
+		{"Postgres, DMY", ny, ts, "Sat 02 Jan 10:04:05.123456 2016 EST"},
+		{"German", ny, ts, "02.01.2016 10:04:05.123456 EST"},
+		{"ISO", time.UTC, time.Date(0, 3, 1, 0, 0, 0, 0, time.UTC), "0001-03-01 00:00:00+00 BC"},
+	}
+	for _, test := range tests {
+		style, err := ParseDateStyle(test.style, DefaultDateStyle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := FormatTimestamp(test.t, style, test.loc)
+		if s != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.style, test.expected, s)
+		}
+
+		// Everything we output must be accepted as input.
+		parsed, err := ParseTimestamp(s, style.Order, test.loc)
+		if err != nil {
+			t.Errorf("%s: could not parse %q: %s", test.style, s, err)
+		} else if !parsed.Equal(test.t.Truncate(time.Microsecond)) {
+			t.Errorf("%s: %q parsed as %s", test.style, s, parsed)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	d := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		style    string
+		expected string
+	}{
+		{"ISO, MDY", "2016-01-02"},
+		{"SQL, MDY", "01/02/2016"},
+		{"SQL, DMY", "02/01/2016"},
+		{"Postgres, MDY", "01-02-2016"},
+		{"Postgres, DMY", "02-01-2016"},
+		{"German", "02.01.2016"},
+	} {
+		style, _ := ParseDateStyle(test.style, DefaultDateStyle)
+		if s := FormatDate(d, style); s != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.style, test.expected, s)
+		}
+		if parsed, err := ParseDate(test.expected, style.Order); err != nil || !parsed.Equal(d) {
+			t.Errorf("%s: %q parsed as %s, %v", test.style, test.expected, parsed, err)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		expected time.Time
+	}{
+		{"2016-01-02T15:04:05.5Z", time.Date(2016, 1, 2, 15, 4, 5, 5e8, time.UTC)},
+		{"2016-01-02 15:04:05-07", time.Date(2016, 1, 2, 22, 4, 5, 0, time.UTC)},
+		{"2016-01-02 15:04:05 +0530", time.Date(2016, 1, 2, 9, 34, 5, 0, time.UTC)},
+		{"2016-01-02", time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"20160102 15:04", time.Date(2016, 1, 2, 15, 4, 0, 0, time.UTC)},
+		{"January 2, 2016 15:04:05 UTC", time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"02-Jan-16", time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)},
+	} {
+		ts, err := ParseTimestamp(test.s, MDY, time.UTC)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.s, err)
+		} else if !ts.Equal(test.expected) {
+			t.Errorf("%q: expected %s, got %s", test.s, test.expected, ts)
+		}
+	}
+
+	for _, s := range []string{"", "yesterday-ish", "2016-02-30", "2016-01-02 25:00", "2016-01-02 10:00 XYZ"} {
+		if _, err := ParseTimestamp(s, MDY, time.UTC); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
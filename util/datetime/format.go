@@ -0,0 +1,199 @@
+package datetime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadLocation returns the location for a TimeZone setting. Besides the
+// names known to time.LoadLocation, it accepts fixed ISO 8601 offsets such
+// as "+08" or "-05:30".
+func LoadLocation(name string) (*time.Location, error) {
+	if name != "" && (name[0] == '+' || name[0] == '-') {
+		offset, ok := parseOffset(name)
+		if !ok {
+			return nil, fmt.Errorf("time zone %q not recognized", name)
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	switch strings.ToUpper(name) {
+	case "UTC", "GMT", "Z", "ZULU":
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || strings.EqualFold(name, "local") {
+		return nil, fmt.Errorf("time zone %q not recognized", name)
+	}
+	return loc, nil
+}
+
+// FormatTimestamp formats t as a timestamp with time zone, in loc and the
+// given style, eg: "2016-01-02 15:04:05.123456+08" for ISO.
+func FormatTimestamp(t time.Time, style DateStyle, loc *time.Location) string {
+	t = t.In(loc).Truncate(time.Microsecond)
+	year, bc := pgYear(t.Year())
+	abbrev, offset := t.Zone()
+
+	var b []byte
+	switch style.Format {
+	case ISO:
+		b = appendISODate(b, year, t.Month(), t.Day())
+		b = append(b, ' ')
+		b = appendClock(b, t)
+		b = appendOffset(b, offset)
+	case SQL, German:
+		b = appendNumericDate(b, style, year, t.Month(), t.Day())
+		b = append(b, ' ')
+		b = appendClock(b, t)
+		b = append(b, ' ')
+		b = appendZone(b, abbrev, offset)
+	case Postgres:
+		b = append(b, t.Weekday().String()[:3]...)
+		b = append(b, ' ')
+		if style.Order == DMY {
+			b = appendInt(b, t.Day(), 2)
+			b = append(b, ' ')
+			b = append(b, t.Month().String()[:3]...)
+		} else {
+			b = append(b, t.Month().String()[:3]...)
+			b = append(b, ' ')
+			b = appendInt(b, t.Day(), 2)
+		}
+		b = append(b, ' ')
+		b = appendClock(b, t)
+		b = append(b, ' ')
+		b = appendInt(b, year, 4)
+		b = append(b, ' ')
+		b = appendZone(b, abbrev, offset)
+	}
+	if bc {
+		b = append(b, " BC"...)
+	}
+	return string(b)
+}
+
+// FormatDate formats the date part of t in the given style, eg: "2016-01-02"
+// for ISO or "02.01.2016" for German.
+func FormatDate(t time.Time, style DateStyle) string {
+	year, bc := pgYear(t.Year())
+
+	var b []byte
+	switch style.Format {
+	case ISO:
+		b = appendISODate(b, year, t.Month(), t.Day())
+	case SQL, German:
+		b = appendNumericDate(b, style, year, t.Month(), t.Day())
+	case Postgres:
+		first, second := int(t.Month()), t.Day()
+		if style.Order == DMY {
+			first, second = second, first
+		}
+		b = appendInt(b, first, 2)
+		b = append(b, '-')
+		b = appendInt(b, second, 2)
+		b = append(b, '-')
+		b = appendInt(b, year, 4)
+	}
+	if bc {
+		b = append(b, " BC"...)
+	}
+	return string(b)
+}
+
+// pgYear converts a proleptic Gregorian year, where 0 is 1 BC, into the year
+// PostgreSQL displays.
+func pgYear(year int) (int, bool) {
+	if year <= 0 {
+		return 1 - year, true
+	}
+	return year, false
+}
+
+func appendInt(b []byte, v, width int) []byte {
+	s := strconv.Itoa(v)
+	for i := len(s); i < width; i++ {
+		b = append(b, '0')
+	}
+	return append(b, s...)
+}
+
+func appendISODate(b []byte, year int, month time.Month, day int) []byte {
+	b = appendInt(b, year, 4)
+	b = append(b, '-')
+	b = appendInt(b, int(month), 2)
+	b = append(b, '-')
+	return appendInt(b, day, 2)
+}
+
+// appendNumericDate appends the SQL ("01/02/2016") or German ("02.01.2016")
+// form of a date.
+func appendNumericDate(b []byte, style DateStyle, year int, month time.Month, day int) []byte {
+	sep := byte('/')
+	first, second := int(month), day
+	if style.Format == German {
+		sep = '.'
+		first, second = day, int(month)
+	} else if style.Order == DMY {
+		first, second = day, int(month)
+	}
+	b = appendInt(b, first, 2)
+	b = append(b, sep)
+	b = appendInt(b, second, 2)
+	b = append(b, sep)
+	return appendInt(b, year, 4)
+}
+
+// appendClock appends the time of day, with microseconds if there are any.
+func appendClock(b []byte, t time.Time) []byte {
+	b = appendInt(b, t.Hour(), 2)
+	b = append(b, ':')
+	b = appendInt(b, t.Minute(), 2)
+	b = append(b, ':')
+	b = appendInt(b, t.Second(), 2)
+	return AppendFraction(b, t.Nanosecond()/1000)
+}
+
+// AppendFraction appends a fraction of a second given in microseconds, with
+// trailing zeros removed. Nothing is appended for a zero fraction.
+func AppendFraction(b []byte, micros int) []byte {
+	if micros == 0 {
+		return b
+	}
+	if micros < 0 {
+		micros = -micros
+	}
+	s := strings.TrimRight(fmt.Sprintf("%06d", micros), "0")
+	b = append(b, '.')
+	return append(b, s...)
+}
+
+// appendOffset appends a UTC offset as "+08", "-05:30" or "+05:53:28".
+func appendOffset(b []byte, offset int) []byte {
+	if offset < 0 {
+		b = append(b, '-')
+		offset = -offset
+	} else {
+		b = append(b, '+')
+	}
+	b = appendInt(b, offset/3600, 2)
+	if offset%3600 != 0 {
+		b = append(b, ':')
+		b = appendInt(b, offset%3600/60, 2)
+		if offset%60 != 0 {
+			b = append(b, ':')
+			b = appendInt(b, offset%60, 2)
+		}
+	}
+	return b
+}
+
+// appendZone appends a time zone abbreviation, falling back to the numeric
+// offset for zones which only have numeric abbreviations.
+func appendZone(b []byte, abbrev string, offset int) []byte {
+	if abbrev == "" || abbrev[0] == '+' || abbrev[0] == '-' {
+		return appendOffset(b, offset)
+	}
+	return append(b, abbrev...)
+}
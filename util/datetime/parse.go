@@ -0,0 +1,376 @@
+package datetime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ParseTimestamp parses a timestamp in any of the DateStyle output formats,
+// or ISO 8601 / RFC 3339. Ambiguous numeric dates are read in the given field
+// order, and timestamps without a time zone are taken to be in loc.
+func ParseTimestamp(s string, order DateOrder, loc *time.Location) (time.Time, error) {
+	f, err := parseFields(s, order)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid input syntax for type timestamp with time zone: %q", s)
+	}
+	return f.time(s, loc)
+}
+
+// ParseDate parses a date, as ParseTimestamp does. Any time of day or zone is
+// ignored. The result is midnight UTC on that date.
+func ParseDate(s string, order DateOrder) (time.Time, error) {
+	f, err := parseFields(s, order)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid input syntax for type date: %q", s)
+	}
+	f.hour, f.min, f.sec, f.nsec = 0, 0, 0, 0
+	f.zone, f.abbrev, f.hasOffset = nil, "", false
+	return f.time(s, time.UTC)
+}
+
+// fields holds the parts of a date/time string found by parseFields.
+type fields struct {
+	year, month, day       int
+	hour, min, sec, nsec   int
+	haveDate, haveTime, bc bool
+
+	// The time zone is one of zone, a fixed offset, or an abbreviation which
+	// must match the session time zone.
+	zone      *time.Location
+	offset    int
+	hasOffset bool
+	abbrev    string
+}
+
+var monthNames = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+var weekdayNames = map[string]bool{
+	"sun": true, "mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true,
+}
+
+func parseFields(s string, order DateOrder) (*fields, error) {
+	f := &fields{}
+	var numbers []string
+	for _, field := range splitFields(s) {
+		lower := strings.ToLower(field)
+		switch {
+		case lower == "bc":
+			f.bc = true
+
+		case lower == "ad":
+
+		case unicode.IsLetter(rune(field[0])):
+			if err := f.parseWord(field, lower); err != nil {
+				return nil, err
+			}
+
+		case (field[0] == '+' || field[0] == '-') && (f.haveDate || f.haveTime):
+			offset, ok := parseOffset(field)
+			if !ok {
+				return nil, fmt.Errorf("bad time zone offset %q", field)
+			}
+			f.offset, f.hasOffset = offset, true
+
+		case strings.Contains(field, ":"):
+			if err := f.parseTime(field); err != nil {
+				return nil, err
+			}
+
+		case strings.IndexAny(field, "-/.") > 0:
+			if err := f.parseDate(field, order); err != nil {
+				return nil, err
+			}
+
+		case isDigits(field) && len(field) == 8 && !f.haveDate:
+			// YYYYMMDD
+			f.year, _ = strconv.Atoi(field[:4])
+			f.month, _ = strconv.Atoi(field[4:6])
+			f.day, _ = strconv.Atoi(field[6:])
+			f.haveDate = true
+
+		case isDigits(field):
+			numbers = append(numbers, field)
+
+		default:
+			return nil, fmt.Errorf("unexpected field %q", field)
+		}
+	}
+
+	// A textual month, as in the Postgres style "Sat Jan 02 15:04:05 2016",
+	// leaves the day and year as bare numbers.
+	if f.month != 0 && !f.haveDate {
+		for _, n := range numbers {
+			v, _ := strconv.Atoi(n)
+			if len(n) > 2 && f.year == 0 {
+				f.year = v
+			} else if f.day == 0 {
+				f.day = v
+			} else if f.year == 0 {
+				f.year = adjustYear(v, len(n))
+			} else {
+				return nil, fmt.Errorf("unexpected field %q", n)
+			}
+		}
+		f.haveDate = f.day != 0 && f.year != 0
+		numbers = nil
+	}
+	if !f.haveDate || len(numbers) > 0 {
+		return nil, fmt.Errorf("missing date")
+	}
+	return f, nil
+}
+
+// splitFields splits s on white space and commas, and separates the date and
+// time of ISO 8601 timestamps such as "2016-01-02T15:04:05Z".
+func splitFields(s string) []string {
+	var out []string
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) {
+		if i := strings.IndexAny(field, "Tt"); i > 0 && i+1 < len(field) &&
+			isDigit(field[i-1]) && isDigit(field[i+1]) {
+			out = append(out, field[:i], field[i+1:])
+			continue
+		}
+		out = append(out, field)
+	}
+	return out
+}
+
+func (f *fields) parseWord(field, lower string) error {
+	if len(lower) >= 3 {
+		if m, ok := monthNames[lower[:3]]; ok && strings.HasPrefix(fullMonthName(m), lower) {
+			f.month = int(m)
+			return nil
+		}
+		if weekdayNames[lower[:3]] {
+			return nil
+		}
+	}
+	switch lower {
+	case "z", "utc", "gmt", "zulu":
+		f.zone = time.UTC
+		return nil
+	}
+	if strings.Contains(field, "/") {
+		loc, err := time.LoadLocation(field)
+		if err != nil {
+			return err
+		}
+		f.zone = loc
+		return nil
+	}
+	f.abbrev = field
+	return nil
+}
+
+func fullMonthName(m time.Month) string {
+	return strings.ToLower(m.String())
+}
+
+// parseTime parses "15:04", "15:04:05" or "15:04:05.999999", optionally
+// followed by a zone such as "Z" or "+08:00".
+func (f *fields) parseTime(field string) error {
+	if f.haveTime {
+		return fmt.Errorf("duplicate time")
+	}
+	clock := field
+	if i := strings.IndexAny(field, "+-Zz"); i > 0 {
+		clock = field[:i]
+		if zone := field[i:]; zone == "Z" || zone == "z" {
+			f.zone = time.UTC
+		} else {
+			offset, ok := parseOffset(zone)
+			if !ok {
+				return fmt.Errorf("bad time zone offset %q", zone)
+			}
+			f.offset, f.hasOffset = offset, true
+		}
+	}
+
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("bad time %q", field)
+	}
+	var err error
+	if f.hour, err = atoi(parts[0]); err != nil {
+		return err
+	}
+	if f.min, err = atoi(parts[1]); err != nil {
+		return err
+	}
+	if len(parts) == 3 {
+		sec := parts[2]
+		if i := strings.IndexByte(sec, '.'); i >= 0 {
+			frac := sec[i+1:]
+			if !isDigits(frac) {
+				return fmt.Errorf("bad fraction %q", field)
+			}
+			if len(frac) > 9 {
+				frac = frac[:9]
+			}
+			f.nsec, _ = strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+			sec = sec[:i]
+		}
+		if f.sec, err = atoi(sec); err != nil {
+			return err
+		}
+	}
+	f.haveTime = true
+	return nil
+}
+
+// parseDate parses a date such as "2016-01-02", "01/02/2016" or
+// "02.01.2016". A leading field of more than two digits is always the year;
+// otherwise the fields are read in the given order.
+func (f *fields) parseDate(field string, order DateOrder) error {
+	if f.haveDate {
+		return fmt.Errorf("duplicate date")
+	}
+	sep := field[strings.IndexAny(field, "-/.")]
+	parts := strings.Split(field, string(sep))
+	if len(parts) != 3 {
+		return fmt.Errorf("bad date %q", field)
+	}
+
+	// Textual months, as in "02-Jan-2016".
+	var month string
+	for i, p := range parts {
+		if m, ok := monthNames[strings.ToLower(p)]; ok {
+			month, f.month = p, int(m)
+			parts = append(parts[:i:i], parts[i+1:]...)
+			break
+		}
+	}
+
+	var nums []int
+	for _, p := range parts {
+		v, err := atoi(p)
+		if err != nil {
+			return err
+		}
+		nums = append(nums, v)
+	}
+
+	switch {
+	case month != "":
+		if len(parts[0]) > 2 {
+			f.year, f.day = nums[0], nums[1]
+		} else {
+			f.day, f.year = nums[0], adjustYear(nums[1], len(parts[1]))
+		}
+	case len(parts[0]) > 2 || order == YMD:
+		f.year, f.month, f.day = adjustYear(nums[0], len(parts[0])), nums[1], nums[2]
+	case order == DMY || sep == '.':
+		f.day, f.month, f.year = nums[0], nums[1], adjustYear(nums[2], len(parts[2]))
+	default:
+		f.month, f.day, f.year = nums[0], nums[1], adjustYear(nums[2], len(parts[2]))
+	}
+	f.haveDate = true
+	return nil
+}
+
+// time assembles the fields into a time, in loc unless a zone was given.
+func (f *fields) time(s string, loc *time.Location) (time.Time, error) {
+	year := f.year
+	if f.bc {
+		year = 1 - year
+	}
+	if f.month < 1 || f.month > 12 || f.day < 1 || f.hour > 24 || f.min > 59 || f.sec > 60 ||
+		(f.hour == 24 && (f.min != 0 || f.sec != 0 || f.nsec != 0)) {
+		return time.Time{}, fmt.Errorf("date/time field value out of range: %q", s)
+	}
+
+	zone := loc
+	switch {
+	case f.hasOffset:
+		zone = time.FixedZone("", f.offset)
+	case f.zone != nil:
+		zone = f.zone
+	}
+	t := time.Date(year, time.Month(f.month), f.day, f.hour, f.min, f.sec, f.nsec, zone)
+	if t.Day() != f.day && f.hour != 24 {
+		return time.Time{}, fmt.Errorf("date/time field value out of range: %q", s)
+	}
+	if f.abbrev != "" && !f.hasOffset && f.zone == nil {
+		if abbrev, _ := t.Zone(); !strings.EqualFold(abbrev, f.abbrev) {
+			return time.Time{}, fmt.Errorf("time zone %q not recognized", f.abbrev)
+		}
+	}
+	return t, nil
+}
+
+// adjustYear maps two digit years to the nearest year to 2020, as
+// PostgreSQL does.
+func adjustYear(year, digits int) int {
+	if digits != 2 {
+		return year
+	}
+	if year < 70 {
+		return year + 2000
+	}
+	return year + 1900
+}
+
+// parseOffset parses a UTC offset such as "+08", "-0530" or "+05:30:15",
+// returning seconds east of UTC.
+func parseOffset(s string) (int, bool) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	parts := strings.Split(s[1:], ":")
+	if len(parts) == 1 && len(parts[0]) > 2 {
+		// "+0530" or "+053015"
+		digits := parts[0]
+		parts = nil
+		for len(digits) > 2 {
+			parts = append(parts, digits[:2])
+			digits = digits[2:]
+		}
+		parts = append(parts, digits)
+	}
+	if len(parts) > 3 {
+		return 0, false
+	}
+	offset := 0
+	for i, p := range parts {
+		v, err := atoi(p)
+		if err != nil || (i > 0 && (len(p) != 2 || v > 59)) || (i == 0 && v > 15) {
+			return 0, false
+		}
+		offset += v * []int{3600, 60, 1}[i]
+	}
+	return sign * offset, true
+}
+
+func atoi(s string) (int, error) {
+	if !isDigits(s) {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return strconv.Atoi(s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -24,6 +24,27 @@ const (
 // have overflowed or underflowed.
 var ErrEncodeOverflow = errors.New("overflow during Encode")
 
+// ErrDecodeOverflow is returned by Decode and DecodeBigInt when the nanos of
+// the decoded Duration would have overflowed or underflowed.
+var ErrDecodeOverflow = errors.New("overflow during Decode")
+
+// ErrIntervalOverflow is returned by the checked arithmetic methods when the
+// result does not fit in a Duration (SQLSTATE 22015).
+var ErrIntervalOverflow = errors.New("interval out of range")
+
+// ErrTimestampOverflow is returned by CheckedAddTime when the result is
+// outside the range of a PostgreSQL timestamp (SQLSTATE 22008).
+var ErrTimestampOverflow = errors.New("timestamp out of range")
+
+// ErrDivisionByZero is returned by CheckedDiv (SQLSTATE 22012).
+var ErrDivisionByZero = errors.New("division by zero")
+
+// The range of a PostgreSQL timestamp: 4714-11-24 BC to 294276-12-31 AD.
+var (
+	minTimestamp = time.Date(-4713, time.November, 24, 0, 0, 0, 0, time.UTC)
+	maxTimestamp = time.Date(294276, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+)
+
 // A Duration represents a length of time.
 //
 // A duration of "1 month" cannot be represented as a fixed number of
@@ -35,8 +56,8 @@ var ErrEncodeOverflow = errors.New("overflow during Encode")
 // For the purposes of Compare and Encode, 1 month is considered equivalent to
 // 30 days and 1 day is equivalent to 24 * 60 * 60 * 1E9 nanoseconds.
 //
-// TODO: Until the overflow and underflow handling is fixed, this is only
-// useful for durations of < 292 years.
+// The arithmetic methods wrap on overflow; the Checked variants return an
+// error instead and should be used for values that come from users.
 type Duration struct {
 	Months int64
 	Days   int64
@@ -71,19 +92,16 @@ func (d Duration) String() string {
 
 // Encode returns three integers such that the original Duration is recoverable
 // (using Decode) and the first int will approximately sort a collection of
-// encoded Durations.
+// encoded Durations. ErrEncodeOverflow is returned if sortNanos does not fit in
+// an int64, in which case EncodeBigInt can be used instead.
 func (d Duration) Encode() (sortNanos int64, months int64, days int64, err error) {
-	// The number of whole years equivalent to any value of Duration always fits
-	// in an int64. Use this to compute a conservative estimate of overflow.
-	//
-	// TODO(dan): Compute overflow exactly, then document that EncodeBigInt can be
-	// used in overflow cases.
-	years := d.Months/12 + d.Days/daysInMonth/12 + d.Nanos/nanosInMonth/12
-	if years > maxYearsInDuration || years < minYearsInDuration {
+	monthNanos, ok1 := mulInt64(d.Months, nanosInMonth)
+	dayNanos, ok2 := mulInt64(d.Days, nanosInDay)
+	totalNanos, ok3 := addInt64(monthNanos, dayNanos)
+	totalNanos, ok4 := addInt64(totalNanos, d.Nanos)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
 		return 0, 0, 0, ErrEncodeOverflow
 	}
-
-	totalNanos := d.Months*nanosInMonth + d.Days*nanosInDay + d.Nanos
 	return totalNanos, d.Months, d.Days, nil
 }
 
@@ -100,22 +118,56 @@ func (d Duration) EncodeBigInt() (sortNanos *big.Int, months int64, days int64)
 }
 
 // Decode reverses the three integers returned from Encode and produces an equal
-// Duration to the original.
+// Duration to the original. ErrDecodeOverflow is returned for inputs that did
+// not come from Encode and would overflow.
 func Decode(sortNanos int64, months int64, days int64) (Duration, error) {
-	nanos := sortNanos - months*nanosInMonth - days*nanosInDay
-	// TODO(dan): Handle underflow, then document that DecodeBigInt can be used
-	// in underflow cases.
+	monthNanos, ok1 := mulInt64(months, nanosInMonth)
+	dayNanos, ok2 := mulInt64(days, nanosInDay)
+	nanos, ok3 := subInt64(sortNanos, monthNanos)
+	nanos, ok4 := subInt64(nanos, dayNanos)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return Duration{}, ErrDecodeOverflow
+	}
 	return Duration{Months: months, Days: days, Nanos: nanos}, nil
 }
 
-// TODO(dan): Write DecodeBigInt.
+// DecodeBigInt reverses EncodeBigInt.
+func DecodeBigInt(sortNanos *big.Int, months int64, days int64) (Duration, error) {
+	bigMonths := big.NewInt(months)
+	bigMonths.Mul(bigMonths, big.NewInt(nanosInMonth))
+	bigDays := big.NewInt(days)
+	bigDays.Mul(bigDays, big.NewInt(nanosInDay))
+	nanos := new(big.Int).Set(sortNanos)
+	nanos.Sub(nanos, bigMonths).Sub(nanos, bigDays)
+	if !nanos.IsInt64() {
+		return Duration{}, ErrDecodeOverflow
+	}
+	return Duration{Months: months, Days: days, Nanos: nanos.Int64()}, nil
+}
 
-// Add returns the time t+d.
+// Add returns the time t+d. It does not check for overflow; see
+// CheckedAddTime.
 func Add(t time.Time, d Duration) time.Time {
-	// TODO(dan): Overflow handling.
 	return t.AddDate(0, int(d.Months), int(d.Days)).Add(time.Duration(d.Nanos) * time.Nanosecond)
 }
 
+// CheckedAddTime returns the time t+d, or ErrTimestampOverflow if it is
+// outside the range of a PostgreSQL timestamp.
+func CheckedAddTime(t time.Time, d Duration) (time.Time, error) {
+	// Bound the months and days first, so that AddDate cannot wrap. Anything
+	// larger is out of range whatever t is.
+	const maxMonths = 12 * 300000
+	const maxDays = 366 * 300000
+	if d.Months > maxMonths || d.Months < -maxMonths || d.Days > maxDays || d.Days < -maxDays {
+		return time.Time{}, ErrTimestampOverflow
+	}
+	r := Add(t, d)
+	if r.Before(minTimestamp) || r.After(maxTimestamp) {
+		return time.Time{}, ErrTimestampOverflow
+	}
+	return r, nil
+}
+
 // Add returns a Duration representing a time length of d+x.
 func (d Duration) Add(x Duration) Duration {
 	return Duration{d.Months + x.Months, d.Days + x.Days, d.Nanos + x.Nanos}
@@ -136,6 +188,138 @@ func (d Duration) Div(x int64) Duration {
 	return Duration{d.Months / x, d.Days / x, d.Nanos / x}
 }
 
+// CheckedAdd is like Add, but returns ErrIntervalOverflow on overflow.
+func (d Duration) CheckedAdd(x Duration) (Duration, error) {
+	months, ok1 := addInt64(d.Months, x.Months)
+	days, ok2 := addInt64(d.Days, x.Days)
+	nanos, ok3 := addInt64(d.Nanos, x.Nanos)
+	if !ok1 || !ok2 || !ok3 {
+		return Duration{}, ErrIntervalOverflow
+	}
+	return Duration{months, days, nanos}, nil
+}
+
+// CheckedSub is like Sub, but returns ErrIntervalOverflow on overflow.
+func (d Duration) CheckedSub(x Duration) (Duration, error) {
+	months, ok1 := subInt64(d.Months, x.Months)
+	days, ok2 := subInt64(d.Days, x.Days)
+	nanos, ok3 := subInt64(d.Nanos, x.Nanos)
+	if !ok1 || !ok2 || !ok3 {
+		return Duration{}, ErrIntervalOverflow
+	}
+	return Duration{months, days, nanos}, nil
+}
+
+// CheckedMul is like Mul, but returns ErrIntervalOverflow on overflow.
+func (d Duration) CheckedMul(x int64) (Duration, error) {
+	months, ok1 := mulInt64(d.Months, x)
+	days, ok2 := mulInt64(d.Days, x)
+	nanos, ok3 := mulInt64(d.Nanos, x)
+	if !ok1 || !ok2 || !ok3 {
+		return Duration{}, ErrIntervalOverflow
+	}
+	return Duration{months, days, nanos}, nil
+}
+
+// CheckedDiv is like Div, but returns ErrDivisionByZero if x is zero and
+// ErrIntervalOverflow on overflow. The result is truncated to microseconds.
+func (d Duration) CheckedDiv(x int64) (Duration, error) {
+	if x == 0 {
+		return Duration{}, ErrDivisionByZero
+	}
+	if x == -1 && (d.Months == math.MinInt64 || d.Days == math.MinInt64 || d.Nanos == math.MinInt64) {
+		return Duration{}, ErrIntervalOverflow
+	}
+	return d.Div(x).TruncateMicros(), nil
+}
+
+// MulFloat returns d*f, or ErrIntervalOverflow if the result is out of range.
+// As in PostgreSQL, the fractional months of the result cascade into days,
+// and the fractional days into time, using 30 day months and 24 hour days.
+func (d Duration) MulFloat(f float64) (Duration, error) {
+	return d.scale(f, func(v float64) float64 { return v * f })
+}
+
+// DivFloat returns d/f, or ErrDivisionByZero if f is zero. Fractional months
+// and days cascade as they do for MulFloat.
+func (d Duration) DivFloat(f float64) (Duration, error) {
+	if f == 0 {
+		return Duration{}, ErrDivisionByZero
+	}
+	return d.scale(f, func(v float64) float64 { return v / f })
+}
+
+// scale implements MulFloat and DivFloat, following interval_mul and
+// interval_div in PostgreSQL. op applies the factor to one field.
+func (d Duration) scale(f float64, op func(float64) float64) (Duration, error) {
+	months := op(float64(d.Months))
+	days := op(float64(d.Days))
+	if !inInt64Range(months) || !inInt64Range(days) {
+		return Duration{}, ErrIntervalOverflow
+	}
+	var r Duration
+	r.Months = int64(months)
+	r.Days = int64(days)
+
+	monthRemainderDays := roundMicros((months - float64(r.Months)) * daysInMonth)
+	secRemainder := roundMicros((days - float64(r.Days) + monthRemainderDays -
+		math.Trunc(monthRemainderDays)) * secondsInDay)
+	// The cascaded seconds may add up to whole days.
+	if math.Abs(secRemainder) >= secondsInDay {
+		wholeDays := math.Trunc(secRemainder / secondsInDay)
+		r.Days += int64(wholeDays)
+		secRemainder -= wholeDays * secondsInDay
+	}
+	r.Days += int64(monthRemainderDays)
+
+	micros := math.Floor(op(float64(d.Nanos/int64(time.Microsecond))) + secRemainder*1e6 + 0.5)
+	if !inInt64Range(micros) || math.Abs(micros) > math.MaxInt64/float64(time.Microsecond) {
+		return Duration{}, ErrIntervalOverflow
+	}
+	r.Nanos = int64(micros) * int64(time.Microsecond)
+	return r, nil
+}
+
+const secondsInDay = 24 * 60 * 60
+
+// roundMicros rounds a number of days or seconds to microsecond precision,
+// like TSROUND in PostgreSQL.
+func roundMicros(v float64) float64 {
+	return math.Floor(v*1e6+0.5) / 1e6
+}
+
+func inInt64Range(v float64) bool {
+	return !math.IsNaN(v) && v >= math.MinInt64 && v < math.MaxInt64
+}
+
+// TruncateMicros returns d with its nanos truncated toward zero to the
+// microsecond precision of a PostgreSQL interval.
+func (d Duration) TruncateMicros() Duration {
+	d.Nanos -= d.Nanos % int64(time.Microsecond)
+	return d
+}
+
+func addInt64(a, b int64) (int64, bool) {
+	c := a + b
+	return c, (c > a) == (b > 0)
+}
+
+func subInt64(a, b int64) (int64, bool) {
+	c := a - b
+	return c, (c < a) == (b > 0)
+}
+
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if (c < 0) != ((a < 0) != (b < 0)) || c/b != a {
+		return c, false
+	}
+	return c, true
+}
+
 // normalized returns a new Duration transformed using the equivalence rules.
 // Each quantity of days greater than the threshold is moved into months,
 // likewise for nanos. Integer overflow is avoided by partial transformation.
@@ -4,6 +4,7 @@ package duration
 import (
 	"math"
 	"testing"
+	"time"
 )
 
 type durationTest struct {
@@ -111,4 +112,296 @@ func TestNormalize(t *testing.T) {
 			t.Errorf("%d nanos were not normalized [%s]", i, normalized)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestFormat(t *testing.T) {
+	const (
+		hour   = int64(time.Hour)
+		minute = int64(time.Minute)
+		second = int64(time.Second)
+	)
+	tests := []struct {
+		d                                   Duration
+		postgres, verbose, sqlStandard, iso string
+	}{
+		{Duration{},
+			"00:00:00", "@ 0", "0", "PT0S"},
+		{Duration{Months: 14, Days: 3, Nanos: 4*hour + 5*minute + 6*second},
+			"1 year 2 mons 3 days 04:05:06", "@ 1 year 2 mons 3 days 4 hours 5 mins 6 secs", "+1-2 +3 +4:05:06", "P1Y2M3DT4H5M6S"},
+		{Duration{Months: -14, Days: -3, Nanos: -(4*hour + 5*minute + 6*second)},
+			"-1 years -2 mons -3 days -04:05:06", "@ 1 year 2 mons 3 days 4 hours 5 mins 6 secs ago", "-1-2 -3 -4:05:06", "P-1Y-2M-3DT-4H-5M-6S"},
+		{Duration{Months: -1, Days: 3},
+			"-1 mons +3 days", "@ 1 mon -3 days ago", "-0-1 +3 +0:00:00", "P-1M3D"},
+		{Duration{Days: 1},
+			"1 day", "@ 1 day", "1 0:00:00", "P1D"},
+		{Duration{Months: 25},
+			"2 years 1 mon", "@ 2 years 1 mon", "2-1", "P2Y1M"},
+		{Duration{Nanos: 1500 * int64(time.Millisecond)},
+			"00:00:01.5", "@ 1.5 secs", "0:00:01.5", "PT1.5S"},
+		{Duration{Nanos: -(26*hour + 1*second + 1000)},
+			"-26:00:01.000001", "@ 26 hours 1.000001 secs ago", "-26:00:01.000001", "PT-26H-1.000001S"},
+		{Duration{Nanos: 999},
+			"00:00:00", "@ 0", "0", "PT0S"},
+	}
+	for _, test := range tests {
+		for _, check := range []struct {
+			style    Style
+			expected string
+		}{
+			{StylePostgres, test.postgres},
+			{StylePostgresVerbose, test.verbose},
+			{StyleSQLStandard, test.sqlStandard},
+			{StyleISO8601, test.iso},
+		} {
+			if s := test.d.Format(check.style); s != check.expected {
+				t.Errorf("%v in %s: expected %q, got %q", test.d, check.style, check.expected, s)
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	const (
+		hour   = int64(time.Hour)
+		minute = int64(time.Minute)
+		second = int64(time.Second)
+	)
+	full := Duration{Months: 14, Days: 3, Nanos: 4*hour + 5*minute + 6*second + 789*int64(time.Millisecond)}
+	tests := []struct {
+		s        string
+		expected Duration
+	}{
+		{"1 year 2 mons 3 days 04:05:06.789", full},
+		{"@ 1 year 2 mons 3 days 4 hours 5 mins 6.789 secs", full},
+		{"1-2 3 4:05:06.789", full},
+		{"P1Y2M3DT4H5M6.789S", full},
+		{"P0001-02-03T04:05:06.789", full},
+		{"1 yr 2 months 3d 4h 5m 6s 789ms", full},
+		{"@ 1 year 2 mons 3 days 4 hours 5 mins 6.789 secs ago", full.Mul(-1)},
+		{"-1 years -2 mons -3 days -04:05:06.789", full.Mul(-1)},
+		{"-1-2 -3 -4:05:06.789", full.Mul(-1)},
+		{"-1 mons +3 days", Duration{Months: -1, Days: 3}},
+		{"@ 1 mon -3 days ago", Duration{Months: -1, Days: 3}},
+		{"3days", Duration{Days: 3}},
+		{"90", Duration{Nanos: 90 * second}},
+		{"1:30", Duration{Nanos: 90 * minute}},
+		{"1:30.5", Duration{Nanos: 90*second + 500*int64(time.Millisecond)}},
+		{"1.5 years", Duration{Months: 18}},
+		{"1.5 months", Duration{Months: 1, Days: 15}},
+		{"1.5 weeks", Duration{Days: 10, Nanos: 12 * hour}},
+		{"2 decades", Duration{Months: 240}},
+		{"1.000001 us", Duration{Nanos: 1000}},
+		{"PT0S", Duration{}},
+		{"P1W", Duration{Days: 7}},
+		{"PT-1.5S", Duration{Nanos: -1500 * int64(time.Millisecond)}},
+	}
+	for _, test := range tests {
+		d, err := Parse(test.s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.s, err)
+		} else if d != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.s, test.expected, d)
+		}
+	}
+
+	for _, s := range []string{"", "@", "1 fortnight", "day", "1 day day", "1-13", "P1D2Y", "PT", "1:60", "P",
+		"1 year 1 year", "1 2", "1 day 2 days", "1 hour 2:00:00", "1-2 3 mons", "1:00 2:00"} {
+		if d, err := Parse(s); err == nil {
+			t.Errorf("%q: expected an error, got %v", s, d)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%q: expected a syntax error, got %v", s, err)
+		}
+	}
+
+	// In the SQL standard style a single leading sign applies to all fields.
+	if d, err := ParseWithStyle("-1 2:03:04", StyleSQLStandard); err != nil ||
+		d != (Duration{Days: -1, Nanos: -(2*hour + 3*minute + 4*second)}) {
+		t.Errorf("unexpected result %v, %v", d, err)
+	}
+	if d, err := Parse("-1 2:03:04"); err != nil ||
+		d != (Duration{Days: -1, Nanos: 2*hour + 3*minute + 4*second}) {
+		t.Errorf("unexpected result %v, %v", d, err)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, d := range []Duration{
+		{},
+		{Months: 14, Days: 3, Nanos: int64(4*time.Hour + 5*time.Minute + 6*time.Second + time.Microsecond)},
+		{Months: -14, Days: -3, Nanos: -int64(4*time.Hour + 5*time.Minute + 6*time.Second)},
+		{Months: -1, Days: 3, Nanos: -int64(time.Second)},
+		{Nanos: int64(100*time.Hour + 500*time.Millisecond)},
+	} {
+		for _, style := range []Style{StylePostgres, StylePostgresVerbose, StyleSQLStandard, StyleISO8601} {
+			s := d.Format(style)
+			parsed, err := ParseWithStyle(s, style)
+			if err != nil {
+				t.Errorf("%s: %q: unexpected error: %s", style, s, err)
+			} else if parsed != d {
+				t.Errorf("%s: %q: expected %v, got %v", style, s, d, parsed)
+			}
+		}
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	max := Duration{Months: math.MaxInt64, Days: math.MaxInt64, Nanos: math.MaxInt64}
+	one := Duration{Months: 1, Days: 1, Nanos: 1}
+
+	if _, err := max.CheckedAdd(one); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow from CheckedAdd, got %v", err)
+	}
+	if _, err := max.Mul(-1).CheckedSub(one.Mul(2)); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow from CheckedSub, got %v", err)
+	}
+	if _, err := max.CheckedMul(2); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow from CheckedMul, got %v", err)
+	}
+	if _, err := one.CheckedDiv(0); err != ErrDivisionByZero {
+		t.Errorf("expected division by zero, got %v", err)
+	}
+	if _, err := (Duration{Nanos: math.MinInt64}).CheckedDiv(-1); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow from CheckedDiv, got %v", err)
+	}
+
+	if d, err := one.CheckedAdd(one); err != nil || d != (Duration{2, 2, 2}) {
+		t.Errorf("unexpected result %v, %v", d, err)
+	}
+	if d, err := (Duration{Months: 3, Days: 3, Nanos: 3001}).CheckedDiv(2); err != nil ||
+		d != (Duration{Months: 1, Days: 1, Nanos: 1000}) {
+		t.Errorf("unexpected result %v, %v", d, err)
+	}
+	if d := (Duration{Nanos: -1999}).TruncateMicros(); d != (Duration{Nanos: -1000}) {
+		t.Errorf("unexpected result %v", d)
+	}
+
+	ts := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	if r, err := CheckedAddTime(ts, Duration{Months: 1, Days: 1}); err != nil || !r.Equal(time.Date(2016, 2, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected result %v, %v", r, err)
+	}
+	for _, d := range []Duration{{Months: 12 * 300000}, {Months: math.MinInt64}, {Days: math.MaxInt64}} {
+		if _, err := CheckedAddTime(ts, d); err != ErrTimestampOverflow {
+			t.Errorf("%v: expected timestamp overflow, got %v", d, err)
+		}
+	}
+}
+
+func TestDecodeOverflow(t *testing.T) {
+	if _, err := Decode(math.MinInt64, 1, 0); err != ErrDecodeOverflow {
+		t.Errorf("expected overflow from Decode, got %v", err)
+	}
+
+	d := Duration{Months: math.MaxInt64, Days: math.MaxInt64, Nanos: math.MaxInt64}
+	if _, _, _, err := d.Encode(); err != ErrEncodeOverflow {
+		t.Errorf("expected overflow from Encode, got %v", err)
+	}
+	sortNanos, months, days := d.EncodeBigInt()
+	if decoded, err := DecodeBigInt(sortNanos, months, days); err != nil || decoded != d {
+		t.Errorf("expected %v, got %v, %v", d, decoded, err)
+	}
+
+	// Just within range of Encode.
+	d = Duration{Nanos: math.MaxInt64 - nanosInMonth, Months: 1}
+	if _, _, _, err := d.Encode(); err != nil {
+		t.Errorf("unexpected error from Encode: %v", err)
+	}
+}
+
+func TestMulDivFloat(t *testing.T) {
+	const (
+		hour   = int64(time.Hour)
+		minute = int64(time.Minute)
+	)
+	for _, test := range []struct {
+		d        Duration
+		f        float64
+		div      bool
+		expected Duration
+	}{
+		{Duration{Months: 1}, 0.5, false, Duration{Days: 15}},
+		{Duration{Days: 1}, 0.5, false, Duration{Nanos: 12 * hour}},
+		{Duration{Months: 12}, 0.5, false, Duration{Months: 6}},
+		{Duration{Nanos: hour}, 1.5, false, Duration{Nanos: 90 * minute}},
+		{Duration{Months: 1, Days: 1}, 3, true, Duration{Days: 10, Nanos: 8 * hour}},
+		{Duration{Months: -1, Days: -1}, 3, true, Duration{Days: -10, Nanos: -8 * hour}},
+		{Duration{Months: 1, Days: 2, Nanos: 3}, 2, false, Duration{Months: 2, Days: 4}},
+	} {
+		var d Duration
+		var err error
+		if test.div {
+			d, err = test.d.DivFloat(test.f)
+		} else {
+			d, err = test.d.MulFloat(test.f)
+		}
+		if err != nil {
+			t.Errorf("%v, %v: unexpected error: %s", test.d, test.f, err)
+		} else if d != test.expected {
+			t.Errorf("%v, %v: expected %v, got %v", test.d, test.f, test.expected, d)
+		}
+	}
+
+	if _, err := (Duration{Days: 1}).DivFloat(0); err != ErrDivisionByZero {
+		t.Errorf("expected division by zero, got %v", err)
+	}
+	if _, err := (Duration{Days: 1}).MulFloat(math.NaN()); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow, got %v", err)
+	}
+	if _, err := (Duration{Months: math.MaxInt64 / 2}).MulFloat(3); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow, got %v", err)
+	}
+}
+
+func TestJustify(t *testing.T) {
+	const hour = int64(time.Hour)
+	for _, test := range []struct {
+		d                     Duration
+		hours, days, interval Duration
+	}{
+		{Duration{Nanos: 27 * hour},
+			Duration{Days: 1, Nanos: 3 * hour}, Duration{Nanos: 27 * hour}, Duration{Days: 1, Nanos: 3 * hour}},
+		{Duration{Days: 35},
+			Duration{Days: 35}, Duration{Months: 1, Days: 5}, Duration{Months: 1, Days: 5}},
+		{Duration{Days: 1, Nanos: -hour},
+			Duration{Nanos: 23 * hour}, Duration{Days: 1, Nanos: -hour}, Duration{Nanos: 23 * hour}},
+		{Duration{Months: 1, Days: -1},
+			Duration{Months: 1, Days: -1}, Duration{Days: 29}, Duration{Days: 29}},
+		{Duration{Months: 1, Nanos: -hour},
+			Duration{Months: 1, Nanos: -hour}, Duration{Months: 1, Nanos: -hour}, Duration{Days: 29, Nanos: 23 * hour}},
+		{Duration{Months: -1, Days: 0, Nanos: 25 * hour},
+			Duration{Months: -1, Days: 1, Nanos: hour}, Duration{Months: -1, Nanos: 25 * hour}, Duration{Days: -28, Nanos: -23 * hour}},
+	} {
+		if d, err := test.d.JustifyHours(); err != nil || d != test.hours {
+			t.Errorf("JustifyHours(%v): expected %v, got %v, %v", test.d, test.hours, d, err)
+		}
+		if d, err := test.d.JustifyDays(); err != nil || d != test.days {
+			t.Errorf("JustifyDays(%v): expected %v, got %v, %v", test.d, test.days, d, err)
+		}
+		if d, err := test.d.JustifyInterval(); err != nil || d != test.interval {
+			t.Errorf("JustifyInterval(%v): expected %v, got %v, %v", test.d, test.interval, d, err)
+		}
+	}
+
+	if _, err := (Duration{Days: math.MaxInt64, Nanos: 2 * nanosInDay}).JustifyHours(); err != ErrIntervalOverflow {
+		t.Errorf("expected overflow, got %v", err)
+	}
+}
+
+func TestAge(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		t1, t2   time.Time
+		expected Duration
+	}{
+		{date(2016, 3, 1), date(2015, 1, 31), Duration{Months: 13, Days: 1}},
+		{date(2015, 1, 31), date(2016, 3, 1), Duration{Months: -13, Days: -1}},
+		{date(2001, 4, 10), date(1957, 6, 13), Duration{Months: 43*12 + 9, Days: 27}},
+		{time.Date(2016, 1, 2, 1, 0, 0, 0, time.UTC), time.Date(2016, 1, 1, 23, 30, 0, 500, time.UTC),
+			Duration{Nanos: int64(90 * time.Minute)}},
+		{date(2016, 1, 1), date(2016, 1, 1), Duration{}},
+	} {
+		if d := Age(test.t1, test.t2); d != test.expected {
+			t.Errorf("Age(%s, %s): expected %v, got %v", test.t1, test.t2, test.expected, d)
+		}
+	}
+}
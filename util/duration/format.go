@@ -0,0 +1,289 @@
+package duration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Style is a value of the IntervalStyle run-time parameter, which controls
+// the text format of intervals.
+type Style int
+
+const (
+	// StylePostgres is the default: "1 year 2 mons 3 days 04:05:06".
+	StylePostgres Style = iota
+	// StylePostgresVerbose: "@ 1 year 2 mons 3 days 4 hours 5 mins 6 secs".
+	StylePostgresVerbose
+	// StyleSQLStandard: "+1-2 +3 +4:05:06".
+	StyleSQLStandard
+	// StyleISO8601: "P1Y2M3DT4H5M6S".
+	StyleISO8601
+)
+
+var styleNames = []string{"postgres", "postgres_verbose", "sql_standard", "iso_8601"}
+
+// ParseStyle parses an IntervalStyle setting.
+func ParseStyle(s string) (Style, error) {
+	for i, name := range styleNames {
+		if strings.EqualFold(s, name) {
+			return Style(i), nil
+		}
+	}
+	return StylePostgres, fmt.Errorf("invalid value for parameter \"IntervalStyle\": %q", s)
+}
+
+func (s Style) String() string {
+	return styleNames[s]
+}
+
+// fields is a Duration broken down the way PostgreSQL displays it. Months
+// are split into years and months, and nanos into hours, minutes, seconds and
+// microseconds, all of which share the sign of the value they came from.
+type fields struct {
+	year, mon, day, hour, min, sec, usec int64
+}
+
+func (d Duration) fields() fields {
+	usecs := d.Nanos / int64(time.Microsecond)
+	f := fields{year: d.Months / 12, mon: d.Months % 12, day: d.Days}
+	f.hour = usecs / int64(time.Hour/time.Microsecond)
+	usecs -= f.hour * int64(time.Hour/time.Microsecond)
+	f.min = usecs / int64(time.Minute/time.Microsecond)
+	usecs -= f.min * int64(time.Minute/time.Microsecond)
+	f.sec = usecs / int64(time.Second/time.Microsecond)
+	f.usec = usecs - f.sec*int64(time.Second/time.Microsecond)
+	return f
+}
+
+// Format returns the text representation of d in the given style. Nanos are
+// truncated to microseconds, the precision of a PostgreSQL interval.
+func (d Duration) Format(style Style) string {
+	f := d.fields()
+	switch style {
+	case StylePostgresVerbose:
+		return f.formatVerbose()
+	case StyleSQLStandard:
+		return f.formatSQLStandard()
+	case StyleISO8601:
+		return f.formatISO8601()
+	}
+	return f.formatPostgres()
+}
+
+func (f fields) formatPostgres() string {
+	var b []byte
+	isBefore, isZero := false, true
+	for _, part := range []struct {
+		v    int64
+		unit string
+	}{{f.year, "year"}, {f.mon, "mon"}, {f.day, "day"}} {
+		if part.v == 0 {
+			continue
+		}
+		if !isZero {
+			b = append(b, ' ')
+		}
+		if isBefore && part.v > 0 {
+			b = append(b, '+')
+		}
+		b = strconv.AppendInt(b, part.v, 10)
+		b = append(b, ' ')
+		b = append(b, plural(part.unit, part.v)...)
+		isBefore, isZero = part.v < 0, false
+	}
+
+	if !isZero && f.hour == 0 && f.min == 0 && f.sec == 0 && f.usec == 0 {
+		return string(b)
+	}
+	if !isZero {
+		b = append(b, ' ')
+	}
+	if f.hour < 0 || f.min < 0 || f.sec < 0 || f.usec < 0 {
+		b = append(b, '-')
+	} else if isBefore {
+		b = append(b, '+')
+	}
+	b = appendPadded(b, abs(f.hour))
+	b = append(b, ':')
+	b = appendPadded(b, abs(f.min))
+	b = append(b, ':')
+	return string(f.appendSeconds(b, true))
+}
+
+func (f fields) formatVerbose() string {
+	b := []byte{'@'}
+	isBefore, isZero := false, true
+	for _, part := range []struct {
+		v    int64
+		unit string
+	}{{f.year, "year"}, {f.mon, "mon"}, {f.day, "day"}, {f.hour, "hour"}, {f.min, "min"}} {
+		v := part.v
+		if v == 0 {
+			continue
+		}
+		// A negative leading field makes the interval "ago", and later
+		// fields are displayed relative to that.
+		if isZero {
+			isBefore = v < 0
+			v = abs(v)
+		} else if isBefore {
+			v = -v
+		}
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, v, 10)
+		b = append(b, ' ')
+		b = append(b, plural(part.unit, v)...)
+		isZero = false
+	}
+	if f.sec != 0 || f.usec != 0 {
+		b = append(b, ' ')
+		if f.sec < 0 || (f.sec == 0 && f.usec < 0) {
+			if isZero {
+				isBefore = true
+			} else if !isBefore {
+				b = append(b, '-')
+			}
+		} else if isBefore {
+			b = append(b, '-')
+		}
+		b = f.appendSeconds(b, false)
+		b = append(b, " sec"...)
+		if abs(f.sec) != 1 || f.usec != 0 {
+			b = append(b, 's')
+		}
+		isZero = false
+	}
+	if isZero {
+		b = append(b, " 0"...)
+	}
+	if isBefore {
+		b = append(b, " ago"...)
+	}
+	return string(b)
+}
+
+func (f fields) formatSQLStandard() string {
+	hasNegative := f.year < 0 || f.mon < 0 || f.day < 0 || f.hour < 0 || f.min < 0 || f.sec < 0 || f.usec < 0
+	hasPositive := f.year > 0 || f.mon > 0 || f.day > 0 || f.hour > 0 || f.min > 0 || f.sec > 0 || f.usec > 0
+	hasYearMonth := f.year != 0 || f.mon != 0
+	hasDayTime := f.day != 0 || f.hour != 0 || f.min != 0 || f.sec != 0 || f.usec != 0
+	// Only intervals with a single sign and either year-month or day-time
+	// fields can be written as a SQL standard interval literal. Others get
+	// explicit signs on each part.
+	standard := !(hasNegative && hasPositive) && !(hasYearMonth && hasDayTime)
+
+	var b []byte
+	if hasNegative && standard {
+		b = append(b, '-')
+		f = fields{-f.year, -f.mon, -f.day, -f.hour, -f.min, -f.sec, -f.usec}
+	}
+
+	switch {
+	case !hasNegative && !hasPositive:
+		b = append(b, '0')
+	case !standard:
+		b = append(b, sign(f.year < 0 || f.mon < 0))
+		b = strconv.AppendInt(b, abs(f.year), 10)
+		b = append(b, '-')
+		b = strconv.AppendInt(b, abs(f.mon), 10)
+		b = append(b, ' ', sign(f.day < 0))
+		b = strconv.AppendInt(b, abs(f.day), 10)
+		b = append(b, ' ', sign(f.hour < 0 || f.min < 0 || f.sec < 0 || f.usec < 0))
+		b = strconv.AppendInt(b, abs(f.hour), 10)
+		b = append(b, ':')
+		b = appendPadded(b, abs(f.min))
+		b = append(b, ':')
+		b = f.appendSeconds(b, true)
+	case hasYearMonth:
+		b = strconv.AppendInt(b, f.year, 10)
+		b = append(b, '-')
+		b = strconv.AppendInt(b, f.mon, 10)
+	default:
+		if f.day != 0 {
+			b = strconv.AppendInt(b, f.day, 10)
+			b = append(b, ' ')
+		}
+		b = strconv.AppendInt(b, f.hour, 10)
+		b = append(b, ':')
+		b = appendPadded(b, f.min)
+		b = append(b, ':')
+		b = f.appendSeconds(b, true)
+	}
+	return string(b)
+}
+
+func (f fields) formatISO8601() string {
+	if f == (fields{}) {
+		return "PT0S"
+	}
+	b := []byte{'P'}
+	b = appendISOPart(b, f.year, 'Y')
+	b = appendISOPart(b, f.mon, 'M')
+	b = appendISOPart(b, f.day, 'D')
+	if f.hour != 0 || f.min != 0 || f.sec != 0 || f.usec != 0 {
+		b = append(b, 'T')
+	}
+	b = appendISOPart(b, f.hour, 'H')
+	b = appendISOPart(b, f.min, 'M')
+	if f.sec != 0 || f.usec != 0 {
+		if f.sec < 0 || f.usec < 0 {
+			b = append(b, '-')
+		}
+		b = f.appendSeconds(b, false)
+		b = append(b, 'S')
+	}
+	return string(b)
+}
+
+// appendSeconds appends the absolute value of the seconds and microseconds,
+// zero padding the seconds to two digits if pad is set.
+func (f fields) appendSeconds(b []byte, pad bool) []byte {
+	if pad {
+		b = appendPadded(b, abs(f.sec))
+	} else {
+		b = strconv.AppendInt(b, abs(f.sec), 10)
+	}
+	if f.usec != 0 {
+		b = append(b, '.')
+		b = append(b, strings.TrimRight(fmt.Sprintf("%06d", abs(f.usec)), "0")...)
+	}
+	return b
+}
+
+func appendISOPart(b []byte, v int64, unit byte) []byte {
+	if v == 0 {
+		return b
+	}
+	b = strconv.AppendInt(b, v, 10)
+	return append(b, unit)
+}
+
+func appendPadded(b []byte, v int64) []byte {
+	if v < 10 {
+		b = append(b, '0')
+	}
+	return strconv.AppendInt(b, v, 10)
+}
+
+func plural(unit string, v int64) string {
+	if v == 1 {
+		return unit
+	}
+	return unit + "s"
+}
+
+func sign(negative bool) byte {
+	if negative {
+		return '-'
+	}
+	return '+'
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
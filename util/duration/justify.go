@@ -0,0 +1,144 @@
+package duration
+
+import "time"
+
+// JustifyHours moves each whole 24 hours of d's time into days, so that
+// "27 hours" becomes "1 day 03:00:00". The days and time are given the same
+// sign.
+func (d Duration) JustifyHours() (Duration, error) {
+	wholeDays := d.Nanos / nanosInDay
+	d.Nanos -= wholeDays * nanosInDay
+	days, ok := addInt64(d.Days, wholeDays)
+	if !ok {
+		return Duration{}, ErrIntervalOverflow
+	}
+	d.Days = days
+	switch {
+	case d.Days > 0 && d.Nanos < 0:
+		d.Nanos += nanosInDay
+		d.Days--
+	case d.Days < 0 && d.Nanos > 0:
+		d.Nanos -= nanosInDay
+		d.Days++
+	}
+	return d, nil
+}
+
+// JustifyDays moves each whole 30 days of d into months, so that "35 days"
+// becomes "1 mon 5 days". The months and days are given the same sign.
+func (d Duration) JustifyDays() (Duration, error) {
+	wholeMonths := d.Days / daysInMonth
+	d.Days -= wholeMonths * daysInMonth
+	months, ok := addInt64(d.Months, wholeMonths)
+	if !ok {
+		return Duration{}, ErrIntervalOverflow
+	}
+	d.Months = months
+	switch {
+	case d.Months > 0 && d.Days < 0:
+		d.Days += daysInMonth
+		d.Months--
+	case d.Months < 0 && d.Days > 0:
+		d.Days -= daysInMonth
+		d.Months++
+	}
+	return d, nil
+}
+
+// JustifyInterval applies JustifyHours and then JustifyDays, with all the
+// fields of the result given the same sign.
+func (d Duration) JustifyInterval() (Duration, error) {
+	wholeDays := d.Nanos / nanosInDay
+	d.Nanos -= wholeDays * nanosInDay
+	days, ok := addInt64(d.Days, wholeDays)
+	if !ok {
+		return Duration{}, ErrIntervalOverflow
+	}
+	wholeMonths := days / daysInMonth
+	d.Days = days - wholeMonths*daysInMonth
+	if d.Months, ok = addInt64(d.Months, wholeMonths); !ok {
+		return Duration{}, ErrIntervalOverflow
+	}
+
+	switch {
+	case d.Months > 0 && (d.Days < 0 || (d.Days == 0 && d.Nanos < 0)):
+		d.Days += daysInMonth
+		d.Months--
+	case d.Months < 0 && (d.Days > 0 || (d.Days == 0 && d.Nanos > 0)):
+		d.Days -= daysInMonth
+		d.Months++
+	}
+	switch {
+	case d.Days > 0 && d.Nanos < 0:
+		d.Nanos += nanosInDay
+		d.Days--
+	case d.Days < 0 && d.Nanos > 0:
+		d.Nanos -= nanosInDay
+		d.Days++
+	}
+	return d, nil
+}
+
+// Age returns the symbolic difference t1-t2 in years, months and days, as
+// the PostgreSQL age function does, eg: the age of 2016-03-01 relative to
+// 2015-01-31 is "1 year 1 mon 1 day". Both times are taken in the location
+// of t1, and the result is truncated to microseconds.
+func Age(t1, t2 time.Time) Duration {
+	t1 = t1.Truncate(time.Microsecond)
+	t2 = t2.In(t1.Location()).Truncate(time.Microsecond)
+
+	type fields struct{ year, mon, day, hour, min, sec, usec int }
+	f1 := fields{t1.Year(), int(t1.Month()), t1.Day(), t1.Hour(), t1.Minute(), t1.Second(), t1.Nanosecond() / 1000}
+	f2 := fields{t2.Year(), int(t2.Month()), t2.Day(), t2.Hour(), t2.Minute(), t2.Second(), t2.Nanosecond() / 1000}
+	f := fields{
+		f1.year - f2.year, f1.mon - f2.mon, f1.day - f2.day,
+		f1.hour - f2.hour, f1.min - f2.min, f1.sec - f2.sec, f1.usec - f2.usec,
+	}
+
+	// Work with a positive difference, and flip the sign back at the end.
+	before := t1.Before(t2)
+	if before {
+		f = fields{-f.year, -f.mon, -f.day, -f.hour, -f.min, -f.sec, -f.usec}
+	}
+
+	// Borrow from the next larger field for negative fields. Days are
+	// borrowed from the month of the earlier time.
+	for ; f.usec < 0; f.sec-- {
+		f.usec += 1000000
+	}
+	for ; f.sec < 0; f.min-- {
+		f.sec += 60
+	}
+	for ; f.min < 0; f.hour-- {
+		f.min += 60
+	}
+	for ; f.hour < 0; f.day-- {
+		f.hour += 24
+	}
+	for f.day < 0 {
+		ref := t2
+		if before {
+			ref = t1
+		}
+		f.day += daysIn(ref.Year(), ref.Month())
+		f.mon--
+	}
+	for ; f.mon < 0; f.year-- {
+		f.mon += 12
+	}
+
+	if before {
+		f = fields{-f.year, -f.mon, -f.day, -f.hour, -f.min, -f.sec, -f.usec}
+	}
+	return Duration{
+		Months: int64(f.year)*12 + int64(f.mon),
+		Days:   int64(f.day),
+		Nanos: int64(f.hour)*int64(time.Hour) + int64(f.min)*int64(time.Minute) +
+			int64(f.sec)*int64(time.Second) + int64(f.usec)*int64(time.Microsecond),
+	}
+}
+
+// daysIn returns the number of days in the given month.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,432 @@
+package duration
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// unit is an interval unit. Exactly one of months, days and nanos is set.
+type unit struct {
+	months, days, nanos int64
+	field               fieldMask
+}
+
+// fieldMask is a set of the fields of an interval, one for each group of unit
+// names, used like DecodeInterval's fmask to reject a field given twice.
+type fieldMask uint
+
+// units maps the unit names PostgreSQL accepts to their units.
+var units = func() map[string]unit {
+	m := make(map[string]unit)
+	for i, u := range []struct {
+		names []string
+		unit  unit
+	}{
+		{[]string{"millennium", "millennia", "millenniums", "mil", "mils"}, unit{months: 12000}},
+		{[]string{"century", "centuries", "cent", "c"}, unit{months: 1200}},
+		{[]string{"decade", "decades", "dec", "decs"}, unit{months: 120}},
+		{[]string{"year", "years", "y", "yr", "yrs"}, unit{months: 12}},
+		{[]string{"month", "months", "mon", "mons"}, unit{months: 1}},
+		{[]string{"week", "weeks", "w"}, unit{days: 7}},
+		{[]string{"day", "days", "d"}, unit{days: 1}},
+		{[]string{"hour", "hours", "h", "hr", "hrs"}, unit{nanos: int64(time.Hour)}},
+		{[]string{"minute", "minutes", "m", "min", "mins"}, unit{nanos: int64(time.Minute)}},
+		{[]string{"second", "seconds", "s", "sec", "secs"}, unit{nanos: int64(time.Second)}},
+		{[]string{"millisecond", "milliseconds", "ms", "msec", "msecs"}, unit{nanos: int64(time.Millisecond)}},
+		{[]string{"microsecond", "microseconds", "us", "usec", "usecs"}, unit{nanos: int64(time.Microsecond)}},
+	} {
+		u.unit.field = 1 << uint(i)
+		for _, name := range u.names {
+			m[name] = u.unit
+		}
+	}
+	return m
+}()
+
+var (
+	unitSecond = units["second"]
+	unitDay    = units["day"]
+
+	// A time gives the hours, minutes and seconds, and a SQL standard
+	// year-month the years and months.
+	timeFields      = units["hour"].field | units["minute"].field | unitSecond.field
+	yearMonthFields = units["year"].field | units["month"].field
+)
+
+// Parse parses an interval in any of the formats PostgreSQL accepts, eg:
+//
+//	1 year 2 mons 3 days 04:05:06.789
+//	@ 1 year 2 mons 3 days 4 hours 5 mins 6.789 secs ago
+//	1-2 3 4:05:06.789
+//	P1Y2M3DT4H5M6.789S
+//
+// A leading minus sign applies to its own field only, as it does under the
+// default IntervalStyle.
+func Parse(s string) (Duration, error) {
+	return ParseWithStyle(s, StylePostgres)
+}
+
+// ParseWithStyle is like Parse, but follows PostgreSQL in reading a leading
+// minus sign as applying to every field when style is StyleSQLStandard and
+// no other field has a sign, so that "-1 2:03:04" is minus 1 day 2:03:04.
+func ParseWithStyle(s string, style Style) (Duration, error) {
+	str := strings.TrimSpace(s)
+	if style == StyleSQLStandard && strings.HasPrefix(str, "-") && !signedFields(tokenize(str)[1:]) {
+		d, err := parse(str[1:], s)
+		if err != nil {
+			return Duration{}, err
+		}
+		return d.CheckedMul(-1)
+	}
+	return parse(str, s)
+}
+
+func signedFields(tokens []string) bool {
+	for _, tok := range tokens {
+		if tok[0] == '+' || tok[0] == '-' {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(str, orig string) (Duration, error) {
+	if str == "" {
+		return Duration{}, syntaxError(orig)
+	}
+	if str[0] == 'P' || str[0] == 'p' {
+		return parseISO8601(str[1:], orig)
+	}
+	// The "@" of postgres_verbose output is optional noise.
+	str = strings.TrimPrefix(str, "@")
+
+	tokens := tokenize(str)
+	if len(tokens) == 0 {
+		return Duration{}, syntaxError(orig)
+	}
+	ago := false
+	if strings.EqualFold(tokens[len(tokens)-1], "ago") {
+		ago = true
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	// Like PostgreSQL, work from right to left, so that a unit applies to the
+	// number before it, and a number without a unit is seconds unless it
+	// precedes a time, in which case it is days.
+	var d Duration
+	var fmask fieldMask
+	defaultUnit := unitSecond
+	var pending *unit
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		var err error
+		switch {
+		case unicode.IsLetter(rune(tok[0])):
+			u, ok := units[strings.ToLower(tok)]
+			if !ok || pending != nil {
+				return Duration{}, syntaxError(orig)
+			}
+			pending = &u
+
+		case strings.Contains(tok, ":"):
+			if pending != nil || fmask&timeFields != 0 {
+				return Duration{}, syntaxError(orig)
+			}
+			var nanos int64
+			if nanos, err = parseTime(tok); err == ErrIntervalOverflow {
+				return Duration{}, err
+			} else if err != nil {
+				return Duration{}, syntaxError(orig)
+			}
+			if d, err = d.CheckedAdd(Duration{Nanos: nanos}); err != nil {
+				return Duration{}, err
+			}
+			fmask |= timeFields
+			defaultUnit = unitDay
+
+		case strings.Contains(tok[1:], "-"):
+			// SQL standard year-month, eg: "1-2". A sign applies to both.
+			if pending != nil || fmask&yearMonthFields != 0 {
+				return Duration{}, syntaxError(orig)
+			}
+			fmask |= yearMonthFields
+			var months int64
+			if months, err = parseYearMonth(tok); err != nil {
+				return Duration{}, syntaxError(orig)
+			}
+			if d, err = d.CheckedAdd(Duration{Months: months}); err != nil {
+				return Duration{}, err
+			}
+
+		default:
+			u := defaultUnit
+			if pending != nil {
+				u = *pending
+				pending = nil
+			}
+			if fmask&u.field != 0 {
+				return Duration{}, syntaxError(orig)
+			}
+			fmask |= u.field
+			if d, err = addNumber(d, tok, u, orig); err != nil {
+				return Duration{}, err
+			}
+		}
+	}
+	if pending != nil {
+		return Duration{}, syntaxError(orig)
+	}
+	if ago {
+		return d.CheckedMul(-1)
+	}
+	return d, nil
+}
+
+// tokenize splits s into numbers, words, times and year-months, treating
+// white space and commas as separators and separating numbers from units
+// written without a space, as in "3days".
+func tokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c) || c == ',':
+			i++
+			continue
+		case unicode.IsLetter(c):
+			for i < len(s) && unicode.IsLetter(rune(s[i])) {
+				i++
+			}
+		default:
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && !unicode.IsLetter(rune(s[i])) && s[i] != ',' {
+				i++
+			}
+		}
+		tokens = append(tokens, s[start:i])
+	}
+	return tokens
+}
+
+// addNumber adds the number tok in unit u to d. Fractional months and days
+// cascade down to days and nanos, using 30 day months and 24 hour days.
+func addNumber(d Duration, tok string, u unit, orig string) (Duration, error) {
+	v, err := strconv.ParseFloat(tok, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return Duration{}, syntaxError(orig)
+	}
+	whole, frac := math.Modf(v)
+	if math.Abs(whole) >= math.MaxInt64/float64(u.months+u.days+u.nanos) {
+		return Duration{}, ErrIntervalOverflow
+	}
+	n := int64(whole)
+
+	var x Duration
+	switch {
+	case u.months >= 12:
+		// Fractional years and larger only go as far as whole months.
+		x.Months = n*u.months + int64(math.Floor(frac*float64(u.months)+0.5))
+	case u.months != 0:
+		x.Months = n * u.months
+		x = addFractionalDays(x, frac*daysInMonth)
+	case u.days != 0:
+		x.Days = n * u.days
+		x = addFractionalDays(x, frac*float64(u.days))
+	default:
+		x.Nanos = n*u.nanos + roundToMicros(frac*float64(u.nanos))
+	}
+	return d.CheckedAdd(x)
+}
+
+func addFractionalDays(d Duration, days float64) Duration {
+	whole, frac := math.Modf(days)
+	d.Days += int64(whole)
+	d.Nanos += roundToMicros(frac * float64(nanosInDay))
+	return d
+}
+
+// roundToMicros rounds nanos to the microsecond precision of intervals.
+func roundToMicros(nanos float64) int64 {
+	return int64(math.Floor(nanos/1000+0.5)) * 1000
+}
+
+// parseTime parses "[-]h:mm[:ss[.ffffff]]" or "[-]mm:ss.ffffff" as nanos.
+func parseTime(tok string) (int64, error) {
+	sign := int64(1)
+	switch tok[0] {
+	case '-':
+		sign = -1
+		tok = tok[1:]
+	case '+':
+		tok = tok[1:]
+	}
+	parts := strings.Split(tok, ":")
+	if len(parts) > 3 {
+		return 0, syntaxError(tok)
+	}
+	// A fraction on the second field means it holds the seconds.
+	if len(parts) == 2 && strings.Contains(parts[1], ".") {
+		parts = append([]string{"0"}, parts...)
+	}
+	var nanos int64
+	for i, p := range parts {
+		if i < len(parts)-1 || i < 2 {
+			v, err := strconv.ParseInt(p, 10, 64)
+			if err != nil || v < 0 || (i > 0 && v > 59) {
+				return 0, syntaxError(tok)
+			}
+			n, ok := mulInt64(v, []int64{int64(time.Hour), int64(time.Minute)}[i])
+			if !ok {
+				return 0, ErrIntervalOverflow
+			}
+			nanos += n
+			continue
+		}
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || v >= 60 || p[0] == '+' || p[0] == '-' {
+			return 0, syntaxError(tok)
+		}
+		nanos += roundToMicros(v * float64(time.Second))
+	}
+	return sign * nanos, nil
+}
+
+// parseYearMonth parses a SQL standard "[-]y-m" as months.
+func parseYearMonth(tok string) (int64, error) {
+	sign := int64(1)
+	switch tok[0] {
+	case '-':
+		sign = -1
+		tok = tok[1:]
+	case '+':
+		tok = tok[1:]
+	}
+	i := strings.IndexByte(tok, '-')
+	if i < 0 {
+		return 0, syntaxError(tok)
+	}
+	years, err := strconv.ParseInt(tok[:i], 10, 64)
+	if err != nil || years < 0 {
+		return 0, syntaxError(tok)
+	}
+	months, err := strconv.ParseInt(tok[i+1:], 10, 64)
+	if err != nil || months < 0 || months > 11 {
+		return 0, syntaxError(tok)
+	}
+	return sign * (years*12 + months), nil
+}
+
+// parseISO8601 parses the part of an ISO 8601 interval after the "P", in
+// either the format with designators, "1Y2M3DT4H5M6S", or the alternative
+// format, "0001-02-03T04:05:06".
+func parseISO8601(s, orig string) (Duration, error) {
+	if s == "" {
+		return Duration{}, syntaxError(orig)
+	}
+	date, clock := s, ""
+	if i := strings.IndexAny(s, "Tt"); i >= 0 {
+		date, clock = s[:i], s[i+1:]
+		if clock == "" {
+			return Duration{}, syntaxError(orig)
+		}
+	}
+
+	var d Duration
+	if strings.IndexFunc(date+clock, unicode.IsLetter) < 0 {
+		// The alternative format.
+		if date != "" {
+			parts := strings.Split(date, "-")
+			if len(parts) != 3 {
+				return Duration{}, syntaxError(orig)
+			}
+			for i, p := range parts {
+				v, err := strconv.ParseInt(p, 10, 64)
+				if err != nil || v < 0 {
+					return Duration{}, syntaxError(orig)
+				}
+				switch i {
+				case 0:
+					d.Months += v * 12
+				case 1:
+					d.Months += v
+				case 2:
+					d.Days += v
+				}
+			}
+		}
+		if clock != "" {
+			nanos, err := parseTime(clock)
+			if err != nil {
+				return Duration{}, syntaxError(orig)
+			}
+			d.Nanos += nanos
+		}
+		return d, nil
+	}
+
+	var err error
+	if d, err = parseDesignators(d, date, "YMWD", false, orig); err != nil {
+		return Duration{}, err
+	}
+	return parseDesignators(d, clock, "HMS", true, orig)
+}
+
+// parseDesignators parses numbers each followed by one of the designators,
+// which must appear in order. M means months in the date part of an interval
+// and minutes in the time part.
+func parseDesignators(d Duration, s, designators string, timePart bool, orig string) (Duration, error) {
+	for s != "" {
+		i := strings.IndexFunc(s, unicode.IsLetter)
+		if i <= 0 {
+			return Duration{}, syntaxError(orig)
+		}
+		pos := strings.IndexByte(designators, byte(unicode.ToUpper(rune(s[i]))))
+		if pos < 0 {
+			return Duration{}, syntaxError(orig)
+		}
+		var u unit
+		switch designators[pos] {
+		case 'Y':
+			u = units["year"]
+		case 'M':
+			if timePart {
+				u = units["minute"]
+			} else {
+				u = units["month"]
+			}
+		case 'W':
+			u = units["week"]
+		case 'D':
+			u = units["day"]
+		case 'H':
+			u = units["hour"]
+		case 'S':
+			u = units["second"]
+		}
+		var err error
+		if d, err = addNumber(d, s[:i], u, orig); err != nil {
+			return Duration{}, err
+		}
+		designators = designators[pos+1:]
+		s = s[i+1:]
+	}
+	return d, nil
+}
+
+// SyntaxError is returned for input which is not an interval (SQLSTATE
+// 22007).
+type SyntaxError struct {
+	Input string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid input syntax for type interval: %q", e.Input)
+}
+
+func syntaxError(s string) error {
+	return &SyntaxError{Input: s}
+}
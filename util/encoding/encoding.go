@@ -0,0 +1,198 @@
+// Package encoding converts text between UTF8, the server encoding, and the
+// client encodings supported by the server.
+package encoding
+
+import (
+	"bytes"
+	"fmt"
+	xencoding "golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding is a client character set encoding.
+type Encoding struct {
+	// Name is the canonical PostgreSQL name, eg: "LATIN1".
+	Name string
+
+	// enc is nil for encodings which need no conversion.
+	enc xencoding.Encoding
+}
+
+// UTF8 is the server encoding. Text in UTF8 passes through unchanged.
+var UTF8 = &Encoding{Name: "UTF8"}
+
+var encodings = []*Encoding{
+	UTF8,
+	{Name: "SQL_ASCII"},
+	{Name: "LATIN1", enc: charmap.ISO8859_1},
+	{Name: "WIN1252", enc: charmap.Windows1252},
+	{Name: "GBK", enc: simplifiedchinese.GBK},
+	{Name: "GB18030", enc: simplifiedchinese.GB18030},
+	{Name: "EUC_JP", enc: japanese.EUCJP},
+	{Name: "SJIS", enc: japanese.ShiftJIS},
+	{Name: "BIG5", enc: traditionalchinese.Big5},
+}
+
+// aliases maps alternative spellings, normalized by normalizeName, to the
+// canonical name.
+var aliases = map[string]string{
+	"UNICODE":  "UTF8",
+	"ISO88591": "LATIN1",
+	"CP1252":   "WIN1252",
+	"WIN936":   "GBK",
+	"CP936":    "GBK",
+	"SHIFTJIS": "SJIS",
+	"MSKANJI":  "SJIS",
+	"WIN932":   "SJIS",
+	"CP932":    "SJIS",
+	"WIN950":   "BIG5",
+	"CP950":    "BIG5",
+}
+
+// normalizeName upper cases name and drops the separators PostgreSQL
+// ignores when matching encoding names.
+func normalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(name))
+}
+
+// Lookup returns the encoding with the given name or alias.
+func Lookup(name string) (*Encoding, error) {
+	n := normalizeName(name)
+	if canonical, ok := aliases[n]; ok {
+		n = canonical
+	}
+	for _, e := range encodings {
+		if normalizeName(e.Name) == n {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value for parameter \"client_encoding\": %q", name)
+}
+
+// UntranslatableError is returned when a character has no equivalent in the
+// target encoding.
+type UntranslatableError struct {
+	Bytes    []byte
+	From, To string
+}
+
+func (e *UntranslatableError) Error() string {
+	return fmt.Sprintf("character with byte sequence %s in encoding %q has no equivalent in encoding %q",
+		formatBytes(e.Bytes), e.From, e.To)
+}
+
+// InvalidByteSequenceError is returned when input is not valid in its
+// encoding.
+type InvalidByteSequenceError struct {
+	Bytes    []byte
+	Encoding string
+}
+
+func (e *InvalidByteSequenceError) Error() string {
+	return fmt.Sprintf("invalid byte sequence for encoding %q: %s", e.Encoding, formatBytes(e.Bytes))
+}
+
+func formatBytes(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("0x%02x", c)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Encode converts UTF8 text to e.
+func (e *Encoding) Encode(s string) ([]byte, error) {
+	if e.enc == nil {
+		return []byte(s), nil
+	}
+	b, _, err := transform.Bytes(e.enc.NewEncoder(), []byte(s))
+	if err == nil {
+		return b, nil
+	}
+
+	// Find the offending character for the error message.
+	enc := e.enc.NewEncoder()
+	for _, r := range s {
+		if _, err := enc.String(string(r)); err != nil {
+			return nil, &UntranslatableError{Bytes: []byte(string(r)), From: UTF8.Name, To: e.Name}
+		}
+	}
+	return nil, err
+}
+
+// EncodeLossy converts UTF8 text to e, replacing characters which cannot be
+// represented. It is used for messages, which must get through regardless.
+func (e *Encoding) EncodeLossy(s string) []byte {
+	if e.enc == nil {
+		return []byte(s)
+	}
+	b, _, err := transform.Bytes(xencoding.ReplaceUnsupported(e.enc.NewEncoder()), []byte(s))
+	if err != nil {
+		return []byte(s)
+	}
+	return b
+}
+
+// Decode converts text in e to UTF8.
+func (e *Encoding) Decode(b []byte) (string, error) {
+	if e.enc == nil {
+		if e == UTF8 && !utf8.Valid(b) {
+			return "", &InvalidByteSequenceError{Bytes: invalidUTF8(b), Encoding: e.Name}
+		}
+		return string(b), nil
+	}
+
+	s, _, err := transform.Bytes(e.enc.NewDecoder(), b)
+	if err != nil {
+		return "", err
+	}
+	// The decoders substitute U+FFFD for invalid input. Report that as an
+	// error, unless the input really did encode U+FFFD.
+	if bytes.IndexRune(s, utf8.RuneError) >= 0 {
+		if replacement, err := e.enc.NewEncoder().String(string(utf8.RuneError)); err != nil ||
+			!bytes.Contains(b, []byte(replacement)) {
+			return "", &InvalidByteSequenceError{Bytes: e.invalidPrefix(b), Encoding: e.Name}
+		}
+	}
+	return string(s), nil
+}
+
+// invalidPrefix returns the first bytes of the first invalid character in b.
+// It is only used to build error messages, so it simply decodes ever longer
+// prefixes of b.
+func (e *Encoding) invalidPrefix(b []byte) []byte {
+	last := 0
+	for i := 1; i <= len(b); i++ {
+		s, _, err := transform.Bytes(e.enc.NewDecoder(), b[:i])
+		if err == nil && bytes.IndexRune(s, utf8.RuneError) < 0 {
+			last = i
+		}
+	}
+	end := last + 2
+	if end > len(b) {
+		end = len(b)
+	}
+	return b[last:end]
+}
+
+func invalidUTF8(b []byte) []byte {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return b[i : i+1]
+		}
+		i += size
+	}
+	return nil
+}
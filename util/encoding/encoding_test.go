@@ -0,0 +1,105 @@
+package encoding
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"UTF8", "UTF8"},
+		{"unicode", "UTF8"},
+		{"utf-8", "UTF8"},
+		{"latin1", "LATIN1"},
+		{"ISO-8859-1", "LATIN1"},
+		{"gbk", "GBK"},
+		{"cp936", "GBK"},
+		{"euc_jp", "EUC_JP"},
+		{"Shift_JIS", "SJIS"},
+		{"Big5", "BIG5"},
+		{"sql_ascii", "SQL_ASCII"},
+	} {
+		e, err := Lookup(test.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if e.Name != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, e.Name)
+		}
+	}
+
+	if _, err := Lookup("EBCDIC"); err == nil {
+		t.Errorf("expected an error for an unknown encoding")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		encoding string
+		text     string
+		encoded  []byte
+	}{
+		{"LATIN1", "café", []byte("caf\xe9")},
+		{"WIN1252", "€5", []byte("\x805")},
+		{"GBK", "中文", []byte("\xd6\xd0\xce\xc4")},
+		{"GB18030", "中文", []byte("\xd6\xd0\xce\xc4")},
+		{"EUC_JP", "日本", []byte("\xc6\xfc\xcb\xdc")},
+		{"SJIS", "日本", []byte("\x93\xfa\x96\x7b")},
+		{"BIG5", "中文", []byte("\xa4\xa4\xa4\xe5")},
+		{"UTF8", "中文", []byte("中文")},
+	} {
+		e, err := Lookup(test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.Encode(test.text)
+		if err != nil {
+			t.Errorf("%s: unexpected error encoding %q: %s", test.encoding, test.text, err)
+			continue
+		}
+		if !bytes.Equal(b, test.encoded) {
+			t.Errorf("%s: expected %q, got %q", test.encoding, test.encoded, b)
+		}
+		s, err := e.Decode(b)
+		if err != nil {
+			t.Errorf("%s: unexpected error decoding %q: %s", test.encoding, b, err)
+			continue
+		}
+		if s != test.text {
+			t.Errorf("%s: expected %q, got %q", test.encoding, test.text, s)
+		}
+	}
+}
+
+func TestUntranslatable(t *testing.T) {
+	e, _ := Lookup("LATIN1")
+	_, err := e.Encode("price: 5€")
+	if _, ok := err.(*UntranslatableError); !ok {
+		t.Fatalf("expected UntranslatableError, got %v", err)
+	}
+	expected := `character with byte sequence 0xe2 0x82 0xac in encoding "UTF8" has no equivalent in encoding "LATIN1"`
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err)
+	}
+
+	if b := e.EncodeLossy("5€"); string(b) != "5\x1a" && string(b) != "5?" {
+		t.Errorf("unexpected lossy encoding %q", b)
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+	e, _ := Lookup("GBK")
+	_, err := e.Decode([]byte("ok\xff\xff"))
+	if _, ok := err.(*InvalidByteSequenceError); !ok {
+		t.Fatalf("expected InvalidByteSequenceError, got %v", err)
+	}
+
+	_, err = UTF8.Decode([]byte("ok\xc3"))
+	if _, ok := err.(*InvalidByteSequenceError); !ok {
+		t.Fatalf("expected InvalidByteSequenceError, got %v", err)
+	}
+}